@@ -60,6 +60,13 @@ type Sym64 struct {
 	Size  uint64 /* Size of associated object. */
 }
 
+type Chdr64 struct {
+	Type      uint32 /* Compression format. */
+	Reserved  uint32
+	Size      uint64 /* Uncompressed data size. */
+	Addralign uint64 /* Uncompressed data alignment. */
+}
+
 type ArHeadher struct {
 	Name [16]byte
 	Date [12]byte
@@ -72,6 +79,7 @@ type ArHeadher struct {
 
 type InputFile struct {
 	File         *File
+	Is64         bool
 	Sections     []SectionHeader
 	FirstGlobal  int
 	SymTable     []Sym64
@@ -89,21 +97,28 @@ type Rela struct {
 	Addend int64
 }
 
-const PageSize = 4096
 const IMAGE_BASE uint64 = 0x200000
 const EF_RISCV_RVC uint32 = 1
+const EF_RISCV_FLOAT_ABI uint32 = 6
+const EF_RISCV_FLOAT_ABI_SOFT uint32 = 0
+const EF_RISCV_FLOAT_ABI_SINGLE uint32 = 2
+const EF_RISCV_FLOAT_ABI_DOUBLE uint32 = 4
+const EF_RISCV_FLOAT_ABI_QUAD uint32 = 6
+const EF_RISCV_RVE uint32 = 8
+const EF_RISCV_TSO uint32 = 0x10
 const ELFHeaderSize = unsafe.Sizeof(Header64{})
 const ProgramHeaderSize = unsafe.Sizeof(ProgramHeader{})
 const SectionHeaderSize = unsafe.Sizeof(SectionHeader{})
 const SymbolSize = unsafe.Sizeof(Sym64{})
 const ArHeaderSize = unsafe.Sizeof(ArHeadher{})
 const RelaSize = unsafe.Sizeof(Rela{})
+const ChdrSize = unsafe.Sizeof(Chdr64{})
 
 // InputFile method
 func NewInputFile(file *File) InputFile {
 	elfFile := InputFile{File: file}
 
-	if len(file.Contents) < int(ELFHeaderSize) {
+	if len(file.Contents) < int(ELF32HeaderSize) {
 		utils.Fatal("ELF file too small!")
 	}
 
@@ -111,24 +126,23 @@ func NewInputFile(file *File) InputFile {
 		utils.Fatal("Not an ELF file!")
 	}
 
-	elfHeader := utils.Read[elf.Header64](file.Contents)
+	elfFile.Is64 = elf.Class(file.Contents[elf.EI_CLASS]) == elf.ELFCLASS64
+	if elfFile.Is64 && len(file.Contents) < int(ELFHeaderSize) {
+		utils.Fatal("ELF file too small!")
+	}
+
+	elfHeader := ReadEhdr(file.Contents)
 
 	contents := file.Contents[elfHeader.Shoff:]
 
-	sectionHeader := utils.Read[SectionHeader](contents)
+	sectionHeader := ReadShdrs(contents, 1, elfFile.Is64)[0]
 	sectionNumber := uint64(elfHeader.Shnum)
 
 	if sectionNumber == 0 {
 		sectionNumber = uint64(sectionHeader.Size)
 	}
 
-	elfFile.Sections = []SectionHeader{sectionHeader}
-
-	for sectionNumber > 1 {
-		contents = contents[SectionHeaderSize:]
-		elfFile.Sections = append(elfFile.Sections, utils.Read[SectionHeader](contents))
-		sectionNumber--
-	}
+	elfFile.Sections = ReadShdrs(contents, sectionNumber, elfFile.Is64)
 
 	shstrndx := uint64(elfHeader.Shstrndx)
 
@@ -173,12 +187,12 @@ func (file *InputFile) FindSection(type_ uint32) *SectionHeader {
 }
 
 func (file *InputFile) GetEhdr() Header64 {
-	return utils.Read[Header64](file.File.Contents)
+	return ReadEhdr(file.File.Contents)
 }
 
 func (file *InputFile) FillUpSymbols(s *SectionHeader) {
 	symContents := file.GetBytesFromShdr(s)
-	file.SymTable = utils.ReadSlice[Sym64](symContents, int(SymbolSize))
+	file.SymTable = ReadSyms(symContents, file.Is64)
 }
 
 // ArHeader methods
@@ -229,3 +243,11 @@ func (s *Sym64) IsUndef() bool {
 func (s *Sym64) IsCommon() bool {
 	return s.Shndx == uint16(elf.SHN_COMMON)
 }
+
+func (s *Sym64) Type() uint8 {
+	return s.Info & 0xf
+}
+
+func (s *Sym64) Bind() uint8 {
+	return s.Info >> 4
+}
@@ -0,0 +1,455 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"rvld/pkg/utils"
+	"sort"
+)
+
+// TargetARM64 is the backend for AArch64 executables and shared
+// libraries.
+type TargetARM64 struct{}
+
+func (t *TargetARM64) MachineType() MachineType {
+	return MachineTypeARM64
+}
+
+func (t *TargetARM64) ELFMachine() elf.Machine {
+	return elf.EM_AARCH64
+}
+
+// PageSize is 64KiB so that the output also runs on kernels configured
+// with the largest page size.
+func (t *TargetARM64) PageSize() uint64 {
+	return 65536
+}
+
+func (t *TargetARM64) MergeFlags(ctx *Context) uint32 {
+	return 0
+}
+
+// TpAddr returns the value of TPIDR_EL0. It points to a 16 bytes
+// thread control block which is followed by the TLS block.
+func (t *TargetARM64) TpAddr(tls *ProgramHeader) uint64 {
+	return tls.VAddr - utils.AlignTo(16, tls.Align)
+}
+
+func (t *TargetARM64) ScanRelocations(ctx *Context, i *InputSection) {
+	for _, rel := range i.GetRels() {
+		sym := i.File.Symbols[rel.Sym]
+		// The LO12 relocations need no attention, as they come in pairs
+		// with an ADRP that is scanned.
+		typ := elf.R_AARCH64(rel.Type)
+		switch typ {
+		case elf.R_AARCH64_ABS64:
+			i.ScanAbsWord(ctx, sym, typ)
+		case elf.R_AARCH64_ABS32:
+			i.ScanAbs(ctx, sym, typ)
+		case elf.R_AARCH64_PREL32, elf.R_AARCH64_PREL64, elf.R_AARCH64_ADR_PREL_PG_HI21,
+			elf.R_AARCH64_ADR_PREL_PG_HI21_NC, elf.R_AARCH64_ADR_PREL_LO21:
+			i.ScanPcRel(ctx, sym, typ)
+		case elf.R_AARCH64_CALL26, elf.R_AARCH64_JUMP26:
+			sym.MarkCall(ctx)
+		case elf.R_AARCH64_ADR_GOT_PAGE, elf.R_AARCH64_LD64_GOT_LO12_NC:
+			sym.Flags |= NeedsGot
+		case elf.R_AARCH64_TLSIE_ADR_GOTTPREL_PAGE21, elf.R_AARCH64_TLSIE_LD64_GOTTPREL_LO12_NC:
+			sym.Flags |= NeedsGotTp
+		case elf.R_AARCH64_TLSGD_ADR_PAGE21, elf.R_AARCH64_TLSGD_ADD_LO12_NC:
+			sym.Flags |= NeedsTlsGd
+		case elf.R_AARCH64_TLSLE_ADD_TPREL_HI12, elf.R_AARCH64_TLSLE_ADD_TPREL_LO12,
+			elf.R_AARCH64_TLSLE_ADD_TPREL_LO12_NC:
+			i.ScanTlsLe(ctx, sym, typ)
+		}
+	}
+}
+
+func (t *TargetARM64) ApplyRelocAlloc(ctx *Context, i *InputSection, base []byte) {
+	for _, rel := range i.GetRels() {
+		if rel.Type == uint32(elf.R_AARCH64_NONE) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		S, A := i.GetSymAddrAndAddend(rel)
+		P := i.GetAddr() + rel.Offset
+
+		overflow := func(val uint64, bits int) {
+			if !isInt(val, bits) {
+				utils.Fatal(fmt.Sprintf("%s: %s: relocation %v against %s out of range: %d is not in [%d, %d)",
+					i.File.File.DisplayName(), i.Name(), elf.R_AARCH64(rel.Type), sym.Name,
+					int64(val), -(int64(1) << (bits - 1)), int64(1)<<(bits-1)))
+			}
+		}
+
+		switch elf.R_AARCH64(rel.Type) {
+		case elf.R_AARCH64_ABS64:
+			i.ApplyAbsWord(ctx, loc, rel, S, A)
+		case elf.R_AARCH64_ABS32:
+			utils.Write(loc, uint32(S+A))
+		case elf.R_AARCH64_PREL32:
+			utils.Write(loc, uint32(S+A-P))
+		case elf.R_AARCH64_PREL64:
+			utils.Write(loc, S+A-P)
+		case elf.R_AARCH64_ADR_PREL_PG_HI21:
+			val := Page(S+A) - Page(P)
+			overflow(val, 33)
+			WriteAdr(loc, val>>12)
+		case elf.R_AARCH64_ADR_PREL_PG_HI21_NC:
+			WriteAdr(loc, (Page(S+A)-Page(P))>>12)
+		case elf.R_AARCH64_ADR_PREL_LO21:
+			val := S + A - P
+			overflow(val, 21)
+			WriteAdr(loc, val)
+		case elf.R_AARCH64_ADD_ABS_LO12_NC, elf.R_AARCH64_LDST8_ABS_LO12_NC:
+			WriteImm12(loc, S+A, 0)
+		case elf.R_AARCH64_LDST16_ABS_LO12_NC:
+			WriteImm12(loc, S+A, 1)
+		case elf.R_AARCH64_LDST32_ABS_LO12_NC:
+			WriteImm12(loc, S+A, 2)
+		case elf.R_AARCH64_LDST64_ABS_LO12_NC:
+			WriteImm12(loc, S+A, 3)
+		case elf.R_AARCH64_LDST128_ABS_LO12_NC:
+			WriteImm12(loc, S+A, 4)
+		case elf.R_AARCH64_CALL26, elf.R_AARCH64_JUMP26:
+			if sym.PltIdx >= 0 {
+				S = sym.GetPltAddr(ctx)
+			}
+			val := S + A - P
+			if sym.File == nil {
+				// A call to an unresolved weak function falls through.
+				val = 4
+			}
+			if !isInt(val, 28) {
+				thunk := i.OutputSection.FindThunk(sym, rel.Addend, P)
+				if thunk == 0 {
+					utils.Fatal(fmt.Sprintf("%s: %s: no range extension thunk for %s",
+						i.File.File.DisplayName(), i.Name(), sym.Name))
+				}
+				val = thunk - P
+			}
+			utils.Write(loc, utils.Read[uint32](loc)&^0x3ffffff|uint32(val>>2)&0x3ffffff)
+		case elf.R_AARCH64_CONDBR19:
+			val := S + A - P
+			overflow(val, 21)
+			utils.Write(loc, utils.Read[uint32](loc)&^(0x7ffff<<5)|uint32(val>>2)&0x7ffff<<5)
+		case elf.R_AARCH64_TSTBR14:
+			val := S + A - P
+			overflow(val, 16)
+			utils.Write(loc, utils.Read[uint32](loc)&^(0x3fff<<5)|uint32(val>>2)&0x3fff<<5)
+		case elf.R_AARCH64_ADR_GOT_PAGE:
+			WriteAdr(loc, (Page(sym.GetGotAddr(ctx)+A)-Page(P))>>12)
+		case elf.R_AARCH64_LD64_GOT_LO12_NC:
+			WriteImm12(loc, sym.GetGotAddr(ctx)+A, 3)
+		case elf.R_AARCH64_TLSGD_ADR_PAGE21:
+			WriteAdr(loc, (Page(sym.GetTlsGdAddr(ctx)+A)-Page(P))>>12)
+		case elf.R_AARCH64_TLSGD_ADD_LO12_NC:
+			WriteImm12(loc, sym.GetTlsGdAddr(ctx)+A, 0)
+		case elf.R_AARCH64_TLSIE_ADR_GOTTPREL_PAGE21:
+			WriteAdr(loc, (Page(sym.GetGotTpAddr(ctx)+A)-Page(P))>>12)
+		case elf.R_AARCH64_TLSIE_LD64_GOTTPREL_LO12_NC:
+			WriteImm12(loc, sym.GetGotTpAddr(ctx)+A, 3)
+		case elf.R_AARCH64_TLSLE_ADD_TPREL_HI12:
+			val := S + A - ctx.TpAddr
+			if val >= 1<<24 {
+				utils.Fatal(fmt.Sprintf("%s: %s: TLS offset of %s is too large for the local-exec model",
+					i.File.File.DisplayName(), i.Name(), sym.Name))
+			}
+			WriteImm12(loc, val>>12, 0)
+		case elf.R_AARCH64_TLSLE_ADD_TPREL_LO12, elf.R_AARCH64_TLSLE_ADD_TPREL_LO12_NC:
+			WriteImm12(loc, S+A-ctx.TpAddr, 0)
+		default:
+			utils.Fatal(fmt.Sprintf("%s: %s: unsupported relocation: %v",
+				i.File.File.DisplayName(), i.Name(), elf.R_AARCH64(rel.Type)))
+		}
+	}
+}
+
+func (t *TargetARM64) ApplyRelocNonAlloc(ctx *Context, i *InputSection, base []byte) {
+	for _, rel := range i.GetRels() {
+		if rel.Type == uint32(elf.R_AARCH64_NONE) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		if sym.File == nil {
+			continue
+		}
+
+		S, A := i.GetSymAddrAndAddend(rel)
+
+		switch elf.R_AARCH64(rel.Type) {
+		case elf.R_AARCH64_ABS32, elf.R_AARCH64_ABS64:
+			if tombstone, ok := i.GetTombstone(rel); ok {
+				S, A = tombstone, 0
+			}
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		case elf.R_AARCH64_TLS_DTPREL64:
+			utils.Write(loc, S+A-ctx.TlsBegin)
+		default:
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		}
+	}
+}
+
+func (t *TargetARM64) ApplyDataReloc(loc []byte, typ uint32, S, A, P uint64) {
+	val := S + A
+
+	switch elf.R_AARCH64(typ) {
+	case elf.R_AARCH64_NONE:
+	case elf.R_AARCH64_ABS32:
+		utils.Write(loc, uint32(val))
+	case elf.R_AARCH64_ABS64:
+		utils.Write(loc, val)
+	case elf.R_AARCH64_PREL32:
+		utils.Write(loc, uint32(val-P))
+	case elf.R_AARCH64_PREL64:
+		utils.Write(loc, val-P)
+	default:
+		utils.Fatal(fmt.Sprintf("unsupported relocation in data section: %v", elf.R_AARCH64(typ)))
+	}
+}
+
+func (t *TargetARM64) DynamicLinker(ctx *Context) string {
+	return "/lib/ld-linux-aarch64.so.1"
+}
+
+func (t *TargetARM64) DynRelocs() DynRelocTypes {
+	return DynRelocTypes{
+		Abs:       uint32(elf.R_AARCH64_ABS64),
+		Relative:  uint32(elf.R_AARCH64_RELATIVE),
+		GlobDat:   uint32(elf.R_AARCH64_GLOB_DAT),
+		JumpSlot:  uint32(elf.R_AARCH64_JUMP_SLOT),
+		Copy:      uint32(elf.R_AARCH64_COPY),
+		TpOff:     uint32(elf.R_AARCH64_TLS_TPREL64),
+		DtpMod:    uint32(elf.R_AARCH64_TLS_DTPMOD64),
+		DtpOff:    uint32(elf.R_AARCH64_TLS_DTPREL64),
+		IRelative: uint32(elf.R_AARCH64_IRELATIVE),
+	}
+}
+
+func (t *TargetARM64) PltHeaderSize() uint64 {
+	return 32
+}
+
+func (t *TargetARM64) PltEntrySize() uint64 {
+	return 16
+}
+
+func (t *TargetARM64) GotPltHeaderSize(ctx *Context) uint64 {
+	return 24
+}
+
+func (t *TargetARM64) WritePltHeader(ctx *Context, buf []byte) {
+	insns := []uint32{
+		0xa9bf_7bf0, // stp  x16, x30, [sp, #-16]!
+		0x9000_0010, // adrp x16, .got.plt[2]
+		0xf940_0211, // ldr  x17, [x16, .got.plt[2]]
+		0x9100_0210, // add  x16, x16, .got.plt[2]
+		0xd61f_0220, // br   x17
+		0xd503_201f, // nop
+		0xd503_201f, // nop
+		0xd503_201f, // nop
+	}
+	for i, insn := range insns {
+		utils.Write(buf[i*4:], insn)
+	}
+
+	gotplt := ctx.GotPlt.Shdr.Addr + 16
+	plt := ctx.Plt.Shdr.Addr
+	WriteAdr(buf[4:], (Page(gotplt)-Page(plt+4))>>12)
+	WriteImm12(buf[8:], gotplt, 3)
+	WriteImm12(buf[12:], gotplt, 0)
+}
+
+func (t *TargetARM64) WritePltEntry(ctx *Context, buf []byte, sym *Symbol) {
+	insns := []uint32{
+		0x9000_0010, // adrp x16, foo@.got.plt
+		0xf940_0211, // ldr  x17, [x16, foo@.got.plt]
+		0x9100_0210, // add  x16, x16, foo@.got.plt
+		0xd61f_0220, // br   x17
+	}
+	for i, insn := range insns {
+		utils.Write(buf[i*4:], insn)
+	}
+
+	gotplt := sym.GetGotPltAddr(ctx)
+	WriteAdr(buf, (Page(gotplt)-Page(sym.GetPltAddr(ctx)))>>12)
+	WriteImm12(buf[4:], gotplt, 3)
+	WriteImm12(buf[8:], gotplt, 0)
+}
+
+func (t *TargetARM64) GotPltEntry(ctx *Context, sym *Symbol) uint64 {
+	return ctx.Plt.Shdr.Addr
+}
+
+func Page(val uint64) uint64 {
+	return val &^ 0xfff
+}
+
+func isInt(val uint64, bits int) bool {
+	v := int64(val) >> (bits - 1)
+	return v == 0 || v == -1
+}
+
+// WriteAdr writes the 21-bit immediate of ADR or ADRP.
+func WriteAdr(loc []byte, val uint64) {
+	hi := uint32(val>>2) & 0x7ffff
+	lo := uint32(val) & 3
+	utils.Write(loc, utils.Read[uint32](loc)&0x9f00001f|lo<<29|hi<<5)
+}
+
+// WriteImm12 writes the low 12 bits of val, scaled down by the access
+// size for loads and stores, to the imm12 field of an instruction.
+func WriteImm12(loc []byte, val uint64, shift int) {
+	imm := uint32(val&0xfff) >> shift
+	utils.Write(loc, utils.Read[uint32](loc)&^(0xfff<<10)|imm<<10)
+}
+
+// A B or BL instruction reaches ±128MiB. Executable sections are split
+// into batches smaller than that, and a thunk placed after each batch
+// provides a hop to the targets its branches cannot reach directly.
+// The margin leaves room for the thunks themselves.
+const thunkBatchSize = 100 * 1024 * 1024
+const thunkMargin = 16 * 1024 * 1024
+
+// ThunkEntrySize is the size of adrp x16; add x16, x16, lo12; br x16.
+const ThunkEntrySize = 12
+
+type ThunkEntry struct {
+	Sym    *Symbol
+	Addend int64
+}
+
+type Thunk struct {
+	Offset  uint64
+	Entries []ThunkEntry
+}
+
+func (t *Thunk) Size() uint64 {
+	return uint64(len(t.Entries)) * ThunkEntrySize
+}
+
+func (t *Thunk) CopyBuf(ctx *Context, base []byte, addr uint64) {
+	for i, ent := range t.Entries {
+		loc := base[i*ThunkEntrySize:]
+		P := addr + uint64(i)*ThunkEntrySize
+		S := ent.Sym.GetCallAddr(ctx) + uint64(ent.Addend)
+
+		utils.Write[uint32](loc, 0x90000010)     // adrp x16, 0
+		utils.Write[uint32](loc[4:], 0x91000210) // add  x16, x16, 0
+		utils.Write[uint32](loc[8:], 0xd61f0200) // br   x16
+		WriteAdr(loc, (Page(S)-Page(P))>>12)
+		WriteImm12(loc[4:], S, 0)
+	}
+}
+
+// FindThunk returns the address of a thunk entry for sym+addend that is
+// reachable from P, or 0 if there is none.
+func (o *OutputSection) FindThunk(sym *Symbol, addend int64, P uint64) uint64 {
+	for _, t := range o.Thunks {
+		for i, ent := range t.Entries {
+			addr := o.Shdr.Addr + t.Offset + uint64(i)*ThunkEntrySize
+			if ent.Sym == sym && ent.Addend == addend && isInt(addr-P, 28) {
+				return addr
+			}
+		}
+	}
+	return 0
+}
+
+// CreateThunks inserts range extension thunks into executable output
+// sections. Which branches need one is decided with the addresses of
+// the current layout.
+func (t *TargetARM64) CreateThunks(ctx *Context) bool {
+	changed := false
+	for _, osec := range ctx.OutputSections {
+		if osec.Shdr.Flags&uint64(elf.SHF_EXECINSTR) == 0 {
+			continue
+		}
+
+		needs := make(map[*InputSection][]ThunkEntry)
+		for _, isec := range osec.Members {
+			for _, rel := range isec.GetRels() {
+				typ := elf.R_AARCH64(rel.Type)
+				if typ != elf.R_AARCH64_CALL26 && typ != elf.R_AARCH64_JUMP26 {
+					continue
+				}
+
+				sym := isec.File.Symbols[rel.Sym]
+				if sym.File == nil {
+					continue
+				}
+
+				val := int64(sym.GetCallAddr(ctx) + uint64(rel.Addend) - isec.GetAddr() - rel.Offset)
+				if val < -(1<<27)+thunkMargin || (1<<27)-thunkMargin <= val {
+					needs[isec] = append(needs[isec], ThunkEntry{sym, rel.Addend})
+				}
+			}
+		}
+
+		if len(needs) == 0 {
+			continue
+		}
+
+		// Thunks move the members of the section, which would undo
+		// where a linker script placed them.
+		if HasSectionsCommand(ctx) {
+			utils.Fatal(fmt.Sprintf("%s: branches out of range need thunks, "+
+				"which are not supported with a SECTIONS command", osec.Name))
+		}
+
+		changed = true
+		osec.Thunks = nil
+		offset := uint64(0)
+		batchStart := uint64(0)
+		var batch []*InputSection
+
+		flush := func() {
+			t := &Thunk{}
+			seen := make(map[ThunkEntry]bool)
+			for _, isec := range batch {
+				for _, ent := range needs[isec] {
+					if !seen[ent] {
+						seen[ent] = true
+						t.Entries = append(t.Entries, ent)
+					}
+				}
+			}
+			batch = nil
+
+			if len(t.Entries) > 0 {
+				sort.SliceStable(t.Entries, func(i, j int) bool {
+					return t.Entries[i].Sym.Name < t.Entries[j].Sym.Name
+				})
+				offset = utils.AlignTo(offset, 4)
+				t.Offset = offset
+				offset += t.Size()
+				osec.Thunks = append(osec.Thunks, t)
+			}
+		}
+
+		for _, isec := range osec.Members {
+			start := utils.AlignTo(offset, 1<<isec.P2Align)
+			if len(batch) > 0 && start+uint64(isec.ShSize)-batchStart > thunkBatchSize {
+				flush()
+				start = utils.AlignTo(offset, 1<<isec.P2Align)
+			}
+
+			if len(batch) == 0 {
+				batchStart = start
+			}
+			batch = append(batch, isec)
+			isec.Offset = uint32(start)
+			offset = start + uint64(isec.ShSize)
+		}
+		flush()
+
+		osec.Shdr.Size = offset
+	}
+	return changed
+}
@@ -0,0 +1,168 @@
+package linker
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"rvld/pkg/utils"
+	"strings"
+	"sync"
+)
+
+type BuildIdKind = uint8
+
+const (
+	BuildIdNone   BuildIdKind = iota
+	BuildIdMd5    BuildIdKind = iota
+	BuildIdSha1   BuildIdKind = iota
+	BuildIdSha256 BuildIdKind = iota
+	BuildIdFast   BuildIdKind = iota
+	BuildIdUuid   BuildIdKind = iota
+	BuildIdHex    BuildIdKind = iota
+)
+
+const NT_GNU_BUILD_ID uint32 = 3
+
+// ParseBuildId interprets the argument of --build-id=.
+func ParseBuildId(ctx *Context, arg string) {
+	switch arg {
+	case "none":
+		ctx.Args.BuildId = BuildIdNone
+	case "md5":
+		ctx.Args.BuildId = BuildIdMd5
+	case "sha1", "tree":
+		ctx.Args.BuildId = BuildIdSha1
+	case "sha256":
+		ctx.Args.BuildId = BuildIdSha256
+	case "fast":
+		ctx.Args.BuildId = BuildIdFast
+	case "uuid":
+		ctx.Args.BuildId = BuildIdUuid
+	default:
+		s, ok := utils.RemovePrefix(arg, "0x")
+		if !ok {
+			utils.Fatal(fmt.Sprintf("invalid --build-id argument: %s", arg))
+		}
+
+		val, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+		if err != nil || len(val) == 0 {
+			utils.Fatal(fmt.Sprintf("invalid --build-id argument: %s", arg))
+		}
+
+		ctx.Args.BuildId = BuildIdHex
+		ctx.Args.BuildIdValue = val
+	}
+}
+
+type BuildIdSection struct {
+	Chunk
+}
+
+func NewBuildIdSection(ctx *Context) *BuildIdSection {
+	b := &BuildIdSection{
+		Chunk: NewChunk(),
+	}
+
+	b.Name = ".note.gnu.build-id"
+	b.Shdr.Type = uint32(elf.SHT_NOTE)
+	b.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	b.Shdr.Addralign = 4
+	b.Shdr.Size = 16 + uint64(b.DescSize(ctx))
+
+	return b
+}
+
+func (b *BuildIdSection) DescSize(ctx *Context) int {
+	switch ctx.Args.BuildId {
+	case BuildIdMd5, BuildIdUuid:
+		return 16
+	case BuildIdSha1:
+		return 20
+	case BuildIdSha256:
+		return 32
+	case BuildIdFast:
+		return 8
+	case BuildIdHex:
+		return len(ctx.Args.BuildIdValue)
+	}
+
+	utils.Assert(false)
+	return 0
+}
+
+// CopyBuf writes the note header. The descriptor is left zero-filled
+// and filled in by WriteBuildId after the rest of the output is done.
+func (b *BuildIdSection) CopyBuf(ctx *Context) {
+	buf := ctx.Buf[b.Shdr.Offset:]
+	utils.Write[uint32](buf, 4)
+	utils.Write[uint32](buf[4:], uint32(b.DescSize(ctx)))
+	utils.Write[uint32](buf[8:], NT_GNU_BUILD_ID)
+	copy(buf[12:], "GNU\x00")
+
+	for i := 16; i < int(b.Shdr.Size); i++ {
+		buf[i] = 0
+	}
+}
+
+const buildIdShardSize = 4 * 1024 * 1024
+
+// WriteBuildId computes the build ID over the whole output image. The
+// image is hashed in shards concurrently, and the build ID is the hash
+// of the shard digests.
+func (b *BuildIdSection) WriteBuildId(ctx *Context) {
+	desc := ctx.Buf[b.Shdr.Offset+16 : b.Shdr.Offset+b.Shdr.Size]
+
+	var newHash func() hash.Hash
+	switch ctx.Args.BuildId {
+	case BuildIdHex:
+		copy(desc, ctx.Args.BuildIdValue)
+		return
+	case BuildIdUuid:
+		_, err := rand.Read(desc)
+		utils.MustNo(err)
+		// Mark it as a version 4, variant 1 UUID.
+		desc[6] = desc[6]&0x0f | 0x40
+		desc[8] = desc[8]&0x3f | 0x80
+		return
+	case BuildIdMd5:
+		newHash = md5.New
+	case BuildIdSha1:
+		newHash = sha1.New
+	case BuildIdSha256:
+		newHash = sha256.New
+	case BuildIdFast:
+		newHash = func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ECMA)) }
+	}
+
+	numShards := (len(ctx.Buf) + buildIdShardSize - 1) / buildIdShardSize
+	digests := make([][]byte, numShards)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numShards; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			end := (i + 1) * buildIdShardSize
+			if end > len(ctx.Buf) {
+				end = len(ctx.Buf)
+			}
+
+			h := newHash()
+			h.Write(ctx.Buf[i*buildIdShardSize : end])
+			digests[i] = h.Sum(nil)
+		}(i)
+	}
+	wg.Wait()
+
+	h := newHash()
+	for _, digest := range digests {
+		h.Write(digest)
+	}
+	copy(desc, h.Sum(nil))
+}
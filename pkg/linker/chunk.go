@@ -5,6 +5,7 @@ type Chunker interface {
 	GetShdr() *SectionHeader
 	UpdateShdr(ctx *Context)
 	GetShndx() int64
+	SetShndx(shndx int64)
 	CopyBuf(ctx *Context)
 }
 
@@ -36,6 +37,10 @@ func (c *Chunk) GetShndx() int64 {
 	return c.Shndx
 }
 
+func (c *Chunk) SetShndx(shndx int64) {
+	c.Shndx = shndx
+}
+
 func (c *Chunk) CopyBuf(ctx *Context) {
 
 }
@@ -0,0 +1,133 @@
+package linker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/elf"
+	"fmt"
+	"io"
+	"rvld/pkg/utils"
+	"strings"
+	"sync"
+)
+
+// ReadCompressionHeader returns the header of an SHF_COMPRESSED section
+// and the compressed data that follows it.
+func ReadCompressionHeader(file *File, name string, data []byte, is64 bool) (Chdr64, []byte) {
+	if (is64 && len(data) < int(ChdrSize)) || len(data) < int(Chdr32Size) {
+		utils.Fatal(fmt.Sprintf("%s: %s: corrupted compressed section", file.DisplayName(), name))
+	}
+
+	chdr, hdrSize := ReadChdr(data, is64)
+	return chdr, data[hdrSize:]
+}
+
+// DecompressSection inflates the contents of an SHF_COMPRESSED section,
+// the shndx-th of the file.
+func DecompressSection(file *File, shndx uint32, name string, data []byte, is64 bool) []byte {
+	chdr, data := ReadCompressionHeader(file, name, data, is64)
+
+	var r io.Reader
+	var err error
+	switch elf.CompressionType(chdr.Type) {
+	case elf.COMPRESS_ZLIB:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case elf.COMPRESS_ZSTD:
+		// The standard library decodes zstd only for debug/elf, which
+		// has to read the whole file to get to the section.
+		var f *elf.File
+		if f, err = elf.NewFile(bytes.NewReader(file.Contents)); err == nil {
+			r = f.Sections[shndx].Open()
+		}
+	default:
+		utils.Fatal(fmt.Sprintf("%s: %s: unsupported compression type: 0x%x", file.DisplayName(), name, chdr.Type))
+	}
+	if err != nil {
+		utils.Fatal(fmt.Sprintf("%s: %s: %v", file.DisplayName(), name, err))
+	}
+
+	out := make([]byte, chdr.Size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		utils.Fatal(fmt.Sprintf("%s: %s: uncompress failed: %v", file.DisplayName(), name, err))
+	}
+	return out
+}
+
+// CompressedSection replaces a non-allocated chunk in the output by a
+// copy of its contents compressed with zlib, prefixed by a compression
+// header of the output's ELF class.
+type CompressedSection struct {
+	Chunk
+	Original Chunker
+	Contents []byte
+}
+
+func NewCompressedSection(ctx *Context, chunk Chunker) *CompressedSection {
+	c := &CompressedSection{
+		Chunk:    NewChunk(),
+		Original: chunk,
+	}
+
+	shdr := chunk.GetShdr()
+	c.Name = chunk.GetName()
+	c.Shndx = chunk.GetShndx()
+	c.Shdr = *shdr
+
+	// Render the section into its own buffer. It is not allocated, so
+	// its contents do not depend on where it is placed in the file.
+	uncompressed := make([]byte, shdr.Size)
+	tmp := *ctx
+	tmp.Buf = uncompressed
+	offset := shdr.Offset
+	shdr.Offset = 0
+	chunk.CopyBuf(&tmp)
+	shdr.Offset = offset
+
+	buf := &bytes.Buffer{}
+	chdr := Chdr64{
+		Type:      uint32(elf.COMPRESS_ZLIB),
+		Size:      shdr.Size,
+		Addralign: shdr.Addralign,
+	}
+	buf.Write(EncodeChdr(ctx, chdr))
+
+	w := zlib.NewWriter(buf)
+	_, err := w.Write(uncompressed)
+	utils.MustNo(err)
+	utils.MustNo(w.Close())
+
+	c.Contents = buf.Bytes()
+	c.Shdr.Flags |= uint64(elf.SHF_COMPRESSED)
+	c.Shdr.Size = uint64(len(c.Contents))
+	c.Shdr.Addralign = WordSize(ctx)
+
+	return c
+}
+
+func (c *CompressedSection) CopyBuf(ctx *Context) {
+	copy(ctx.Buf[c.Shdr.Offset:], c.Contents)
+}
+
+// CompressDebugSections compresses all DWARF sections concurrently and
+// lays out the non-allocated part of the file again, since the sizes
+// have changed. It returns the new file size.
+func CompressDebugSections(ctx *Context) uint64 {
+	var wg sync.WaitGroup
+
+	for i, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		if shdr.Flags&uint64(elf.SHF_ALLOC) != 0 || shdr.Size == 0 ||
+			!strings.HasPrefix(chunk.GetName(), ".debug") {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, chunk Chunker) {
+			defer wg.Done()
+			ctx.Chunks[i] = NewCompressedSection(ctx, chunk)
+		}(i, chunk)
+	}
+
+	wg.Wait()
+	return SetOutputSectionOffsets(ctx)
+}
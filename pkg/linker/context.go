@@ -1,25 +1,92 @@
 package linker
 
+import "debug/elf"
+
 type ContextArgs struct {
 	Output       string
 	Emulation    MachineType
 	LibraryPaths []string
+	Entry        string
+	BuildId      BuildIdKind
+	BuildIdValue []byte
+	MapFile      string
+	MapFormat    string
+	PrintMap     bool
+
+	StripAll      bool
+	StripDebug    bool
+	DiscardAll    bool
+	DiscardLocals bool
+	EhFrameHdr    bool
+	Static        bool
+	Shared        bool
+	Pie           bool
+	Relocatable   bool
+	ExportDynamic bool
+
+	GcSections      bool
+	PrintGcSections bool
+	Undefined       []string
+
+	Icf              string
+	PrintIcfSections bool
+
+	// The state of --as-needed at the input file being read.
+	AsNeeded bool
+
+	DynamicLinker   string
+	NoDynamicLinker bool
+	Soname          string
+
+	// -z now and -z execstack.
+	ZNow       bool
+	ZExecStack bool
+
+	CompressDebugSections elf.CompressionType
 }
 
 type Context struct {
 	Args           ContextArgs
+	Target         Target
 	Objs           []*ObjectFile
+	Dsos           []*ObjectFile
 	SymbolMap      map[string]*Symbol
+	RetainSymbols  map[string]bool
+	Script         *LinkerScript
 	MergedSections []*MergedSection
-	// InternalObj    *ObjectFile
-	// InternalEsyms  []Sym64
+	InternalObj    *ObjectFile
+	InternalEsyms  []Sym64
 
 	Ehdr *OutputEhdr
 	Shdr *OutputShdr
 	Phdr *OutputPhdr
 	Got  *GotSection
 
-	TpAddr uint64
+	Symtab   *SymtabSection
+	Strtab   *StrtabSection
+	Shstrtab *ShstrtabSection
+
+	RiscvAttributes *RiscvAttributesSection
+	BuildId         *BuildIdSection
+	EhFrame         *EhFrameSection
+	EhFrameHdr      *EhFrameHdrSection
+
+	Interp  *InterpSection
+	Dynsym  *DynsymSection
+	Dynstr  *DynstrSection
+	Hash    *HashSection
+	Dynamic *DynamicSection
+	RelaDyn *RelaDynSection
+	Plt     *PltSection
+	GotPlt  *GotPltSection
+	RelaPlt *RelaPltSection
+	Copyrel *CopyrelSection
+
+	TlsBegin uint64
+	TpAddr   uint64
+
+	// e_flags of the output.
+	EFlags uint32
 
 	OutputSections []*OutputSection
 
@@ -30,8 +97,10 @@ type Context struct {
 func NewContext() *Context {
 	return &Context{
 		Args: ContextArgs{
-			Output:    "a.out",
-			Emulation: MachineTypeNone,
+			Output:     "a.out",
+			Emulation:  MachineTypeNone,
+			Entry:      "_start",
+			EhFrameHdr: true,
 		},
 		SymbolMap: make(map[string]*Symbol),
 	}
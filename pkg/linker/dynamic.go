@@ -0,0 +1,418 @@
+package linker
+
+import (
+	"debug/elf"
+	"rvld/pkg/utils"
+)
+
+// DynRelocTypes lists the relocation types a target uses for dynamic
+// relocations, so that the synthetic sections can stay generic.
+type DynRelocTypes struct {
+	Abs       uint32
+	Relative  uint32
+	GlobDat   uint32
+	JumpSlot  uint32
+	Copy      uint32
+	TpOff     uint32
+	DtpMod    uint32
+	DtpOff    uint32
+	IRelative uint32
+}
+
+// DF_1_PIE marks a position-independent executable, which cannot be
+// loaded as a library.
+const DF_1_PIE uint64 = 0x08000000
+
+// DF_1_NOW asks the dynamic linker to resolve all symbols at load time.
+const DF_1_NOW uint64 = 0x1
+
+// IsPic reports whether the output may be loaded at any address, so
+// that absolute addresses in it need dynamic relocations.
+func IsPic(ctx *Context) bool {
+	return ctx.Args.Shared || ctx.Args.Pie
+}
+
+// NeedsDynamicSections reports whether the output is processed by the
+// dynamic linker.
+func NeedsDynamicSections(ctx *Context) bool {
+	return len(ctx.Dsos) > 0 || IsPic(ctx)
+}
+
+func GetImageBase(ctx *Context) uint64 {
+	if IsPic(ctx) {
+		return 0
+	}
+	return IMAGE_BASE
+}
+
+func GetDynamicLinker(ctx *Context) string {
+	if ctx.Args.DynamicLinker != "" {
+		return ctx.Args.DynamicLinker
+	}
+	return ctx.Target.DynamicLinker(ctx)
+}
+
+type InterpSection struct {
+	Chunk
+}
+
+func NewInterpSection() *InterpSection {
+	i := &InterpSection{Chunk: NewChunk()}
+	i.Name = ".interp"
+	i.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	i.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	return i
+}
+
+func (i *InterpSection) UpdateShdr(ctx *Context) {
+	i.Shdr.Size = uint64(len(GetDynamicLinker(ctx))) + 1
+}
+
+func (i *InterpSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[i.Shdr.Offset:]
+	copy(base, GetDynamicLinker(ctx))
+	base[i.Shdr.Size-1] = 0
+}
+
+type DynstrSection struct {
+	ShstrtabSection
+}
+
+func NewDynstrSection() *DynstrSection {
+	d := &DynstrSection{ShstrtabSection: *NewShstrtabSection()}
+	d.Name = ".dynstr"
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	d.Shdr.Size = 1
+	return d
+}
+
+type DynsymSection struct {
+	Chunk
+	Syms []*Symbol
+}
+
+func NewDynsymSection(ctx *Context) *DynsymSection {
+	d := &DynsymSection{Chunk: NewChunk()}
+	d.Name = ".dynsym"
+	d.Shdr.Type = uint32(elf.SHT_DYNSYM)
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	d.Shdr.Entsize = SymSize(ctx)
+	d.Shdr.Addralign = WordSize(ctx)
+	d.Shdr.Info = 1
+	d.Syms = []*Symbol{nil}
+	return d
+}
+
+func (d *DynsymSection) AddSymbol(ctx *Context, sym *Symbol) {
+	if sym.DynsymIdx >= 0 {
+		return
+	}
+
+	sym.DynsymIdx = int32(len(d.Syms))
+	d.Syms = append(d.Syms, sym)
+	ctx.Dynstr.AddString(sym.Name)
+}
+
+func (d *DynsymSection) UpdateShdr(ctx *Context) {
+	d.Shdr.Size = uint64(len(d.Syms)) * SymSize(ctx)
+	d.Shdr.Link = uint32(ctx.Dynstr.Shndx)
+}
+
+func (d *DynsymSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[d.Shdr.Offset:]
+	utils.Write(base, make([]byte, SymSize(ctx)))
+
+	for i := 1; i < len(d.Syms); i++ {
+		sym := d.Syms[i]
+		esym := *sym.ELFSym()
+		esym.Name = ctx.Dynstr.Offsets[sym.Name]
+
+		switch {
+		case sym.IsImported() && sym.OutputChunk == ctx.Copyrel:
+			esym.Shndx = uint16(ctx.Copyrel.Shndx)
+			esym.Value = sym.GetAddr()
+		case sym.IsImported():
+			// A function with a PLT entry in an executable keeps its PLT
+			// address, so that the address is the same in all modules.
+			esym.Shndx = uint16(elf.SHN_UNDEF)
+			esym.Value = 0
+			if sym.PltIdx >= 0 && !ctx.Args.Shared {
+				esym.Value = sym.GetPltAddr(ctx)
+			}
+		default:
+			esym.Shndx = uint16(sym.GetOutputShndx())
+			esym.Value = sym.GetAddr()
+			if elf.SymType(esym.Type()) == elf.STT_TLS {
+				esym.Value -= ctx.TlsBegin
+			}
+		}
+
+		WriteSym(ctx, base[uint64(i)*SymSize(ctx):], esym)
+	}
+}
+
+// HashSection is the SysV .hash table, which the dynamic linker uses
+// to look up the symbols defined in .dynsym.
+type HashSection struct {
+	Chunk
+}
+
+func NewHashSection() *HashSection {
+	h := &HashSection{Chunk: NewChunk()}
+	h.Name = ".hash"
+	h.Shdr.Type = uint32(elf.SHT_HASH)
+	h.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	h.Shdr.Entsize = 4
+	h.Shdr.Addralign = 4
+	return h
+}
+
+func (h *HashSection) UpdateShdr(ctx *Context) {
+	num := uint64(len(ctx.Dynsym.Syms))
+	h.Shdr.Size = (2 + num*2) * 4
+	h.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+}
+
+func (h *HashSection) CopyBuf(ctx *Context) {
+	num := uint32(len(ctx.Dynsym.Syms))
+	buckets := make([]uint32, num)
+	chains := make([]uint32, num)
+
+	for i := uint32(1); i < num; i++ {
+		b := ElfHash(ctx.Dynsym.Syms[i].Name) % num
+		chains[i] = buckets[b]
+		buckets[b] = i
+	}
+
+	base := ctx.Buf[h.Shdr.Offset:]
+	utils.Write(base, num)
+	utils.Write(base[4:], num)
+	for i := uint32(0); i < num; i++ {
+		utils.Write(base[8+i*4:], buckets[i])
+		utils.Write(base[8+(num+i)*4:], chains[i])
+	}
+}
+
+func ElfHash(name string) uint32 {
+	h := uint32(0)
+	for _, c := range []byte(name) {
+		h = h<<4 + uint32(c)
+		g := h & 0xf000_0000
+		if g != 0 {
+			h ^= g >> 24
+		}
+		h &^= g
+	}
+	return h
+}
+
+// RelaDynSection starts with the relocations input sections emit while
+// they are copied, see InputSection.EmitDynReloc, followed by the ones
+// for synthetic sections.
+type RelaDynSection struct {
+	Chunk
+	NumSectionRelocs uint64
+}
+
+func NewRelaDynSection(ctx *Context) *RelaDynSection {
+	r := &RelaDynSection{Chunk: NewChunk()}
+	r.Name = ".rela.dyn"
+	r.Shdr.Type = uint32(elf.SHT_RELA)
+	r.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	r.Shdr.Entsize = RelaEntSize(ctx)
+	r.Shdr.Addralign = WordSize(ctx)
+	return r
+}
+
+// GetRelocs returns the relocations for synthetic sections. Their number does not
+// depend on the layout, so it can be called before addresses are known
+// to size the section.
+func (r *RelaDynSection) GetRelocs(ctx *Context) []Rela {
+	types := ctx.Target.DynRelocs()
+	rels := ctx.Got.GetDynRelocs(ctx)
+
+	for _, sym := range ctx.Copyrel.Syms {
+		rels = append(rels, Rela{Offset: sym.GetAddr(), Type: types.Copy, Sym: uint32(sym.DynsymIdx)})
+	}
+
+	return rels
+}
+
+func (r *RelaDynSection) UpdateShdr(ctx *Context) {
+	r.Shdr.Size = (r.NumSectionRelocs + uint64(len(r.GetRelocs(ctx)))) * RelaEntSize(ctx)
+	r.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+}
+
+func (r *RelaDynSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[r.Shdr.Offset+r.NumSectionRelocs*RelaEntSize(ctx):]
+	for i, rel := range r.GetRelocs(ctx) {
+		WriteRela(ctx, base[uint64(i)*RelaEntSize(ctx):], rel)
+	}
+}
+
+// CopyrelSection holds the copies of data objects that an executable
+// references directly in a shared library. The dynamic linker fills
+// them with R_*_COPY, and the library then uses the copy as well.
+type CopyrelSection struct {
+	Chunk
+	Syms []*Symbol
+}
+
+func NewCopyrelSection() *CopyrelSection {
+	c := &CopyrelSection{Chunk: NewChunk()}
+	c.Name = ".dynbss"
+	c.Shdr.Type = uint32(elf.SHT_NOBITS)
+	c.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	return c
+}
+
+func (c *CopyrelSection) AddSymbol(ctx *Context, sym *Symbol) {
+	if sym.OutputChunk == c {
+		return
+	}
+
+	dso := sym.File
+	esym := *sym.ELFSym()
+
+	// The copy cannot be aligned more strictly than the original, as
+	// far as can be told from its address.
+	align := uint64(1)
+	if int(esym.Shndx) < len(dso.InputFile.Sections) && dso.InputFile.Sections[esym.Shndx].Addralign > 1 {
+		align = dso.InputFile.Sections[esym.Shndx].Addralign
+	}
+	if esym.Value != 0 && esym.Value&-esym.Value < align {
+		align = esym.Value & -esym.Value
+	}
+
+	offset := utils.AlignTo(c.Shdr.Size, align)
+	c.Shdr.Size = offset + esym.Size
+	if c.Shdr.Addralign < align {
+		c.Shdr.Addralign = align
+	}
+	c.Syms = append(c.Syms, sym)
+
+	// Aliases, e.g. environ and __environ, must refer to the copy too,
+	// or the library would keep using its own instance.
+	for i := dso.FirstGlobal; i < len(dso.Symbols); i++ {
+		alias := dso.Symbols[i]
+		if alias.File != dso || alias.SymIdx != int32(i) {
+			continue
+		}
+
+		aesym := &dso.SymTable[i]
+		if aesym.IsUndef() || aesym.Shndx != esym.Shndx || aesym.Value != esym.Value {
+			continue
+		}
+
+		alias.SetOutputChunk(c)
+		alias.Value = offset
+		ctx.Dynsym.AddSymbol(ctx, alias)
+	}
+}
+
+type DynamicSection struct {
+	Chunk
+}
+
+func NewDynamicSection(ctx *Context) *DynamicSection {
+	d := &DynamicSection{Chunk: NewChunk()}
+	d.Name = ".dynamic"
+	d.Shdr.Type = uint32(elf.SHT_DYNAMIC)
+	d.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	d.Shdr.Entsize = DynEntSize(ctx)
+	d.Shdr.Addralign = WordSize(ctx)
+	return d
+}
+
+func CreateDynamicEntries(ctx *Context) []DynEntry {
+	ents := make([]DynEntry, 0)
+	define := func(tag elf.DynTag, val uint64) {
+		ents = append(ents, DynEntry{Tag: uint64(tag), Val: val})
+	}
+
+	for _, dso := range ctx.Dsos {
+		define(elf.DT_NEEDED, uint64(ctx.Dynstr.AddString(dso.Soname)))
+	}
+
+	if ctx.Args.Soname != "" {
+		define(elf.DT_SONAME, uint64(ctx.Dynstr.AddString(ctx.Args.Soname)))
+	}
+
+	define(elf.DT_HASH, ctx.Hash.Shdr.Addr)
+	define(elf.DT_STRTAB, ctx.Dynstr.Shdr.Addr)
+	define(elf.DT_STRSZ, ctx.Dynstr.Shdr.Size)
+	define(elf.DT_SYMTAB, ctx.Dynsym.Shdr.Addr)
+	define(elf.DT_SYMENT, SymSize(ctx))
+
+	if ctx.RelaDyn.NumSectionRelocs > 0 || len(ctx.RelaDyn.GetRelocs(ctx)) > 0 {
+		define(elf.DT_RELA, ctx.RelaDyn.Shdr.Addr)
+		define(elf.DT_RELASZ, ctx.RelaDyn.Shdr.Size)
+		define(elf.DT_RELAENT, RelaEntSize(ctx))
+	}
+
+	if len(ctx.Plt.Syms) > 0 {
+		define(elf.DT_PLTGOT, ctx.GotPlt.Shdr.Addr)
+		define(elf.DT_PLTRELSZ, ctx.RelaPlt.Shdr.Size)
+		define(elf.DT_PLTREL, uint64(elf.DT_RELA))
+		define(elf.DT_JMPREL, ctx.RelaPlt.Shdr.Addr)
+	}
+
+	// The dynamic linker runs the initializers and finalizers of every
+	// module, the executable included, through these entries.
+	for _, name := range []string{"_init", "_fini"} {
+		sym, ok := ctx.SymbolMap[name]
+		if !ok || sym.File == nil || sym.IsImported() {
+			continue
+		}
+		if name == "_init" {
+			define(elf.DT_INIT, sym.GetAddr())
+		} else {
+			define(elf.DT_FINI, sym.GetAddr())
+		}
+	}
+
+	for _, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		switch elf.SectionType(shdr.Type) {
+		case elf.SHT_INIT_ARRAY:
+			define(elf.DT_INIT_ARRAY, shdr.Addr)
+			define(elf.DT_INIT_ARRAYSZ, shdr.Size)
+		case elf.SHT_FINI_ARRAY:
+			define(elf.DT_FINI_ARRAY, shdr.Addr)
+			define(elf.DT_FINI_ARRAYSZ, shdr.Size)
+		case elf.SHT_PREINIT_ARRAY:
+			define(elf.DT_PREINIT_ARRAY, shdr.Addr)
+			define(elf.DT_PREINIT_ARRAYSZ, shdr.Size)
+		}
+	}
+
+	flags1 := uint64(0)
+	if ctx.Args.Pie && !ctx.Args.Shared {
+		flags1 |= DF_1_PIE
+	}
+	if ctx.Args.ZNow {
+		define(elf.DT_FLAGS, uint64(elf.DF_BIND_NOW))
+		flags1 |= DF_1_NOW
+	}
+	if flags1 != 0 {
+		define(elf.DT_FLAGS_1, flags1)
+	}
+
+	if !ctx.Args.Shared {
+		define(elf.DT_DEBUG, 0)
+	}
+	define(elf.DT_NULL, 0)
+	return ents
+}
+
+func (d *DynamicSection) UpdateShdr(ctx *Context) {
+	d.Shdr.Size = uint64(len(CreateDynamicEntries(ctx))) * DynEntSize(ctx)
+	d.Shdr.Link = uint32(ctx.Dynstr.Shndx)
+}
+
+func (d *DynamicSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[d.Shdr.Offset:]
+	for i, ent := range CreateDynamicEntries(ctx) {
+		WriteDynEntry(ctx, base[uint64(i)*DynEntSize(ctx):], ent)
+	}
+}
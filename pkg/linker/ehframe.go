@@ -0,0 +1,335 @@
+package linker
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"rvld/pkg/utils"
+	"sort"
+)
+
+// CieRecord is a Common Information Entry of an input .eh_frame.
+// Identical CIEs of different files are merged, and only the leader
+// of a group of identical CIEs is copied to the output.
+type CieRecord struct {
+	InputSection *InputSection
+	Offset       uint32
+	Size         uint32
+	Rels         []Rela
+	Leader       *CieRecord
+	OutputOffset uint32
+}
+
+// FdeRecord is a Frame Description Entry of an input .eh_frame. It
+// describes one function and is dropped if that function is discarded.
+type FdeRecord struct {
+	InputSection *InputSection
+	Cie          *CieRecord
+	Offset       uint32
+	Size         uint32
+	Rels         []Rela
+	IsAlive      bool
+	OutputOffset uint32
+}
+
+func (c *CieRecord) Contents() []byte {
+	return c.InputSection.Contents[c.Offset : c.Offset+c.Size]
+}
+
+func (f *FdeRecord) Contents() []byte {
+	return f.InputSection.Contents[f.Offset : f.Offset+f.Size]
+}
+
+// Equals reports whether two CIEs are interchangeable, i.e. they have
+// the same contents and their relocations refer to the same symbols.
+func (c *CieRecord) Equals(other *CieRecord) bool {
+	if !bytes.Equal(c.Contents(), other.Contents()) || len(c.Rels) != len(other.Rels) {
+		return false
+	}
+
+	for i := range c.Rels {
+		x := c.Rels[i]
+		y := other.Rels[i]
+		if x.Offset-uint64(c.Offset) != y.Offset-uint64(other.Offset) || x.Type != y.Type ||
+			x.Addend != y.Addend ||
+			c.InputSection.File.Symbols[x.Sym] != other.InputSection.File.Symbols[y.Sym] {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseEhFrame splits .eh_frame sections into CIEs and FDEs. The input
+// sections themselves are not copied to the output; the synthetic
+// EhFrameSection rebuilds .eh_frame from the live records instead.
+func (o *ObjectFile) ParseEhFrame(ctx *Context) {
+	for _, isec := range o.Sections {
+		if isec == nil || !isec.IsAlive || isec.Name() != ".eh_frame" {
+			continue
+		}
+
+		isec.IsAlive = false
+
+		rels := isec.GetRels()
+		utils.Assert(sort.SliceIsSorted(rels, func(i, j int) bool {
+			return rels[i].Offset < rels[j].Offset
+		}))
+
+		relsIn := func(begin, end uint32) []Rela {
+			lo := sort.Search(len(rels), func(i int) bool { return rels[i].Offset >= uint64(begin) })
+			hi := sort.Search(len(rels), func(i int) bool { return rels[i].Offset >= uint64(end) })
+			return rels[lo:hi]
+		}
+
+		cies := make(map[uint32]*CieRecord)
+		data := isec.Contents
+		offset := uint32(0)
+
+		for int(offset) < len(data) {
+			size := utils.Read[uint32](data[offset:])
+			if size == 0 {
+				break
+			}
+			if size == 0xffffffff {
+				utils.Fatal(fmt.Sprintf("%s: 64-bit .eh_frame records are not supported", o.File.DisplayName()))
+			}
+
+			end := offset + 4 + size
+			id := utils.Read[uint32](data[offset+4:])
+
+			if id == 0 {
+				cie := &CieRecord{
+					InputSection: isec,
+					Offset:       offset,
+					Size:         end - offset,
+					Rels:         relsIn(offset, end),
+				}
+				cies[offset] = cie
+				o.Cies = append(o.Cies, cie)
+			} else {
+				cie, ok := cies[offset+4-id]
+				if !ok {
+					utils.Fatal(fmt.Sprintf("%s: bad CIE pointer in .eh_frame at 0x%x", o.File.DisplayName(), offset))
+				}
+
+				o.Fdes = append(o.Fdes, &FdeRecord{
+					InputSection: isec,
+					Cie:          cie,
+					Offset:       offset,
+					Size:         end - offset,
+					Rels:         relsIn(offset, end),
+				})
+			}
+
+			offset = end
+		}
+	}
+}
+
+// Target returns the symbol of the function described by the FDE,
+// which is referenced by the first relocation, the one for pc_begin.
+func (f *FdeRecord) Target() (*Symbol, int64) {
+	if len(f.Rels) == 0 || f.Rels[0].Offset != uint64(f.Offset)+8 {
+		return nil, 0
+	}
+	return f.InputSection.File.Symbols[f.Rels[0].Sym], f.Rels[0].Addend
+}
+
+type EhFrameSection struct {
+	Chunk
+	Cies []*CieRecord
+	Fdes []*FdeRecord
+}
+
+func NewEhFrameSection() *EhFrameSection {
+	e := &EhFrameSection{
+		Chunk: NewChunk(),
+	}
+
+	e.Name = ".eh_frame"
+	e.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	e.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	e.Shdr.Addralign = 8
+
+	return e
+}
+
+// Construct selects the records that go to the output and assigns
+// their offsets. Within each file CIEs come before FDEs, so a CIE
+// always precedes the FDEs that refer to it, as the format requires.
+func (e *EhFrameSection) Construct(ctx *Context) {
+	e.Cies = e.Cies[:0]
+	e.Fdes = e.Fdes[:0]
+	offset := uint32(0)
+
+	for _, file := range ctx.Objs {
+		for _, cie := range file.Cies {
+			cie.Leader = nil
+			for _, leader := range e.Cies {
+				if cie.Equals(leader) {
+					cie.Leader = leader
+					break
+				}
+			}
+
+			if cie.Leader == nil {
+				cie.Leader = cie
+				cie.OutputOffset = offset
+				offset += cie.Size
+				e.Cies = append(e.Cies, cie)
+			}
+		}
+
+		for _, fde := range file.Fdes {
+			sym, _ := fde.Target()
+			fde.IsAlive = sym != nil && sym.File != nil &&
+				sym.InputSection != nil && sym.InputSection.IsAlive
+			if !fde.IsAlive {
+				continue
+			}
+
+			fde.OutputOffset = offset
+			offset += fde.Size
+			e.Fdes = append(e.Fdes, fde)
+		}
+	}
+
+	// A zero-length record terminates .eh_frame.
+	e.Shdr.Size = uint64(offset) + 4
+}
+
+func (e *EhFrameSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[e.Shdr.Offset:]
+
+	applyRels := func(file *ObjectFile, rels []Rela, recOffset, outOffset uint32) {
+		for _, rel := range rels {
+			sym := file.Symbols[rel.Sym]
+			if sym.File == nil {
+				continue
+			}
+
+			delta := uint32(rel.Offset) - recOffset
+			loc := base[outOffset+delta:]
+			P := e.Shdr.Addr + uint64(outOffset+delta)
+			ctx.Target.ApplyDataReloc(loc, rel.Type, sym.GetAddr(), uint64(rel.Addend), P)
+		}
+	}
+
+	for _, cie := range e.Cies {
+		copy(base[cie.OutputOffset:], cie.Contents())
+		applyRels(cie.InputSection.File, cie.Rels, cie.Offset, cie.OutputOffset)
+	}
+
+	for _, fde := range e.Fdes {
+		copy(base[fde.OutputOffset:], fde.Contents())
+		utils.Write[uint32](base[fde.OutputOffset+4:], fde.OutputOffset+4-fde.Cie.Leader.OutputOffset)
+		applyRels(fde.InputSection.File, fde.Rels, fde.Offset, fde.OutputOffset)
+	}
+
+	utils.Write[uint32](base[e.Shdr.Size-4:], 0)
+}
+
+// RedirectEhFrameSymbols points symbols defined in input .eh_frame
+// sections, such as crtbegin's __EH_FRAME_BEGIN__, at the output. One
+// that is not in a record, such as crtend's __FRAME_END__ at the zero
+// terminator, goes after the records of its file and the ones before.
+func (e *EhFrameSection) RedirectEhFrameSymbols(ctx *Context) {
+	end := uint64(0)
+	for _, file := range ctx.Objs {
+		for _, cie := range file.Cies {
+			if cie.Leader == cie && uint64(cie.OutputOffset+cie.Size) > end {
+				end = uint64(cie.OutputOffset + cie.Size)
+			}
+		}
+		for _, fde := range file.Fdes {
+			if fde.IsAlive && uint64(fde.OutputOffset+fde.Size) > end {
+				end = uint64(fde.OutputOffset + fde.Size)
+			}
+		}
+
+		for i, sym := range file.Symbols {
+			if sym == nil || sym.File != file || sym.InputSection == nil ||
+				sym.InputSection.Name() != ".eh_frame" || (i >= file.FirstGlobal && sym.SymIdx != int32(i)) {
+				continue
+			}
+
+			isec := sym.InputSection
+			value := end
+
+			for _, cie := range file.Cies {
+				if cie.InputSection == isec && uint64(cie.Offset) <= sym.Value && sym.Value < uint64(cie.Offset+cie.Size) {
+					value = uint64(cie.Leader.OutputOffset) + sym.Value - uint64(cie.Offset)
+				}
+			}
+
+			for _, fde := range file.Fdes {
+				if fde.IsAlive && fde.InputSection == isec && uint64(fde.Offset) <= sym.Value && sym.Value < uint64(fde.Offset+fde.Size) {
+					value = uint64(fde.OutputOffset) + sym.Value - uint64(fde.Offset)
+				}
+			}
+
+			sym.SetOutputChunk(e)
+			sym.Value = value
+		}
+	}
+}
+
+const (
+	DW_EH_PE_udata4  = 0x03
+	DW_EH_PE_sdata4  = 0x0b
+	DW_EH_PE_pcrel   = 0x10
+	DW_EH_PE_datarel = 0x30
+)
+
+// EhFrameHdrSection is .eh_frame_hdr, which contains a table of FDEs
+// sorted by address so the unwinder can binary search it.
+type EhFrameHdrSection struct {
+	Chunk
+}
+
+const EhFrameHdrSize = 12
+
+func NewEhFrameHdrSection() *EhFrameHdrSection {
+	e := &EhFrameHdrSection{
+		Chunk: NewChunk(),
+	}
+
+	e.Name = ".eh_frame_hdr"
+	e.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	e.Shdr.Flags = uint64(elf.SHF_ALLOC)
+	e.Shdr.Addralign = 4
+
+	return e
+}
+
+func (e *EhFrameHdrSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[e.Shdr.Offset:]
+	hdrAddr := e.Shdr.Addr
+
+	base[0] = 1
+	base[1] = DW_EH_PE_pcrel | DW_EH_PE_sdata4
+	base[2] = DW_EH_PE_udata4
+	base[3] = DW_EH_PE_datarel | DW_EH_PE_sdata4
+	utils.Write[uint32](base[4:], uint32(ctx.EhFrame.Shdr.Addr-hdrAddr-4))
+	utils.Write[uint32](base[8:], uint32(len(ctx.EhFrame.Fdes)))
+
+	type Entry struct {
+		InitialLoc int32
+		FdeAddr    int32
+	}
+
+	entries := make([]Entry, 0, len(ctx.EhFrame.Fdes))
+	for _, fde := range ctx.EhFrame.Fdes {
+		sym, addend := fde.Target()
+		entries = append(entries, Entry{
+			InitialLoc: int32(sym.GetAddr() + uint64(addend) - hdrAddr),
+			FdeAddr:    int32(ctx.EhFrame.Shdr.Addr + uint64(fde.OutputOffset) - hdrAddr),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].InitialLoc < entries[j].InitialLoc
+	})
+
+	utils.Write(base[EhFrameHdrSize:], entries)
+}
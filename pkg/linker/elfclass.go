@@ -0,0 +1,362 @@
+package linker
+
+import (
+	"debug/elf"
+	"rvld/pkg/utils"
+	"unsafe"
+)
+
+// The linker works on the ELF64 structures throughout. ELF32 files are
+// converted when they are read and written, so that RV32 and RV64
+// share all of the passes.
+
+type Header32 struct {
+	Ident     [16]byte
+	Type      uint16
+	Machine   uint16
+	Version   uint32
+	Entry     uint32
+	Phoff     uint32
+	Shoff     uint32
+	Flags     uint32
+	Ehsize    uint16
+	Phentsize uint16
+	Phnum     uint16
+	Shentsize uint16
+	Shnum     uint16
+	Shstrndx  uint16
+}
+
+type ProgramHeader32 struct {
+	Type     uint32
+	Offset   uint32
+	VAddr    uint32
+	PAddr    uint32
+	FileSize uint32
+	MemSize  uint32
+	Flags    uint32
+	Align    uint32
+}
+
+type SectionHeader32 struct {
+	Name      uint32
+	Type      uint32
+	Flags     uint32
+	Addr      uint32
+	Offset    uint32
+	Size      uint32
+	Link      uint32
+	Info      uint32
+	Addralign uint32
+	Entsize   uint32
+}
+
+type Sym32 struct {
+	Name  uint32
+	Value uint32
+	Size  uint32
+	Info  uint8
+	Other uint8
+	Shndx uint16
+}
+
+type Rela32 struct {
+	Offset uint32
+	Info   uint32
+	Addend int32
+}
+
+type Chdr32 struct {
+	Type      uint32
+	Size      uint32
+	Addralign uint32
+}
+
+const ELF32HeaderSize = unsafe.Sizeof(Header32{})
+const ProgramHeader32Size = unsafe.Sizeof(ProgramHeader32{})
+const SectionHeader32Size = unsafe.Sizeof(SectionHeader32{})
+const Symbol32Size = unsafe.Sizeof(Sym32{})
+const Rela32Size = unsafe.Sizeof(Rela32{})
+const Chdr32Size = unsafe.Sizeof(Chdr32{})
+
+func IsELF64(ctx *Context) bool {
+	return ctx.Args.Emulation != MachineTypeRISCV32
+}
+
+func WordSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return 8
+	}
+	return 4
+}
+
+func EhdrSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return uint64(ELFHeaderSize)
+	}
+	return uint64(ELF32HeaderSize)
+}
+
+func PhdrSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return uint64(ProgramHeaderSize)
+	}
+	return uint64(ProgramHeader32Size)
+}
+
+func ShdrSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return uint64(SectionHeaderSize)
+	}
+	return uint64(SectionHeader32Size)
+}
+
+func SymSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return uint64(SymbolSize)
+	}
+	return uint64(Symbol32Size)
+}
+
+func ReadEhdr(contents []byte) Header64 {
+	if elf.Class(contents[elf.EI_CLASS]) == elf.ELFCLASS64 {
+		return utils.Read[Header64](contents)
+	}
+
+	h := utils.Read[Header32](contents)
+	return Header64{
+		Ident:     h.Ident,
+		Type:      h.Type,
+		Machine:   h.Machine,
+		Version:   h.Version,
+		Entry:     uint64(h.Entry),
+		Phoff:     uint64(h.Phoff),
+		Shoff:     uint64(h.Shoff),
+		Flags:     h.Flags,
+		Ehsize:    h.Ehsize,
+		Phentsize: h.Phentsize,
+		Phnum:     h.Phnum,
+		Shentsize: h.Shentsize,
+		Shnum:     h.Shnum,
+		Shstrndx:  h.Shstrndx,
+	}
+}
+
+func ReadShdrs(data []byte, num uint64, is64 bool) []SectionHeader {
+	shdrs := make([]SectionHeader, 0, num)
+	for i := uint64(0); i < num; i++ {
+		if is64 {
+			shdrs = append(shdrs, utils.Read[SectionHeader](data[i*uint64(SectionHeaderSize):]))
+			continue
+		}
+
+		s := utils.Read[SectionHeader32](data[i*uint64(SectionHeader32Size):])
+		shdrs = append(shdrs, SectionHeader{
+			Name:      s.Name,
+			Type:      s.Type,
+			Flags:     uint64(s.Flags),
+			Addr:      uint64(s.Addr),
+			Offset:    uint64(s.Offset),
+			Size:      uint64(s.Size),
+			Link:      s.Link,
+			Info:      s.Info,
+			Addralign: uint64(s.Addralign),
+			Entsize:   uint64(s.Entsize),
+		})
+	}
+	return shdrs
+}
+
+func ReadSyms(data []byte, is64 bool) []Sym64 {
+	if is64 {
+		return utils.ReadSlice[Sym64](data, int(SymbolSize))
+	}
+
+	syms := make([]Sym64, 0, len(data)/int(Symbol32Size))
+	for _, s := range utils.ReadSlice[Sym32](data, int(Symbol32Size)) {
+		syms = append(syms, Sym64{
+			Name:  s.Name,
+			Info:  s.Info,
+			Other: s.Other,
+			Shndx: s.Shndx,
+			Value: uint64(s.Value),
+			Size:  uint64(s.Size),
+		})
+	}
+	return syms
+}
+
+func ReadRelas(data []byte, is64 bool) []Rela {
+	if is64 {
+		return utils.ReadSlice[Rela](data, int(RelaSize))
+	}
+
+	rels := make([]Rela, 0, len(data)/int(Rela32Size))
+	for _, r := range utils.ReadSlice[Rela32](data, int(Rela32Size)) {
+		rels = append(rels, Rela{
+			Offset: uint64(r.Offset),
+			Type:   r.Info & 0xff,
+			Sym:    r.Info >> 8,
+			Addend: int64(r.Addend),
+		})
+	}
+	return rels
+}
+
+// ReadChdr returns the compression header at the start of data and
+// the size it occupies in the file.
+func ReadChdr(data []byte, is64 bool) (Chdr64, uint64) {
+	if is64 {
+		return utils.Read[Chdr64](data), uint64(ChdrSize)
+	}
+
+	c := utils.Read[Chdr32](data)
+	return Chdr64{Type: c.Type, Size: uint64(c.Size), Addralign: uint64(c.Addralign)}, uint64(Chdr32Size)
+}
+
+func EncodeChdr(ctx *Context, chdr Chdr64) []byte {
+	if IsELF64(ctx) {
+		buf := make([]byte, ChdrSize)
+		utils.Write(buf, chdr)
+		return buf
+	}
+
+	buf := make([]byte, Chdr32Size)
+	utils.Write(buf, Chdr32{Type: chdr.Type, Size: uint32(chdr.Size), Addralign: uint32(chdr.Addralign)})
+	return buf
+}
+
+func WriteEhdr(ctx *Context, buf []byte, h *Header64) {
+	if IsELF64(ctx) {
+		utils.Write(buf, *h)
+		return
+	}
+
+	utils.Write(buf, Header32{
+		Ident:     h.Ident,
+		Type:      h.Type,
+		Machine:   h.Machine,
+		Version:   h.Version,
+		Entry:     uint32(h.Entry),
+		Phoff:     uint32(h.Phoff),
+		Shoff:     uint32(h.Shoff),
+		Flags:     h.Flags,
+		Ehsize:    h.Ehsize,
+		Phentsize: h.Phentsize,
+		Phnum:     h.Phnum,
+		Shentsize: h.Shentsize,
+		Shnum:     h.Shnum,
+		Shstrndx:  h.Shstrndx,
+	})
+}
+
+func WritePhdr(ctx *Context, buf []byte, p ProgramHeader) {
+	if IsELF64(ctx) {
+		utils.Write(buf, p)
+		return
+	}
+
+	utils.Write(buf, ProgramHeader32{
+		Type:     p.Type,
+		Offset:   uint32(p.Offset),
+		VAddr:    uint32(p.VAddr),
+		PAddr:    uint32(p.PAddr),
+		FileSize: uint32(p.FileSize),
+		MemSize:  uint32(p.MemSize),
+		Flags:    p.Flags,
+		Align:    uint32(p.Align),
+	})
+}
+
+func WriteShdr(ctx *Context, buf []byte, s SectionHeader) {
+	if IsELF64(ctx) {
+		utils.Write(buf, s)
+		return
+	}
+
+	utils.Write(buf, SectionHeader32{
+		Name:      s.Name,
+		Type:      s.Type,
+		Flags:     uint32(s.Flags),
+		Addr:      uint32(s.Addr),
+		Offset:    uint32(s.Offset),
+		Size:      uint32(s.Size),
+		Link:      s.Link,
+		Info:      s.Info,
+		Addralign: uint32(s.Addralign),
+		Entsize:   uint32(s.Entsize),
+	})
+}
+
+func WriteSym(ctx *Context, buf []byte, s Sym64) {
+	if IsELF64(ctx) {
+		utils.Write(buf, s)
+		return
+	}
+
+	utils.Write(buf, Sym32{
+		Name:  s.Name,
+		Value: uint32(s.Value),
+		Size:  uint32(s.Size),
+		Info:  s.Info,
+		Other: s.Other,
+		Shndx: s.Shndx,
+	})
+}
+
+// WriteWord writes an address-sized value.
+func WriteWord(ctx *Context, buf []byte, val uint64) {
+	if IsELF64(ctx) {
+		utils.Write(buf, val)
+	} else {
+		utils.Write(buf, uint32(val))
+	}
+}
+
+func RelaEntSize(ctx *Context) uint64 {
+	if IsELF64(ctx) {
+		return uint64(RelaSize)
+	}
+	return uint64(Rela32Size)
+}
+
+func WriteRela(ctx *Context, buf []byte, r Rela) {
+	if IsELF64(ctx) {
+		utils.Write(buf, r)
+		return
+	}
+
+	utils.Write(buf, Rela32{
+		Offset: uint32(r.Offset),
+		Info:   r.Sym<<8 | r.Type&0xff,
+		Addend: int32(r.Addend),
+	})
+}
+
+// DynEntry is an entry of .dynamic. Both fields are address-sized in
+// the file.
+type DynEntry struct {
+	Tag uint64
+	Val uint64
+}
+
+func DynEntSize(ctx *Context) uint64 {
+	return 2 * WordSize(ctx)
+}
+
+func ReadDynEntries(data []byte, is64 bool) []DynEntry {
+	if is64 {
+		return utils.ReadSlice[DynEntry](data, 16)
+	}
+
+	ents := make([]DynEntry, 0, len(data)/8)
+	for _, w := range utils.ReadSlice[[2]uint32](data, 8) {
+		ents = append(ents, DynEntry{Tag: uint64(w[0]), Val: uint64(w[1])})
+	}
+	return ents
+}
+
+func WriteDynEntry(ctx *Context, buf []byte, ent DynEntry) {
+	WriteWord(ctx, buf, ent.Tag)
+	WriteWord(ctx, buf[WordSize(ctx):], ent.Val)
+}
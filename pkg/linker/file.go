@@ -2,6 +2,7 @@ package linker
 
 import (
 	"os"
+	"path/filepath"
 	"rvld/pkg/utils"
 )
 
@@ -11,6 +12,15 @@ type File struct {
 	Parent   *File
 }
 
+// DisplayName returns the name used in diagnostics. Archive members
+// are shown as archive(member).
+func (f *File) DisplayName() string {
+	if f.Parent != nil {
+		return f.Parent.Name + "(" + f.Name + ")"
+	}
+	return f.Name
+}
+
 func MustNewFile(filename string) *File {
 	contents, err := os.ReadFile(filename)
 	utils.MustNo(err)
@@ -36,11 +46,42 @@ func OpenLibrary(filepath string) *File {
 
 func FindLibrary(ctx *Context, name string) *File {
 	for _, dir := range ctx.Args.LibraryPaths {
-		stem := dir + "/lib" + name + ".a"
-		if f := OpenLibrary(stem); f != nil {
+		stem := dir + "/lib" + name
+		if !ctx.Args.Static {
+			if f := OpenLibrary(stem + ".so"); f != nil {
+				return f
+			}
+		}
+		if f := OpenLibrary(stem + ".a"); f != nil {
 			return f
 		}
 	}
 	utils.Fatal("library not found")
 	return nil
 }
+
+// FindScriptInput looks up a file named in INPUT or GROUP of a linker
+// script in dir. A name that is not found as it is is looked for next
+// to the script, then in the library search path.
+func FindScriptInput(ctx *Context, dir string, name string) *File {
+	if lib, ok := utils.RemovePrefix(name, "-l"); ok {
+		return FindLibrary(ctx, lib)
+	}
+	if f := OpenLibrary(name); f != nil {
+		return f
+	}
+
+	if !filepath.IsAbs(name) {
+		if f := OpenLibrary(filepath.Join(dir, name)); f != nil {
+			return f
+		}
+		for _, libdir := range ctx.Args.LibraryPaths {
+			if f := OpenLibrary(filepath.Join(libdir, name)); f != nil {
+				return f
+			}
+		}
+	}
+
+	utils.Fatal("cannot find " + name)
+	return nil
+}
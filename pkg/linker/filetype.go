@@ -13,6 +13,8 @@ const (
 	FileTypeEmpty   FileType = iota
 	FileTypeObject  FileType = iota
 	FileTypeArchive FileType = iota
+	FileTypeDso     FileType = iota
+	FileTypeScript  FileType = iota
 )
 
 func GetFileType(contents []byte) FileType {
@@ -26,6 +28,8 @@ func GetFileType(contents []byte) FileType {
 		switch et {
 		case elf.ET_REL:
 			return FileTypeObject
+		case elf.ET_DYN:
+			return FileTypeDso
 		}
 		return FileTypeUnknown
 	}
@@ -34,5 +38,21 @@ func GetFileType(contents []byte) FileType {
 		return FileTypeArchive
 	}
 
+	if isTextFile(contents) {
+		return FileTypeScript
+	}
+
 	return FileTypeUnknown
 }
+
+// isTextFile reports whether the file starts like text, as a linker
+// script such as glibc's libc.so does.
+func isTextFile(contents []byte) bool {
+	for i := 0; i < len(contents) && i < 4; i++ {
+		c := contents[i]
+		if (c < ' ' || c > '~') && c != '\t' && c != '\n' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
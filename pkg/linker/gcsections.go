@@ -0,0 +1,182 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"rvld/pkg/utils"
+	"strings"
+)
+
+// SHF_GNU_RETAIN marks a section that --gc-sections must not remove.
+const SHF_GNU_RETAIN uint64 = 0x200000
+
+// GcSections removes the alloc sections that cannot be reached from the
+// roots by following relocations. Non-alloc sections such as debug info
+// are kept, but do not keep anything alive.
+func GcSections(ctx *Context) {
+	live := make(map[*InputSection]bool)
+	worklist := make([]*InputSection, 0)
+
+	mark := func(isec *InputSection) {
+		if isec != nil && isec.IsAlive && isec.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 && !live[isec] {
+			live[isec] = true
+			worklist = append(worklist, isec)
+		}
+	}
+
+	markSymbol := func(sym *Symbol) {
+		if sym != nil && sym.File != nil && !sym.File.IsDso {
+			mark(sym.InputSection)
+		}
+	}
+
+	// A live function keeps its FDE, and so the LSDA and the personality
+	// routine that the FDE and its CIE refer to.
+	fdes := getFdesBySection(ctx)
+
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec != nil && isGcRoot(ctx, isec) {
+				mark(isec)
+			}
+		}
+
+		for _, sym := range file.Symbols[file.FirstGlobal:] {
+			if sym.File == file && isExported(ctx, sym) {
+				mark(sym.InputSection)
+			}
+		}
+	}
+
+	for _, name := range append([]string{ctx.Args.Entry}, ctx.Args.Undefined...) {
+		markSymbol(ctx.SymbolMap[name])
+	}
+
+	// Definitions that shared libraries refer to.
+	for _, dso := range ctx.Dsos {
+		for i := dso.FirstGlobal; i < len(dso.Symbols); i++ {
+			if dso.SymTable[i].IsUndef() {
+				markSymbol(dso.Symbols[i])
+			}
+		}
+	}
+
+	if HasSectionsCommand(ctx) {
+		ctx.Script.forEachCommand(func(cmd ScriptCommand) {
+			if d, ok := cmd.(*InputSectionDesc); ok && d.Keep {
+				for _, isec := range d.Sections {
+					mark(isec)
+				}
+			}
+		})
+	}
+
+	for len(worklist) > 0 {
+		isec := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		for _, rel := range isec.GetRels() {
+			markSymbol(isec.File.Symbols[rel.Sym])
+		}
+
+		for _, fde := range fdes[isec] {
+			syms := fde.InputSection.File.Symbols
+			for _, rel := range fde.Rels[1:] {
+				markSymbol(syms[rel.Sym])
+			}
+			for _, rel := range fde.Cie.Rels {
+				markSymbol(syms[rel.Sym])
+			}
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil || !isec.IsAlive || isec.Shdr().Flags&uint64(elf.SHF_ALLOC) == 0 || live[isec] {
+				continue
+			}
+
+			if ctx.Args.PrintGcSections {
+				fmt.Fprintf(os.Stderr, "removing unused section '%s' in file '%s'\n",
+					isec.Name(), file.File.DisplayName())
+			}
+			isec.IsAlive = false
+		}
+	}
+}
+
+// getFdesBySection maps each section to the FDEs that describe it.
+func getFdesBySection(ctx *Context) map[*InputSection][]*FdeRecord {
+	fdes := make(map[*InputSection][]*FdeRecord)
+	for _, file := range ctx.Objs {
+		for _, fde := range file.Fdes {
+			if sym, _ := fde.Target(); sym != nil && sym.InputSection != nil {
+				fdes[sym.InputSection] = append(fdes[sym.InputSection], fde)
+			}
+		}
+	}
+	return fdes
+}
+
+// isGcRoot reports whether the section is kept regardless of references
+// to it. The dynamic linker or the C runtime reach these by other means,
+// e.g. by section type or through __start_ and __stop_ symbols.
+func isGcRoot(ctx *Context, isec *InputSection) bool {
+	shdr := isec.Shdr()
+	switch elf.SectionType(shdr.Type) {
+	case elf.SHT_INIT_ARRAY, elf.SHT_FINI_ARRAY, elf.SHT_PREINIT_ARRAY, elf.SHT_NOTE:
+		return true
+	}
+	if shdr.Flags&SHF_GNU_RETAIN != 0 {
+		return true
+	}
+
+	name := isec.Name()
+	if name == ".init" || name == ".fini" {
+		return true
+	}
+	for _, prefix := range []string{".ctors", ".dtors", ".init_array", ".fini_array", ".preinit_array"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	if isCIdentifier(name) {
+		_, start := ctx.SymbolMap["__start_"+name]
+		_, stop := ctx.SymbolMap["__stop_"+name]
+		return start || stop
+	}
+	return false
+}
+
+// isExported reports whether the symbol goes to .dynsym as a definition
+// that other modules may use. Executables export their definitions only
+// with --export-dynamic, e.g. for the plugins that they dlopen.
+func isExported(ctx *Context, sym *Symbol) bool {
+	if !ctx.Args.Shared && !(ctx.Args.ExportDynamic && NeedsDynamicSections(ctx)) || sym.IsImported() {
+		return false
+	}
+	vis := elf.SymVis(sym.ELFSym().Other & 3)
+	return vis == elf.STV_DEFAULT || vis == elf.STV_PROTECTED
+}
+
+func isCIdentifier(name string) bool {
+	for i, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// GetStartStopSection returns the section that a __start_<sec> or
+// __stop_<sec> symbol delimits.
+func GetStartStopSection(name string) (string, bool) {
+	for _, prefix := range []string{"__start_", "__stop_"} {
+		if sec, ok := utils.RemovePrefix(name, prefix); ok && isCIdentifier(sec) {
+			return sec, true
+		}
+	}
+	return "", false
+}
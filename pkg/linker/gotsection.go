@@ -1,13 +1,13 @@
 package linker
 
-import (
-	"debug/elf"
-	"rvld/pkg/utils"
-)
+import "debug/elf"
 
 type GotSection struct {
 	Chunk
+	GotSyms   []*Symbol
 	GotTpSyms []*Symbol
+	TlsGdSyms []*Symbol
+	TlsLdIdx  int32
 }
 
 type GotEntry struct {
@@ -15,38 +15,149 @@ type GotEntry struct {
 	Val uint64
 }
 
-func NewGotSection() *GotSection {
+func NewGotSection(ctx *Context) *GotSection {
 	g := &GotSection{
-		Chunk: NewChunk(),
+		Chunk:    NewChunk(),
+		TlsLdIdx: -1,
 	}
 
 	g.Name = ".got"
 	g.Shdr.Type = uint32(elf.SHT_PROGBITS)
 	g.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
-	g.Shdr.Addralign = 0
+	g.Shdr.Addralign = WordSize(ctx)
 
 	return g
 }
 
-func (g *GotSection) AddGotTpSymbol(sym *Symbol) {
-	sym.GotTpIdx = int32(g.Shdr.Size / 8)
-	g.Shdr.Size += 8
+func (g *GotSection) AddGotSymbol(ctx *Context, sym *Symbol) {
+	sym.GotIdx = int32(g.Shdr.Size / WordSize(ctx))
+	g.Shdr.Size += WordSize(ctx)
+	g.GotSyms = append(g.GotSyms, sym)
+}
+
+func (g *GotSection) AddGotTpSymbol(ctx *Context, sym *Symbol) {
+	sym.GotTpIdx = int32(g.Shdr.Size / WordSize(ctx))
+	g.Shdr.Size += WordSize(ctx)
 	g.GotTpSyms = append(g.GotTpSyms, sym)
 }
 
+// AddTlsGdSymbol reserves the module ID and offset pair that
+// __tls_get_addr takes for general-dynamic accesses to sym.
+func (g *GotSection) AddTlsGdSymbol(ctx *Context, sym *Symbol) {
+	sym.TlsGdIdx = int32(g.Shdr.Size / WordSize(ctx))
+	g.Shdr.Size += WordSize(ctx) * 2
+	g.TlsGdSyms = append(g.TlsGdSyms, sym)
+}
+
+// AddTlsLd reserves the pair shared by all local-dynamic accesses, of
+// which only the module ID is used.
+func (g *GotSection) AddTlsLd(ctx *Context) {
+	if g.TlsLdIdx >= 0 {
+		return
+	}
+	g.TlsLdIdx = int32(g.Shdr.Size / WordSize(ctx))
+	g.Shdr.Size += WordSize(ctx) * 2
+}
+
+func (g *GotSection) GetTlsLdAddr(ctx *Context) uint64 {
+	return g.Shdr.Addr + uint64(g.TlsLdIdx)*WordSize(ctx)
+}
+
+// GetDtpOff returns the offset of sym in the TLS block of its module as
+// __tls_get_addr expects it. RISC-V biases it by 0x800 to make better
+// use of the signed 12-bit immediates.
+func GetDtpOff(ctx *Context, sym *Symbol) uint64 {
+	val := sym.GetAddr() - ctx.TlsBegin
+	if ctx.Target.ELFMachine() == elf.EM_RISCV {
+		val -= 0x800
+	}
+	return val
+}
+
+// GetEntries returns the slots whose values are known at link time.
+// The other slots are filled by the dynamic linker, see GetDynRelocs.
 func (g *GotSection) GetEntries(ctx *Context) []GotEntry {
 	entries := make([]GotEntry, 0)
+	for _, sym := range g.GotSyms {
+		if sym.IsPreemptible(ctx) {
+			continue
+		}
+		entries = append(entries, GotEntry{Idx: int64(sym.GotIdx), Val: sym.GetAddr()})
+	}
+
+	// The TLS block of an executable, PIE or not, is at a fixed offset
+	// from the thread pointer.
 	for _, sym := range g.GotTpSyms {
+		if sym.IsPreemptible(ctx) || ctx.Args.Shared {
+			continue
+		}
 		idx := sym.GotTpIdx
 		entries = append(entries, GotEntry{Idx: int64(idx), Val: sym.GetAddr() - ctx.TpAddr})
 	}
+
+	// The executable is always module 1.
+	for _, sym := range g.TlsGdSyms {
+		if sym.IsPreemptible(ctx) {
+			continue
+		}
+		if !ctx.Args.Shared {
+			entries = append(entries, GotEntry{Idx: int64(sym.TlsGdIdx), Val: 1})
+		}
+		entries = append(entries, GotEntry{Idx: int64(sym.TlsGdIdx) + 1, Val: GetDtpOff(ctx, sym)})
+	}
+
+	if g.TlsLdIdx >= 0 && !ctx.Args.Shared {
+		entries = append(entries, GotEntry{Idx: int64(g.TlsLdIdx), Val: 1})
+	}
 	return entries
 }
 
+func (g *GotSection) GetDynRelocs(ctx *Context) []Rela {
+	types := ctx.Target.DynRelocs()
+	rels := make([]Rela, 0)
+	add := func(idx int32, typ uint32, sym *Symbol, addend uint64) {
+		rel := Rela{Offset: g.Shdr.Addr + uint64(idx)*WordSize(ctx), Type: typ, Addend: int64(addend)}
+		if sym != nil {
+			rel.Sym = uint32(sym.DynsymIdx)
+		}
+		rels = append(rels, rel)
+	}
+
+	for _, sym := range g.GotSyms {
+		if sym.IsPreemptible(ctx) {
+			add(sym.GotIdx, types.GlobDat, sym, 0)
+		} else if IsPic(ctx) && !sym.IsAbsolute(ctx) {
+			add(sym.GotIdx, types.Relative, nil, sym.GetAddr())
+		}
+	}
+
+	for _, sym := range g.GotTpSyms {
+		if sym.IsPreemptible(ctx) {
+			add(sym.GotTpIdx, types.TpOff, sym, 0)
+		} else if ctx.Args.Shared {
+			add(sym.GotTpIdx, types.TpOff, nil, sym.GetAddr()-ctx.TlsBegin)
+		}
+	}
+
+	for _, sym := range g.TlsGdSyms {
+		if sym.IsPreemptible(ctx) {
+			add(sym.TlsGdIdx, types.DtpMod, sym, 0)
+			add(sym.TlsGdIdx+1, types.DtpOff, sym, 0)
+		} else if ctx.Args.Shared {
+			add(sym.TlsGdIdx, types.DtpMod, nil, 0)
+		}
+	}
+
+	if g.TlsLdIdx >= 0 && ctx.Args.Shared {
+		add(g.TlsLdIdx, types.DtpMod, nil, 0)
+	}
+	return rels
+}
+
 func (g *GotSection) CopyBuf(ctx *Context) {
 	base := ctx.Buf[g.Shdr.Offset:]
 
 	for _, ent := range g.GetEntries(ctx) {
-		utils.Write(base[ent.Idx*8:], ent.Val)
+		WriteWord(ctx, base[uint64(ent.Idx)*WordSize(ctx):], ent.Val)
 	}
 }
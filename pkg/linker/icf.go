@@ -0,0 +1,420 @@
+package linker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"rvld/pkg/utils"
+	"sync"
+)
+
+// SHT_LLVM_ADDRSIG lists, as ULEB128 symbol indices, the symbols whose
+// addresses are taken.
+const SHT_LLVM_ADDRSIG uint32 = 0x6fff4c03
+
+// SHF_EXCLUDE keeps a section out of a final link.
+const SHF_EXCLUDE uint64 = 0x80000000
+
+const icfShardSize = 256
+
+type icfDigest = [sha256.Size]byte
+
+// IcfSections folds read-only sections that have the same contents and
+// whose relocations refer to the same, or recursively identical,
+// sections. Symbols in a folded section move to the section that is kept.
+func IcfSections(ctx *Context) {
+	keep := make(map[*InputSection]bool)
+	if ctx.Args.Icf == "safe" {
+		keep = getAddressSignificantSections(ctx)
+	}
+
+	ids := make(map[*InputSection]int)
+	index := make(map[*InputSection]int)
+	sections := make([]*InputSection, 0)
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec == nil {
+				continue
+			}
+			ids[isec] = len(ids)
+			if isIcfEligible(isec) && !keep[isec] {
+				index[isec] = len(sections)
+				sections = append(sections, isec)
+			}
+		}
+	}
+
+	if len(sections) < 2 {
+		return
+	}
+
+	mergedIds := make(map[*MergedSection]int)
+	for i, m := range ctx.MergedSections {
+		mergedIds[m] = i
+	}
+
+	fdes := getFdesBySection(ctx)
+
+	getRel := func(file *ObjectFile, rel Rela, base uint64, blob int) icfRel {
+		r := icfRel{blob: blob, offset: rel.Offset - base, typ: uint64(rel.Type)}
+
+		if int(rel.Sym) < file.FirstGlobal {
+			esym := &file.SymTable[rel.Sym]
+			if elf.SymType(esym.Type()) == elf.STT_SECTION {
+				if m := file.MergeableSections[file.GetShndx(esym, int(rel.Sym))]; m != nil {
+					if frag, offset := m.GetFragment(uint32(rel.Addend)); frag != nil {
+						r.kind, r.id, r.fragOffset, r.value = 'm', mergedIds[frag.OutputSection], uint64(frag.Offset), uint64(offset)
+						return r
+					}
+				}
+			}
+		}
+
+		r.addend = uint64(rel.Addend)
+		sym := file.Symbols[rel.Sym]
+		r.value = sym.Value
+		switch {
+		case sym.SectionFragment != nil:
+			frag := sym.SectionFragment
+			r.kind, r.id, r.fragOffset = 'm', mergedIds[frag.OutputSection], uint64(frag.Offset)
+		case sym.InputSection != nil:
+			if j, ok := index[sym.InputSection]; ok {
+				r.kind, r.id = 'e', j
+			} else {
+				r.kind, r.id = 's', ids[sym.InputSection]
+			}
+		default:
+			// Imported, absolute or undefined symbols are the same
+			// address if they have the same name.
+			r.kind, r.name = 'n', sym.Name
+		}
+		return r
+	}
+
+	keys := make([]icfKey, len(sections))
+	forEachIcfShard(len(sections), func(i int) {
+		isec := sections[i]
+		k := &keys[i]
+		shdr := isec.Shdr()
+		k.header = [3]uint64{uint64(shdr.Type), shdr.Flags, uint64(isec.P2Align)}
+		k.data = append(k.data, isec.Contents)
+		for _, rel := range isec.GetRels() {
+			k.rels = append(k.rels, getRel(isec.File, rel, 0, 0))
+		}
+
+		// The length and the CIE pointer of an FDE depend on where it is
+		// in .eh_frame, so the CIE is compared by contents instead.
+		for _, fde := range fdes[isec] {
+			k.data = append(k.data, fde.Contents()[8:])
+			for _, rel := range fde.Rels[1:] {
+				k.rels = append(k.rels, getRel(fde.InputSection.File, rel, uint64(fde.Offset), len(k.data)-1))
+			}
+
+			cie := fde.Cie
+			k.data = append(k.data, cie.Contents())
+			for _, rel := range cie.Rels {
+				k.rels = append(k.rels, getRel(cie.InputSection.File, rel, uint64(cie.Offset), len(k.data)-1))
+			}
+		}
+	})
+
+	// The first round hashes everything but the identity of the foldable
+	// sections that relocations refer to, which are recorded as edges and
+	// compared by equivalence class in the following rounds.
+	digests := make([]icfDigest, len(sections))
+	edges := make([][]int, len(sections))
+	forEachIcfShard(len(sections), func(i int) {
+		digests[i] = keys[i].digest()
+		for _, r := range keys[i].rels {
+			if r.kind == 'e' {
+				edges[i] = append(edges[i], r.id)
+			}
+		}
+	})
+
+	// Each round splits the classes whose members refer to sections in
+	// different classes, until no class is split. The members of the
+	// final classes are then compared in full, as equal digests make
+	// sections the same only with near certainty.
+	classes := make([]int, len(sections))
+	numClasses := partitionByDigest(digests, classes)
+
+	for {
+		next := make([]icfDigest, len(sections))
+		forEachIcfShard(len(sections), func(i int) {
+			h := sha256.New()
+			h.Write(digests[i][:])
+			buf := make([]byte, 8)
+			for _, j := range edges[i] {
+				binary.LittleEndian.PutUint64(buf, uint64(classes[j]))
+				h.Write(buf)
+			}
+			h.Sum(next[i][:0])
+		})
+
+		n := partitionByDigest(next, classes)
+		if n == numClasses {
+			if !splitIcfClasses(keys, classes, digests) {
+				break
+			}
+			n = -1
+		}
+		numClasses = n
+	}
+
+	folded := make(map[*InputSection]*InputSection)
+	members := make(map[int][]int)
+	for i, isec := range sections {
+		if leader := classes[i]; leader != i {
+			folded[isec] = sections[leader]
+			members[leader] = append(members[leader], i)
+		}
+	}
+
+	if ctx.Args.PrintIcfSections {
+		for i, isec := range sections {
+			if len(members[i]) == 0 {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "selected section '%s' in file '%s'\n",
+				isec.Name(), isec.File.File.DisplayName())
+			for _, j := range members[i] {
+				fmt.Fprintf(os.Stderr, "  removing identical section '%s' in file '%s'\n",
+					sections[j].Name(), sections[j].File.File.DisplayName())
+			}
+		}
+	}
+
+	// The kept section's FDE covers the folded ones.
+	for _, file := range ctx.Objs {
+		file.Fdes = utils.RemoveIf(file.Fdes, func(fde *FdeRecord) bool {
+			sym, _ := fde.Target()
+			return sym != nil && folded[sym.InputSection] != nil
+		})
+	}
+
+	for _, file := range ctx.Objs {
+		for _, sym := range file.Symbols {
+			if leader := folded[sym.InputSection]; leader != nil {
+				sym.SetInputSection(leader)
+			}
+		}
+	}
+
+	for isec, leader := range folded {
+		isec.IsAlive = false
+		isec.Leader = leader
+	}
+}
+
+// icfKey is everything that ICF compares of a section: its header, its
+// contents and those of its FDEs and their CIEs, and their relocations.
+type icfKey struct {
+	header [3]uint64
+	data   [][]byte
+	rels   []icfRel
+}
+
+// icfRel is a relocation as ICF compares it. The kind of its target is
+// 'm' for a section fragment, 'e' for a foldable section, whose index in
+// the sections being folded is id, 's' for any other section, and 'n'
+// for a symbol that is compared by name.
+type icfRel struct {
+	blob       int
+	offset     uint64
+	typ        uint64
+	addend     uint64
+	kind       byte
+	id         int
+	fragOffset uint64
+	value      uint64
+	name       string
+}
+
+// digest hashes the key, leaving out which foldable sections it refers to.
+func (k *icfKey) digest() icfDigest {
+	h := sha256.New()
+	buf := make([]byte, 8)
+
+	put := func(vals ...uint64) {
+		for _, val := range vals {
+			binary.LittleEndian.PutUint64(buf, val)
+			h.Write(buf)
+		}
+	}
+
+	put(k.header[:]...)
+	put(uint64(len(k.data)))
+	for _, bs := range k.data {
+		put(uint64(len(bs)))
+		h.Write(bs)
+	}
+
+	put(uint64(len(k.rels)))
+	for _, r := range k.rels {
+		id := uint64(r.id)
+		if r.kind == 'e' {
+			id = 0
+		}
+		put(uint64(r.blob), r.offset, r.typ, r.addend, uint64(r.kind), id, r.fragOffset, r.value)
+		put(uint64(len(r.name)))
+		h.Write([]byte(r.name))
+	}
+
+	var digest icfDigest
+	h.Sum(digest[:0])
+	return digest
+}
+
+// equal reports whether two sections are the same, given the current
+// classes of the foldable sections that they refer to.
+func (k *icfKey) equal(other *icfKey, classes []int) bool {
+	if k.header != other.header || len(k.data) != len(other.data) || len(k.rels) != len(other.rels) {
+		return false
+	}
+
+	for i := range k.data {
+		if !bytes.Equal(k.data[i], other.data[i]) {
+			return false
+		}
+	}
+
+	for i := range k.rels {
+		a, b := k.rels[i], other.rels[i]
+		if a.kind == 'e' && b.kind == 'e' {
+			a.id, b.id = classes[a.id], classes[b.id]
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// splitIcfClasses rehashes the digest of each section that differs from
+// the leader of its class, so that the next round moves it out of the
+// class. Such sections that are the same still share a digest. It
+// reports whether any section was moved.
+func splitIcfClasses(keys []icfKey, classes []int, digests []icfDigest) bool {
+	split := false
+	for i := range keys {
+		if leader := classes[i]; leader != i && !keys[i].equal(&keys[leader], classes) {
+			digests[i] = sha256.Sum256(digests[i][:])
+			split = true
+		}
+	}
+	return split
+}
+
+// partitionByDigest puts sections with the same digest in the same class,
+// named after its first member, and returns the number of classes.
+func partitionByDigest(digests []icfDigest, classes []int) int {
+	leaders := make(map[icfDigest]int)
+	for i, digest := range digests {
+		if leader, ok := leaders[digest]; ok {
+			classes[i] = leader
+		} else {
+			leaders[digest] = i
+			classes[i] = i
+		}
+	}
+	return len(leaders)
+}
+
+func forEachIcfShard(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += icfShardSize {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			end := start + icfShardSize
+			if end > n {
+				end = n
+			}
+
+			for i := start; i < end; i++ {
+				fn(i)
+			}
+		}(start)
+	}
+	wg.Wait()
+}
+
+// isIcfEligible reports whether the section may be folded. Writable
+// sections have an identity by nature, sections that the runtime finds
+// by name or type must all stay, and empty ones gain nothing.
+func isIcfEligible(isec *InputSection) bool {
+	shdr := isec.Shdr()
+	if !isec.IsAlive || isec.ShSize == 0 || shdr.Flags&uint64(elf.SHF_ALLOC) == 0 ||
+		shdr.Flags&uint64(elf.SHF_WRITE|elf.SHF_TLS) != 0 {
+		return false
+	}
+
+	switch elf.SectionType(shdr.Type) {
+	case elf.SHT_NOBITS, elf.SHT_NOTE, elf.SHT_INIT_ARRAY, elf.SHT_FINI_ARRAY, elf.SHT_PREINIT_ARRAY:
+		return false
+	}
+
+	name := isec.Name()
+	return name != ".init" && name != ".fini" && !isCIdentifier(name)
+}
+
+// getAddressSignificantSections returns the sections that --icf=safe
+// must not fold: those defining a symbol listed in .llvm_addrsig or one
+// that other modules may use. A file without .llvm_addrsig gives no such
+// guarantee, so none of its sections are folded. Only Clang emits the
+// table, with -faddrsig, so objects built by GCC are never folded.
+func getAddressSignificantSections(ctx *Context) map[*InputSection]bool {
+	keep := make(map[*InputSection]bool)
+
+	found := false
+	for _, file := range ctx.Objs {
+		found = found || file.Addrsig != nil
+	}
+	if !found {
+		utils.Warn("--icf=safe: no input file has an address-significance table (.llvm_addrsig); nothing is folded")
+	}
+
+	mark := func(sym *Symbol) {
+		if sym != nil && sym.File != nil && !sym.File.IsDso && sym.InputSection != nil {
+			keep[sym.InputSection] = true
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		if file.Addrsig == nil {
+			for _, isec := range file.Sections {
+				if isec != nil {
+					keep[isec] = true
+				}
+			}
+			continue
+		}
+
+		for data := file.Addrsig; len(data) > 0; {
+			idx, n := utils.ReadUleb(data)
+			data = data[n:]
+			if idx < uint64(len(file.Symbols)) {
+				mark(file.Symbols[idx])
+			}
+		}
+
+		for _, sym := range file.Symbols[file.FirstGlobal:] {
+			if sym.File == file && isExported(ctx, sym) {
+				mark(sym)
+			}
+		}
+	}
+
+	for _, dso := range ctx.Dsos {
+		for i := dso.FirstGlobal; i < len(dso.Symbols); i++ {
+			if dso.SymTable[i].IsUndef() {
+				mark(dso.Symbols[i])
+			}
+		}
+	}
+	return keep
+}
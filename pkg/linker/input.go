@@ -1,12 +1,36 @@
 package linker
 
-import "rvld/pkg/utils"
+import (
+	"fmt"
+	"rvld/pkg/utils"
+)
 
 func ReadInputFiles(ctx *Context, remaining []string) {
+	states := make([]bool, 0)
+
 	for _, arg := range remaining {
 		// normal object file
 		var ok bool
 
+		switch arg {
+		case "--as-needed":
+			ctx.Args.AsNeeded = true
+			continue
+		case "--no-as-needed":
+			ctx.Args.AsNeeded = false
+			continue
+		case "--push-state":
+			states = append(states, ctx.Args.AsNeeded)
+			continue
+		case "--pop-state":
+			if len(states) == 0 {
+				utils.Fatal("--pop-state without --push-state")
+			}
+			ctx.Args.AsNeeded = states[len(states)-1]
+			states = states[:len(states)-1]
+			continue
+		}
+
 		if arg, ok = utils.RemovePrefix(arg, "-l"); ok {
 			ReadFile(ctx, FindLibrary(ctx, arg))
 		} else {
@@ -27,19 +51,48 @@ func ReadFile(ctx *Context, file *File) {
 			utils.Assert(GetFileType(child.Contents) == FileTypeObject)
 			ctx.Objs = append(ctx.Objs, CreateObjectFile(ctx, child, true))
 		}
+	case FileTypeDso:
+		dso := CreateSharedFile(ctx, file)
+
+		// The gcc driver names some libraries more than once.
+		for _, d := range ctx.Dsos {
+			if d.Soname == dso.Soname {
+				d.AsNeeded = d.AsNeeded && ctx.Args.AsNeeded
+				return
+			}
+		}
+
+		dso.AsNeeded = ctx.Args.AsNeeded
+		ctx.Dsos = append(ctx.Dsos, dso)
+	case FileTypeScript:
+		ReadScriptFile(ctx, file)
 	default:
 		utils.Fatal("unknown file type")
 	}
 }
 
-func CreateObjectFile(ctx *Context, file *File, inLib bool) *ObjectFile {
+func CheckFileCompatibility(ctx *Context, file *File) {
 	mt := GetMachineTypeFromContext(file.Contents)
 	if mt != ctx.Args.Emulation {
-		utils.Fatal("incompatible file type")
+		utils.Fatal(fmt.Sprintf("%s: incompatible file type: %s is expected but got %s",
+			file.DisplayName(), MachineTypeStringer{ctx.Args.Emulation}, MachineTypeStringer{mt}))
 	}
+}
+
+func CreateObjectFile(ctx *Context, file *File, inLib bool) *ObjectFile {
+	CheckFileCompatibility(ctx, file)
 
 	obj := NewObjectFile(file, !inLib)
 	obj.Parse(ctx)
 
 	return obj
 }
+
+func CreateSharedFile(ctx *Context, file *File) *ObjectFile {
+	CheckFileCompatibility(ctx, file)
+
+	dso := NewSharedFile(file)
+	dso.ParseDso(ctx)
+
+	return dso
+}
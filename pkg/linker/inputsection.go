@@ -2,6 +2,7 @@ package linker
 
 import (
 	"debug/elf"
+	"fmt"
 	"math"
 	"math/bits"
 	"rvld/pkg/utils"
@@ -18,8 +19,15 @@ type InputSection struct {
 
 	OutputSection *OutputSection
 
+	// The section that this one was folded into by --icf.
+	Leader *InputSection
+
 	RelsecInx uint32
 	Rels      []Rela
+
+	// Dynamic relocations this section contributes to .rela.dyn.
+	NumDynRelocs uint64
+	DynRelocIdx  uint64
 }
 
 func NewInputSection(ctx *Context, name string, file *ObjectFile, shndx uint32) *InputSection {
@@ -33,11 +41,20 @@ func NewInputSection(ctx *Context, name string, file *ObjectFile, shndx uint32)
 	}
 
 	shdr := s.Shdr()
-	s.Contents = file.File.Contents[shdr.Offset : shdr.Offset+shdr.Size]
+	if shdr.Type != uint32(elf.SHT_NOBITS) {
+		s.Contents = file.File.Contents[shdr.Offset : shdr.Offset+shdr.Size]
+	}
 
-	// If section's flag is SHF_COMPRESSED, skip it
-	utils.Assert(shdr.Flags&uint64(elf.SHF_COMPRESSED) == 0)
-	s.ShSize = uint32(shdr.Size)
+	align := shdr.Addralign
+	if shdr.Flags&uint64(elf.SHF_COMPRESSED) != 0 {
+		// The contents stay compressed until the file is known to be
+		// part of the link. See ObjectFile.DecompressSections.
+		chdr, _ := ReadCompressionHeader(file.File, name, s.Contents, file.Is64)
+		s.ShSize = uint32(chdr.Size)
+		align = chdr.Addralign
+	} else {
+		s.ShSize = uint32(shdr.Size)
+	}
 
 	// Calculate trailing zeros of align
 	ToP2Align := func(align uint64) uint8 {
@@ -47,9 +64,14 @@ func NewInputSection(ctx *Context, name string, file *ObjectFile, shndx uint32)
 
 		return uint8(bits.TrailingZeros64(align))
 	}
-	s.P2Align = ToP2Align(shdr.Addralign)
+	s.P2Align = ToP2Align(align)
 
-	s.OutputSection = GetOutputSection(ctx, name, shdr.Type, shdr.Flags)
+	if HasSectionsCommand(ctx) {
+		s.OutputSection = ctx.Script.MapInputSection(ctx, s, name)
+	}
+	if s.OutputSection == nil {
+		s.OutputSection = GetOutputSection(ctx, name, shdr.Type, shdr.Flags)
+	}
 
 	return s
 }
@@ -70,8 +92,15 @@ func (i *InputSection) WriteTo(ctx *Context, buf []byte) {
 
 	i.CopyContents(buf)
 
+	// With -r, relocations are written out instead of being applied.
+	if ctx.Args.Relocatable {
+		return
+	}
+
 	if i.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
 		i.ApplyRelocAlloc(ctx, buf)
+	} else {
+		i.ApplyRelocNonAlloc(ctx, buf)
 	}
 }
 
@@ -85,7 +114,7 @@ func (i *InputSection) GetRels() []Rela {
 	}
 
 	bs := i.File.GetBytesFromShdr(&i.File.InputFile.Sections[i.RelsecInx])
-	i.Rels = utils.ReadSlice[Rela](bs, int(RelaSize))
+	i.Rels = ReadRelas(bs, i.File.Is64)
 	return i.Rels
 }
 
@@ -93,174 +122,148 @@ func (i *InputSection) GetAddr() uint64 {
 	return i.OutputSection.Shdr.Addr + uint64(i.Offset)
 }
 
-func (i *InputSection) ScanRelocations() {
-	rels := i.GetRels()
-	for _, rel := range rels {
-		sym := i.File.Symbols[rel.Sym]
-		if sym.File == nil {
-			continue
-		}
-
-		if rel.Type == uint32(elf.R_RISCV_TLS_GOT_HI20) {
-			sym.Flags |= NeedsGotTp
+func (i *InputSection) ScanRelocations(ctx *Context) {
+	for _, rel := range i.GetRels() {
+		if sym := i.File.Symbols[rel.Sym]; sym.IsIfunc(ctx) {
+			sym.Flags |= NeedsPlt
 		}
 	}
+
+	ctx.Target.ScanRelocations(ctx, i)
 }
 
 func (i *InputSection) ApplyRelocAlloc(ctx *Context, base []byte) {
-	rels := i.GetRels()
-
-	for _, rel := range rels {
-		if rel.Type == uint32(elf.R_RISCV_NONE) || rel.Type == uint32(elf.R_RISCV_RELAX) {
-			continue
-		}
-
-		sym := i.File.Symbols[rel.Sym]
-		loc := base[rel.Offset:]
-
-		if sym.File == nil {
-			continue
-		}
-
-		S := sym.GetAddr()
-		A := uint64(rel.Addend)
-		P := i.GetAddr() + rel.Offset
-
-		switch elf.R_RISCV(rel.Type) {
-		case elf.R_RISCV_32:
-			utils.Write(loc, uint32(S+A))
-		case elf.R_RISCV_64:
-			utils.Write(loc, S+A)
-		case elf.R_RISCV_BRANCH:
-			WriteBtype(loc, uint32(S+A-P))
-		case elf.R_RISCV_JAL:
-			WriteJtype(loc, uint32(S+A-P))
-		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
-			val := uint32(S + A - P)
-			WriteUtype(loc, val)
-			WriteItype(loc[4:], val)
-		case elf.R_RISCV_TLS_GOT_HI20:
-			utils.Write(loc, uint32(sym.GetGotTpAddr(ctx)+A-P))
-		case elf.R_RISCV_PCREL_HI20:
-			utils.Write(loc, uint32(S+A-P))
-		case elf.R_RISCV_HI20:
-			WriteUtype(loc, uint32(S+A))
-		case elf.R_RISCV_LO12_I, elf.R_RISCV_LO12_S:
-			val := S + A
-			if rel.Type == uint32(elf.R_RISCV_LO12_I) {
-				WriteItype(loc, uint32(val))
-			} else {
-				WriteStype(loc, uint32(val))
-			}
-
-			if utils.SignExtend(val, 11) == val {
-				SetRs1(loc, 0)
-			}
-		case elf.R_RISCV_TPREL_LO12_I, elf.R_RISCV_TPREL_LO12_S:
-			val := S + A - ctx.TpAddr
-			if rel.Type == uint32(elf.R_RISCV_TPREL_LO12_I) {
-				WriteItype(loc, uint32(val))
-			} else {
-				WriteStype(loc, uint32(val))
-			}
+	ctx.Target.ApplyRelocAlloc(ctx, i, base)
+}
 
-			if utils.SignExtend(val, 11) == val {
-				SetRs1(loc, 4)
-			}
-		}
+func (i *InputSection) fatalPic(ctx *Context, sym *Symbol, typ fmt.Stringer) {
+	kind := "a PIE object"
+	if ctx.Args.Shared {
+		kind = "a shared object"
 	}
 
-	for a := 0; a < len(rels); a++ {
-		switch elf.R_RISCV(rels[a].Type) {
-		case elf.R_RISCV_PCREL_LO12_I, elf.R_RISCV_PCREL_LO12_S:
-			sym := i.File.Symbols[rels[a].Sym]
-			utils.Assert(sym.InputSection == i)
-			loc := base[rels[a].Offset:]
-			val := utils.Read[uint32](base[sym.Value:])
-
-			if rels[a].Type == uint32(elf.R_RISCV_PCREL_LO12_I) {
-				WriteItype(loc, val)
-			} else {
-				WriteStype(loc, val)
-			}
-		}
+	name := sym.Name
+	if name == "" && sym.InputSection != nil {
+		name = sym.InputSection.Name()
 	}
+	utils.Fatal(fmt.Sprintf("%s: %s: relocation %v against %s cannot be used when making %s; recompile with -fPIC",
+		i.File.File.DisplayName(), i.Name(), typ, name, kind))
+}
 
-	for a := 0; a < len(rels); a++ {
-		switch elf.R_RISCV(rels[a].Type) {
-		case elf.R_RISCV_PCREL_HI20, elf.R_RISCV_TLS_GOT_HI20:
-			loc := base[rels[a].Offset:]
-			val := utils.Read[uint32](loc)
-
-			utils.Write(loc, utils.Read[uint32](i.Contents[rels[a].Offset:]))
-			WriteUtype(loc, val)
-		}
+// ScanAbsWord handles a word-sized absolute reference. In PIC output it
+// is turned into a dynamic relocation, which must not patch code.
+func (i *InputSection) ScanAbsWord(ctx *Context, sym *Symbol, typ fmt.Stringer) {
+	if !IsPic(ctx) {
+		sym.MarkDirectAccess()
+		return
 	}
-}
 
-// github.com/jameslzhu/riscv-card/riscv-card.pdf
-func itype(val uint32) uint32 {
-	return val << 20
-}
+	if sym.IsAbsolute(ctx) {
+		return
+	}
 
-func stype(val uint32) uint32 {
-	return utils.Bits(val, 11, 5)<<25 | utils.Bits(val, 4, 0)<<7
-}
+	if i.Shdr().Flags&uint64(elf.SHF_WRITE) == 0 {
+		utils.Fatal(fmt.Sprintf("%s: %s: relocation %v against %s in read-only section; recompile with -fPIC",
+			i.File.File.DisplayName(), i.Name(), typ, sym.Name))
+	}
 
-func btype(val uint32) uint32 {
-	return utils.Bit(val, 12)<<31 | utils.Bits(val, 10, 5)<<25 |
-		utils.Bits(val, 4, 1)<<8 | utils.Bit(val, 11)<<7
+	if sym.IsPreemptible(ctx) {
+		sym.Flags |= NeedsDynsym
+	}
+	i.NumDynRelocs++
 }
 
-func utype(val uint32) uint32 {
-	return (val + 0x800) & 0xffff_f000
+// ScanAbs handles an absolute reference narrower than a word, which the
+// dynamic linker cannot adjust.
+func (i *InputSection) ScanAbs(ctx *Context, sym *Symbol, typ fmt.Stringer) {
+	if IsPic(ctx) && !sym.IsAbsolute(ctx) {
+		i.fatalPic(ctx, sym, typ)
+	}
+	sym.MarkDirectAccess()
 }
 
-func jtype(val uint32) uint32 {
-	return utils.Bit(val, 20)<<31 | utils.Bits(val, 10, 1)<<21 |
-		utils.Bit(val, 11)<<20 | utils.Bits(val, 19, 12)<<12
+// ScanPcRel handles a PC-relative reference. It works wherever the
+// output is loaded, but not if the symbol is replaced at run time.
+func (i *InputSection) ScanPcRel(ctx *Context, sym *Symbol, typ fmt.Stringer) {
+	if ctx.Args.Shared && sym.IsPreemptible(ctx) {
+		i.fatalPic(ctx, sym, typ)
+	}
+	sym.MarkDirectAccess()
 }
 
-func cbtype(val uint16) uint16 {
-	return utils.Bit(val, 8)<<12 | utils.Bit(val, 4)<<11 | utils.Bit(val, 3)<<10 |
-		utils.Bit(val, 7)<<6 | utils.Bit(val, 6)<<5 | utils.Bit(val, 2)<<4 |
-		utils.Bit(val, 1)<<3 | utils.Bit(val, 5)<<2
+// ScanTlsLe handles a local-exec TLS access, which assumes the variable
+// is in the executable.
+func (i *InputSection) ScanTlsLe(ctx *Context, sym *Symbol, typ fmt.Stringer) {
+	if ctx.Args.Shared {
+		i.fatalPic(ctx, sym, typ)
+	}
 }
 
-func cjtype(val uint16) uint16 {
-	return utils.Bit(val, 11)<<12 | utils.Bit(val, 4)<<11 | utils.Bit(val, 9)<<10 |
-		utils.Bit(val, 8)<<9 | utils.Bit(val, 10)<<8 | utils.Bit(val, 6)<<7 |
-		utils.Bit(val, 7)<<6 | utils.Bit(val, 3)<<5 | utils.Bit(val, 2)<<4 |
-		utils.Bit(val, 1)<<3 | utils.Bit(val, 5)<<2
+// ApplyAbsWord applies a relocation that was scanned by ScanAbsWord.
+func (i *InputSection) ApplyAbsWord(ctx *Context, loc []byte, rel Rela, S, A uint64) {
+	sym := i.File.Symbols[rel.Sym]
+	P := i.GetAddr() + rel.Offset
+	types := ctx.Target.DynRelocs()
+
+	switch {
+	case !IsPic(ctx) || sym.IsAbsolute(ctx):
+		WriteWord(ctx, loc, S+A)
+	case sym.IsPreemptible(ctx):
+		i.EmitDynReloc(ctx, Rela{Offset: P, Type: types.Abs, Sym: uint32(sym.DynsymIdx), Addend: int64(A)})
+	default:
+		i.EmitDynReloc(ctx, Rela{Offset: P, Type: types.Relative, Addend: int64(S + A)})
+		WriteWord(ctx, loc, S+A)
+	}
 }
 
-func WriteItype(loc []byte, val uint32) {
-	mask := uint32(0b000000_00000_11111_111_11111_1111111)
-	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|itype(val))
+// EmitDynReloc writes rel to the slots of .rela.dyn reserved for this
+// section.
+func (i *InputSection) EmitDynReloc(ctx *Context, rel Rela) {
+	base := ctx.Buf[ctx.RelaDyn.Shdr.Offset:]
+	WriteRela(ctx, base[i.DynRelocIdx*RelaEntSize(ctx):], rel)
+	i.DynRelocIdx++
 }
 
-func WriteStype(loc []byte, val uint32) {
-	mask := uint32(0b000000_11111_11111_111_00000_1111111)
-	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|stype(val))
+// ApplyRelocNonAlloc applies relocations of non-allocated sections,
+// which are mostly DWARF.
+func (i *InputSection) ApplyRelocNonAlloc(ctx *Context, base []byte) {
+	ctx.Target.ApplyRelocNonAlloc(ctx, i, base)
 }
 
-func WriteBtype(loc []byte, val uint32) {
-	mask := uint32(0b000000_11111_11111_111_00000_1111111)
-	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|btype(val))
-}
+// GetTombstone reports whether rel refers to a discarded section, and
+// if so, the value to write instead of its address, so that debuggers
+// can tell such references apart from real addresses.
+func (i *InputSection) GetTombstone(rel Rela) (uint64, bool) {
+	sym := i.File.Symbols[rel.Sym]
+	if sym.InputSection == nil || sym.InputSection.IsAlive {
+		return 0, false
+	}
 
-func WriteUtype(loc []byte, val uint32) {
-	mask := uint32(0b000000_00000_00000_000_11111_1111111)
-	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|utype(val))
+	if name := i.Name(); name == ".debug_loc" || name == ".debug_ranges" {
+		// 0 would terminate a location or range list.
+		return 1, true
+	}
+	return 0, true
 }
 
-func WriteJtype(loc []byte, val uint32) {
-	mask := uint32(0b000000_00000_00000_000_11111_1111111)
-	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|jtype(val))
-}
+// GetSymAddrAndAddend returns S and A of rel. Mergeable sections are
+// split into fragments, so a reference to such a section's symbol is
+// redirected to the fragment its addend points into.
+func (i *InputSection) GetSymAddrAndAddend(rel Rela) (uint64, uint64) {
+	sym := i.File.Symbols[rel.Sym]
+
+	if int(rel.Sym) < i.File.FirstGlobal {
+		esym := &i.File.SymTable[rel.Sym]
+		if elf.SymType(esym.Type()) == elf.STT_SECTION {
+			if m := i.File.MergeableSections[i.File.GetShndx(esym, int(rel.Sym))]; m != nil {
+				frag, offset := m.GetFragment(uint32(rel.Addend))
+				if frag == nil {
+					utils.Fatal("bad relocation addend for mergeable section")
+				}
+				return frag.GetAddr(), uint64(offset)
+			}
+		}
+	}
 
-func SetRs1(loc []byte, rs1 uint32) {
-	utils.Write[uint32](loc, utils.Read[uint32](loc)&(0b111111_11111_00000_111_11111_1111111))
-	utils.Write[uint32](loc, utils.Read[uint32](loc)|(rs1<<15))
+	return sym.GetAddr(), uint64(rel.Addend)
 }
-
@@ -0,0 +1,298 @@
+package linker
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"rvld/pkg/utils"
+	"sort"
+	"strings"
+)
+
+type MapSymbol struct {
+	Name string `json:"name"`
+	Addr uint64 `json:"addr"`
+	Size uint64 `json:"size"`
+}
+
+type MapInputSection struct {
+	File    string      `json:"file"`
+	Name    string      `json:"name"`
+	Addr    uint64      `json:"addr"`
+	Size    uint64      `json:"size"`
+	Align   uint64      `json:"align"`
+	Symbols []MapSymbol `json:"symbols,omitempty"`
+}
+
+type MapMergedInput struct {
+	File string `json:"file"`
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+type MapChunk struct {
+	Name         string            `json:"name"`
+	Addr         uint64            `json:"addr"`
+	LoadAddr     uint64            `json:"load_addr"`
+	Offset       uint64            `json:"offset"`
+	Size         uint64            `json:"size"`
+	Align        uint64            `json:"align"`
+	Inputs       []MapInputSection `json:"inputs,omitempty"`
+	MergedInputs []MapMergedInput  `json:"merged_inputs,omitempty"`
+	Symbols      []MapSymbol       `json:"symbols,omitempty"`
+}
+
+type MapMemoryRegion struct {
+	Name   string `json:"name"`
+	Attrs  string `json:"attrs,omitempty"`
+	Origin uint64 `json:"origin"`
+	Length uint64 `json:"length"`
+}
+
+type MapDiscarded struct {
+	File string `json:"file"`
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+type LinkMap struct {
+	Output    string            `json:"output"`
+	Memory    []MapMemoryRegion `json:"memory,omitempty"`
+	Inputs    []string          `json:"inputs"`
+	Discarded []MapDiscarded    `json:"discarded,omitempty"`
+	Chunks    []MapChunk        `json:"chunks"`
+
+	// Absolute symbols, such as those a linker script assigns.
+	Symbols []MapSymbol `json:"symbols,omitempty"`
+}
+
+// BuildLinkMap describes where every input section and symbol ended up
+// in the output. It must be called after addresses are assigned.
+func BuildLinkMap(ctx *Context) *LinkMap {
+	isecSyms := make(map[*InputSection][]MapSymbol)
+	chunkSyms := make(map[Chunker][]MapSymbol)
+	absSyms := make([]MapSymbol, 0)
+
+	addSym := func(sym *Symbol) {
+		if !sym.IsSymtabCandidate() || elf.SymType(sym.ELFSym().Type()) == elf.STT_FILE {
+			return
+		}
+
+		msym := MapSymbol{Name: sym.Name, Addr: sym.GetAddr(), Size: sym.ELFSym().Size}
+		switch {
+		case sym.InputSection != nil:
+			isecSyms[sym.InputSection] = append(isecSyms[sym.InputSection], msym)
+		case sym.SectionFragment != nil:
+			chunk := Chunker(sym.SectionFragment.OutputSection)
+			chunkSyms[chunk] = append(chunkSyms[chunk], msym)
+		case sym.OutputChunk != nil:
+			chunkSyms[sym.OutputChunk] = append(chunkSyms[sym.OutputChunk], msym)
+		default:
+			absSyms = append(absSyms, msym)
+		}
+	}
+
+	mergedInputs := make(map[*MergedSection][]MapMergedInput)
+
+	for _, file := range ctx.Objs {
+		for i := 1; i < file.FirstGlobal; i++ {
+			addSym(&file.LocalSymbols[i])
+		}
+
+		for i := file.FirstGlobal; i < len(file.Symbols); i++ {
+			if sym := file.Symbols[i]; sym.File == file {
+				addSym(sym)
+			}
+		}
+
+		for i, m := range file.MergeableSections {
+			if m == nil {
+				continue
+			}
+
+			mergedInputs[m.Parent] = append(mergedInputs[m.Parent], MapMergedInput{
+				File: file.File.DisplayName(),
+				Name: file.Sections[i].Name(),
+				Size: uint64(len(file.Sections[i].Contents)),
+			})
+		}
+	}
+
+	sortSyms := func(syms []MapSymbol) []MapSymbol {
+		sort.SliceStable(syms, func(i, j int) bool {
+			return syms[i].Addr < syms[j].Addr
+		})
+		return syms
+	}
+
+	m := &LinkMap{Output: ctx.Args.Output, Symbols: sortSyms(absSyms)}
+
+	if ctx.Script != nil {
+		for _, r := range ctx.Script.Memory {
+			m.Memory = append(m.Memory, MapMemoryRegion{Name: r.Name, Attrs: r.Attrs, Origin: r.Origin, Length: r.Length})
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		if file == ctx.InternalObj {
+			continue
+		}
+		m.Inputs = append(m.Inputs, file.File.DisplayName())
+
+		// Sections that are split into pieces or records are not
+		// discarded, but copied in another form.
+		for i, isec := range file.Sections {
+			if isec == nil || isec.IsAlive || file.MergeableSections[i] != nil ||
+				isec.Name() == ".eh_frame" && !ctx.Args.Relocatable {
+				continue
+			}
+
+			m.Discarded = append(m.Discarded, MapDiscarded{
+				File: file.File.DisplayName(),
+				Name: isec.Name(),
+				Size: uint64(isec.ShSize),
+			})
+		}
+	}
+	for _, dso := range ctx.Dsos {
+		m.Inputs = append(m.Inputs, dso.File.DisplayName())
+	}
+
+	for _, chunk := range ctx.Chunks {
+		if chunk.GetShndx() == 0 {
+			continue
+		}
+
+		shdr := chunk.GetShdr()
+		mc := MapChunk{
+			Name:     chunk.GetName(),
+			Addr:     shdr.Addr,
+			LoadAddr: GetLoadAddr(ctx, chunk),
+			Offset:   shdr.Offset,
+			Size:     shdr.Size,
+			Align:    shdr.Addralign,
+			Symbols:  sortSyms(chunkSyms[chunk]),
+		}
+
+		if c, ok := chunk.(*CompressedSection); ok {
+			chunk = c.Original
+		}
+
+		switch c := chunk.(type) {
+		case *OutputSection:
+			for _, isec := range c.Members {
+				mc.Inputs = append(mc.Inputs, MapInputSection{
+					File:    isec.File.File.DisplayName(),
+					Name:    isec.Name(),
+					Addr:    isec.GetAddr(),
+					Size:    uint64(isec.ShSize),
+					Align:   1 << isec.P2Align,
+					Symbols: sortSyms(isecSyms[isec]),
+				})
+			}
+		case *MergedSection:
+			mc.MergedInputs = mergedInputs[c]
+		}
+
+		m.Chunks = append(m.Chunks, mc)
+	}
+
+	return m
+}
+
+// WriteText writes the map in the layout of GNU ld's, with a line for
+// each output section, followed by its input sections and symbols.
+func (m *LinkMap) WriteText(w io.Writer) {
+	// A name that does not fit in its column goes on a line of its own.
+	name := func(s string) string {
+		if len(s) >= 16 {
+			return s + "\n" + strings.Repeat(" ", 16)
+		}
+		return fmt.Sprintf("%-16s", s)
+	}
+
+	writeSym := func(sym MapSymbol) {
+		fmt.Fprintf(w, "%16s0x%016x                %s\n", "", sym.Addr, sym.Name)
+	}
+
+	fmt.Fprintf(w, "Discarded input sections\n\n")
+	for _, d := range m.Discarded {
+		fmt.Fprintf(w, "%s0x%016x %#10x %s\n", name(" "+d.Name), 0, d.Size, d.File)
+	}
+
+	fmt.Fprintf(w, "\nMemory Configuration\n\n")
+	fmt.Fprintf(w, "%-16s %-18s %-18s %s\n", "Name", "Origin", "Length", "Attributes")
+	for _, r := range m.Memory {
+		fmt.Fprintf(w, "%-16s 0x%016x 0x%016x %s\n", r.Name, r.Origin, r.Length, r.Attrs)
+	}
+	fmt.Fprintf(w, "%-16s 0x%016x 0x%016x\n", "*default*", 0, uint64(math.MaxUint64))
+
+	fmt.Fprintf(w, "\nLinker script and memory map\n\n")
+	for _, in := range m.Inputs {
+		fmt.Fprintf(w, "LOAD %s\n", in)
+	}
+	for _, sym := range m.Symbols {
+		writeSym(sym)
+	}
+
+	for _, c := range m.Chunks {
+		fmt.Fprintf(w, "\n%s0x%016x %#10x", name(c.Name), c.Addr, c.Size)
+		if c.LoadAddr != c.Addr {
+			fmt.Fprintf(w, " load address 0x%016x", c.LoadAddr)
+		}
+		fmt.Fprintf(w, "\n")
+
+		for _, isec := range c.Inputs {
+			fmt.Fprintf(w, "%s0x%016x %#10x %s\n", name(" "+isec.Name), isec.Addr, isec.Size, isec.File)
+			for _, sym := range isec.Symbols {
+				writeSym(sym)
+			}
+		}
+
+		// The contents of merged sections have no place of their own,
+		// so the inputs are listed at the start of the section.
+		for _, in := range c.MergedInputs {
+			fmt.Fprintf(w, "%s0x%016x %#10x %s\n", name(" "+in.Name), c.Addr, in.Size, in.File)
+		}
+
+		for _, sym := range c.Symbols {
+			writeSym(sym)
+		}
+	}
+}
+
+func (m *LinkMap) WriteJSON(w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	utils.MustNo(enc.Encode(m))
+}
+
+// PrintMap writes the link map requested by -Map and --print-map.
+func PrintMap(ctx *Context) {
+	m := BuildLinkMap(ctx)
+
+	write := func(w io.Writer) {
+		bw := bufio.NewWriter(w)
+		if ctx.Args.MapFormat == "json" {
+			m.WriteJSON(bw)
+		} else {
+			m.WriteText(bw)
+		}
+		utils.MustNo(bw.Flush())
+	}
+
+	if ctx.Args.MapFile != "" {
+		f, err := os.Create(ctx.Args.MapFile)
+		utils.MustNo(err)
+		write(f)
+		utils.MustNo(f.Close())
+	}
+
+	if ctx.Args.PrintMap {
+		write(os.Stdout)
+	}
+}
@@ -10,19 +10,33 @@ type MachineType = uint8
 const (
 	MachineTypeNone    MachineType = iota
 	MachineTypeRISCV64 MachineType = iota
+	MachineTypeRISCV32 MachineType = iota
+	MachineTypeX86_64  MachineType = iota
+	MachineTypeARM64   MachineType = iota
 )
 
 func GetMachineTypeFromContext(contents []byte) MachineType {
 	ft := GetFileType(contents)
 
 	switch ft {
-	case FileTypeObject:
+	case FileTypeObject, FileTypeDso:
 		machine := elf.Machine(utils.Read[uint16](contents[18:]))
-		if machine == elf.EM_RISCV {
-			class := elf.Class(contents[4])
+		class := elf.Class(contents[4])
+		switch machine {
+		case elf.EM_RISCV:
 			switch class {
 			case elf.ELFCLASS64:
 				return MachineTypeRISCV64
+			case elf.ELFCLASS32:
+				return MachineTypeRISCV32
+			}
+		case elf.EM_X86_64:
+			if class == elf.ELFCLASS64 {
+				return MachineTypeX86_64
+			}
+		case elf.EM_AARCH64:
+			if class == elf.ELFCLASS64 {
+				return MachineTypeARM64
 			}
 		}
 	}
@@ -38,6 +52,12 @@ func (m MachineTypeStringer) String() string {
 	switch m.MachineType {
 	case MachineTypeRISCV64:
 		return "riscv64"
+	case MachineTypeRISCV32:
+		return "riscv32"
+	case MachineTypeX86_64:
+		return "x86_64"
+	case MachineTypeARM64:
+		return "arm64"
 	}
 
 	utils.Assert(m.MachineType == MachineTypeNone)
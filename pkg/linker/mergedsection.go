@@ -11,7 +11,7 @@ type MergedSection struct {
 	Map map[string]*SectionFragment
 }
 
-func NewMergedSection(name string, flags uint64, typ uint32) *MergedSection {
+func NewMergedSection(name string, flags uint64, typ uint32, entsize uint64) *MergedSection {
 	m := &MergedSection{
 		Chunk: NewChunk(),
 		Map:   make(map[string]*SectionFragment),
@@ -20,17 +20,26 @@ func NewMergedSection(name string, flags uint64, typ uint32) *MergedSection {
 	m.Name = name
 	m.Shdr.Flags = flags
 	m.Shdr.Type = typ
+	m.Shdr.Entsize = entsize
 
 	return m
 }
 
-func GetMergedSectionInstance(ctx *Context, name string, typ uint32, flags uint64) *MergedSection {
-	name = GetOutputName(name, flags)
-	flags = flags & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_MERGE) & ^uint64(elf.SHF_STRINGS) & ^uint64(elf.SHF_COMPRESSED)
+func GetMergedSectionInstance(ctx *Context, name string, typ uint32, flags uint64, entsize uint64) *MergedSection {
+	flags = flags & ^uint64(elf.SHF_GROUP) & ^uint64(elf.SHF_COMPRESSED)
+
+	// Relocatable output stays mergeable, so that the final link can
+	// merge its pieces with those of other files.
+	if !ctx.Args.Relocatable {
+		name = GetOutputName(name, flags)
+		flags = flags & ^uint64(elf.SHF_MERGE) & ^uint64(elf.SHF_STRINGS)
+		entsize = 0
+	}
 
 	find := func() *MergedSection {
 		for _, osec := range ctx.MergedSections {
-			if name == osec.Name && flags == osec.Shdr.Flags && typ == osec.Shdr.Type {
+			if name == osec.Name && flags == osec.Shdr.Flags && typ == osec.Shdr.Type &&
+				entsize == osec.Shdr.Entsize {
 				return osec
 			}
 		}
@@ -41,7 +50,7 @@ func GetMergedSectionInstance(ctx *Context, name string, typ uint32, flags uint6
 		return osec
 	}
 
-	osec := NewMergedSection(name, flags, typ)
+	osec := NewMergedSection(name, flags, typ, entsize)
 	ctx.MergedSections = append(ctx.MergedSections, osec)
 
 	return osec
@@ -5,6 +5,7 @@ import (
 	"debug/elf"
 	"math"
 	"rvld/pkg/utils"
+	"strings"
 )
 
 type ObjectFile struct {
@@ -14,7 +15,29 @@ type ObjectFile struct {
 	SymtabShndxSec []uint32
 	Sections       []*InputSection
 
-	MergeableSections []*MergeableSection
+	MergeableSections  []*MergeableSection
+	RiscvAttributesSec *SectionHeader
+	RiscvAttributes    *RiscvAttributes
+	Addrsig            []byte
+	Cies               []*CieRecord
+	Fdes               []*FdeRecord
+	Groups             []*GroupSection
+
+	LocalSymtabIdx  int64
+	GlobalSymtabIdx int64
+	NumLocalSymtab  int64
+	NumGlobalSymtab int64
+	StrtabOffset    int64
+	StrtabSize      int64
+
+	// Shared libraries only contribute their dynamic symbols.
+	IsDso   bool
+	Soname  string
+	Versyms []uint16
+
+	// A shared library read under --as-needed, or in AS_NEEDED, which
+	// is only linked if an object refers to it.
+	AsNeeded bool
 }
 
 func NewObjectFile(file *File, isAlive bool) *ObjectFile {
@@ -34,11 +57,35 @@ func (o *ObjectFile) Parse(ctx *Context) {
 	// initialize Sections
 	o.InitializeSections(ctx)
 	o.InitializeSymbols(ctx)
+}
+
+// ParseSections reads the section contents of a file that is part of the
+// link. It runs once archive members have been selected, so members that
+// are not loaded are never decompressed or split.
+func (o *ObjectFile) ParseSections(ctx *Context) {
+	if o.RiscvAttributesSec != nil {
+		o.RiscvAttributes = ParseRiscvAttributes(o.File, o.GetBytesFromShdr(o.RiscvAttributesSec))
+	}
+
+	o.DecompressSections()
 
 	// initialize Mergeable Sections
 	o.InitializeMergeableSections(ctx)
-	o.SkipEhframeSections()
 
+	// Relocatable output copies .eh_frame like any other section.
+	if !ctx.Args.Relocatable {
+		o.ParseEhFrame(ctx)
+	}
+}
+
+func (o *ObjectFile) DecompressSections() {
+	for _, isec := range o.Sections {
+		if isec == nil || isec.Shdr().Flags&uint64(elf.SHF_COMPRESSED) == 0 {
+			continue
+		}
+
+		isec.Contents = DecompressSection(o.File, isec.Shndx, isec.Name(), isec.Contents, o.Is64)
+	}
 }
 
 func (o *ObjectFile) InitializeSections(ctx *Context) {
@@ -47,10 +94,23 @@ func (o *ObjectFile) InitializeSections(ctx *Context) {
 	for i := 0; i < len(o.InputFile.Sections); i++ {
 		shdr := &o.InputFile.Sections[i]
 		switch elf.SectionType(shdr.Type) {
-		case elf.SHT_GROUP, elf.SHT_SYMTAB, elf.SHT_STRTAB, elf.SHT_REL, elf.SHT_RELA, elf.SHT_NULL:
+		case elf.SHT_GROUP:
+			if ctx.Args.Relocatable {
+				o.Groups = append(o.Groups, NewGroupSection(o, shdr))
+			}
+		case elf.SHT_SYMTAB, elf.SHT_STRTAB, elf.SHT_REL, elf.SHT_RELA, elf.SHT_NULL:
 			break
 		case elf.SHT_SYMTAB_SHNDX:
 			o.FillUpSymtabShndxSec(shdr)
+		case elf.SectionType(SHT_RISCV_ATTRIBUTES):
+			// Attributes are merged across files into a single synthetic
+			// section instead of being concatenated.
+			o.RiscvAttributesSec = shdr
+		case elf.SectionType(SHT_LLVM_ADDRSIG):
+			// The symbol indices are only meaningful to this file, so the
+			// section is consumed by --icf=safe, or rewritten against the
+			// output symbol table by -r, rather than copied.
+			o.Addrsig = o.GetBytesFromShdr(shdr)
 		default:
 			name := GetNameFromTable(o.InputFile.StrTable, shdr.Name)
 			o.Sections[i] = NewInputSection(ctx, name, o, uint32(i))
@@ -148,6 +208,23 @@ func (o *ObjectFile) ResolveSymbols() {
 	}
 }
 
+// ClaimUnresolvedSymbols makes the file own the symbols it refers to but
+// no input defines, so that a shared library can import them at load
+// time.
+func (o *ObjectFile) ClaimUnresolvedSymbols() {
+	for i := o.FirstGlobal; i < len(o.InputFile.SymTable); i++ {
+		sym := o.Symbols[i]
+		if !o.InputFile.SymTable[i].IsUndef() || sym.File != nil {
+			continue
+		}
+
+		sym.File = o
+		sym.SetInputSection(nil)
+		sym.Value = 0
+		sym.SymIdx = int32(i)
+	}
+}
+
 func (o *ObjectFile) GetSecion(esym *Sym64, idx int) *InputSection {
 	return o.Sections[o.GetShndx(esym, idx)]
 }
@@ -182,10 +259,24 @@ func (o *ObjectFile) InitializeMergeableSections(ctx *Context) {
 	o.MergeableSections = make([]*MergeableSection, len(o.Sections))
 	for i := 0; i < len(o.Sections); i++ {
 		isec := o.Sections[i]
-		if isec != nil && isec.IsAlive && isec.Shdr().Flags&uint64(elf.SHF_MERGE) != 0 {
-			o.MergeableSections[i] = SplitSection(ctx, isec)
-			isec.IsAlive = false
+		if isec == nil || !isec.IsAlive || isec.Shdr().Flags&uint64(elf.SHF_MERGE) == 0 {
+			continue
 		}
+
+		// Pieces of a group member would not stay in the group, so
+		// relocatable output copies such sections as they are.
+		if ctx.Args.Relocatable && isec.Shdr().Flags&uint64(elf.SHF_GROUP) != 0 {
+			continue
+		}
+
+		// So are sections that a linker script places, as the pieces
+		// would end up in a section of their own.
+		if isec.OutputSection.Desc != nil {
+			continue
+		}
+
+		o.MergeableSections[i] = SplitSection(ctx, isec)
+		isec.IsAlive = false
 	}
 }
 
@@ -193,7 +284,7 @@ func SplitSection(ctx *Context, isec *InputSection) *MergeableSection {
 	m := &MergeableSection{}
 	shdr := isec.Shdr()
 
-	m.Parent = GetMergedSectionInstance(ctx, isec.Name(), shdr.Type, shdr.Flags)
+	m.Parent = GetMergedSectionInstance(ctx, isec.Name(), shdr.Type, shdr.Flags, shdr.Entsize)
 	m.P2Align = isec.P2Align
 
 	data := isec.Contents
@@ -284,18 +375,191 @@ func (o *ObjectFile) RegisterSectionPieces() {
 	}
 }
 
-func (o *ObjectFile) SkipEhframeSections() {
+func (o *ObjectFile) ScanRelocations(ctx *Context) {
 	for _, isec := range o.Sections {
-		if isec != nil && isec.IsAlive && isec.Name() == ".eh_frame" {
-			isec.IsAlive = false
+		if isec != nil && isec.IsAlive && isec.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
+			isec.ScanRelocations(ctx)
 		}
 	}
 }
 
-func (o *ObjectFile) ScanRelocations() {
-	for _, isec := range o.Sections {
-		if isec != nil && isec.IsAlive && isec.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
-			isec.ScanRelocations()
+func (o *ObjectFile) ComputeSymtabSize(ctx *Context) {
+	o.NumLocalSymtab = 0
+	o.NumGlobalSymtab = 0
+	o.StrtabSize = 0
+
+	if o.NeedsFileSymbol(ctx) {
+		o.NumLocalSymtab++
+		o.StrtabSize += int64(len(o.File.Name)) + 1
+	}
+
+	for i := 1; i < o.FirstGlobal; i++ {
+		sym := &o.LocalSymbols[i]
+		if o.ShouldWriteLocal(ctx, sym) {
+			o.NumLocalSymtab++
+			o.StrtabSize += int64(len(sym.Name)) + 1
+		}
+	}
+
+	for i := o.FirstGlobal; i < len(o.Symbols); i++ {
+		sym := o.Symbols[i]
+		if sym.File == o && o.ShouldWriteGlobal(ctx, sym) {
+			if isLocalInOutput(ctx, sym) {
+				o.NumLocalSymtab++
+			} else {
+				o.NumGlobalSymtab++
+			}
+			o.StrtabSize += int64(len(sym.Name)) + 1
+		}
+	}
+}
+
+// isLocalInOutput reports whether a global symbol is written as a local
+// one, as hidden symbols are once the link is final.
+func isLocalInOutput(ctx *Context, sym *Symbol) bool {
+	vis := elf.SymVis(sym.ELFSym().Other & 3)
+	return !ctx.Args.Relocatable && (vis == elf.STV_HIDDEN || vis == elf.STV_INTERNAL)
+}
+
+// HasFileSymbol reports whether the input symbol table already carries
+// an STT_FILE entry, which is usually emitted by the assembler.
+func (o *ObjectFile) HasFileSymbol() bool {
+	for i := 1; i < o.FirstGlobal; i++ {
+		if elf.SymType(o.SymTable[i].Type()) == elf.STT_FILE {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsFileSymbol reports whether an STT_FILE entry has to be made up
+// for this file so that its local symbols are attributed correctly.
+func (o *ObjectFile) NeedsFileSymbol(ctx *Context) bool {
+	return o != ctx.InternalObj && !o.HasFileSymbol() &&
+		!ctx.Args.DiscardAll && ctx.RetainSymbols == nil
+}
+
+func (o *ObjectFile) ShouldWriteLocal(ctx *Context, sym *Symbol) bool {
+	if !sym.IsSymtabCandidate() {
+		return false
+	}
+
+	// Relocations in relocatable output may still refer to any local.
+	if ctx.Args.Relocatable {
+		return true
+	}
+
+	if ctx.Args.DiscardAll || ctx.RetainSymbols != nil {
+		return false
+	}
+
+	// -X drops assembler temporaries, which are named .L*.
+	return !ctx.Args.DiscardLocals || !strings.HasPrefix(sym.Name, ".L")
+}
+
+func (o *ObjectFile) ShouldWriteGlobal(ctx *Context, sym *Symbol) bool {
+	// Relocatable output keeps undefined and common symbols for the
+	// final link.
+	if ctx.Args.Relocatable {
+		esym := sym.ELFSym()
+		return sym.IsSymtabCandidate() || esym.IsUndef() || esym.IsCommon()
+	}
+
+	if !sym.IsSymtabCandidate() {
+		return false
+	}
+
+	return ctx.RetainSymbols == nil || ctx.RetainSymbols[sym.Name]
+}
+
+// AssignSymtabIndices records where PopulateSymtab puts each symbol, so
+// that relocations in relocatable output can refer to them.
+func (o *ObjectFile) AssignSymtabIndices(ctx *Context) {
+	idx := o.LocalSymtabIdx
+	if o.NeedsFileSymbol(ctx) {
+		idx++
+	}
+
+	for i := 1; i < o.FirstGlobal; i++ {
+		sym := &o.LocalSymbols[i]
+		if o.ShouldWriteLocal(ctx, sym) {
+			sym.SymtabIdx = int32(idx)
+			idx++
+		}
+	}
+
+	idx = o.GlobalSymtabIdx
+	for i := o.FirstGlobal; i < len(o.Symbols); i++ {
+		sym := o.Symbols[i]
+		if sym.File == o && o.ShouldWriteGlobal(ctx, sym) {
+			sym.SymtabIdx = int32(idx)
+			idx++
+		}
+	}
+}
+
+func (o *ObjectFile) PopulateSymtab(ctx *Context) {
+	symtab := ctx.Buf[ctx.Symtab.Shdr.Offset:]
+	strtab := ctx.Buf[ctx.Strtab.Shdr.Offset:]
+	strOff := o.StrtabOffset
+
+	writeName := func(name string) uint32 {
+		off := strOff
+		copy(strtab[off:], name)
+		strtab[off+int64(len(name))] = 0
+		strOff += int64(len(name)) + 1
+		return uint32(off)
+	}
+
+	write := func(sym *Symbol, idx int64) {
+		esym := *sym.ELFSym()
+		esym.Name = writeName(sym.Name)
+		if sym.File == o && isLocalInOutput(ctx, sym) {
+			esym.Info = uint8(elf.STB_LOCAL)<<4 | esym.Type()
+		}
+		if esym.IsUndef() || esym.IsCommon() {
+			WriteSym(ctx, symtab[uint64(idx)*SymSize(ctx):], esym)
+			return
+		}
+		esym.Shndx = uint16(sym.GetOutputShndx())
+		esym.Value = sym.GetAddr()
+		if elf.SymType(esym.Type()) == elf.STT_TLS {
+			esym.Value -= ctx.TlsBegin
+		}
+		WriteSym(ctx, symtab[uint64(idx)*SymSize(ctx):], esym)
+	}
+
+	idx := o.LocalSymtabIdx
+	if o.NeedsFileSymbol(ctx) {
+		WriteSym(ctx, symtab[uint64(idx)*SymSize(ctx):], Sym64{
+			Name:  writeName(o.File.Name),
+			Info:  uint8(elf.STB_LOCAL)<<4 | uint8(elf.STT_FILE),
+			Shndx: uint16(elf.SHN_ABS),
+		})
+		idx++
+	}
+
+	for i := 1; i < o.FirstGlobal; i++ {
+		sym := &o.LocalSymbols[i]
+		if o.ShouldWriteLocal(ctx, sym) {
+			write(sym, idx)
+			idx++
+		}
+	}
+
+	globalIdx := o.GlobalSymtabIdx
+	for i := o.FirstGlobal; i < len(o.Symbols); i++ {
+		sym := o.Symbols[i]
+		if sym.File != o || !o.ShouldWriteGlobal(ctx, sym) {
+			continue
+		}
+
+		if isLocalInOutput(ctx, sym) {
+			write(sym, idx)
+			idx++
+		} else {
+			write(sym, globalIdx)
+			globalIdx++
 		}
 	}
 }
@@ -1,22 +1,22 @@
 package linker
 
 import (
-	"bytes"
 	"debug/elf"
-	"encoding/binary"
+	"fmt"
 	"rvld/pkg/utils"
+	"strconv"
 )
 
 type OutputEhdr struct {
 	Chunk
 }
 
-func NewOutputEhdr() *OutputEhdr {
+func NewOutputEhdr(ctx *Context) *OutputEhdr {
 	return &OutputEhdr{
 		Chunk{
 			Shdr: SectionHeader{
 				Flags:     uint64(elf.SHF_ALLOC),
-				Size:      uint64(ELFHeaderSize),
+				Size:      EhdrSize(ctx),
 				Addralign: 8,
 			},
 		},
@@ -27,47 +27,65 @@ func (o *OutputEhdr) CopyBuf(ctx *Context) {
 	ehdr := &Header64{}
 	WriteMagic(ehdr.Ident[:])
 	ehdr.Ident[elf.EI_CLASS] = uint8(elf.ELFCLASS64)
+	if !IsELF64(ctx) {
+		ehdr.Ident[elf.EI_CLASS] = uint8(elf.ELFCLASS32)
+	}
 	ehdr.Ident[elf.EI_DATA] = uint8(elf.ELFDATA2LSB)
 	ehdr.Ident[elf.EI_VERSION] = uint8(elf.EV_CURRENT)
 	ehdr.Ident[elf.EI_OSABI] = 0
 	ehdr.Ident[elf.EI_ABIVERSION] = 0
 
 	ehdr.Type = uint16(elf.ET_EXEC) // Executable file
-	ehdr.Machine = uint16(elf.EM_RISCV)
+	if IsPic(ctx) {
+		ehdr.Type = uint16(elf.ET_DYN)
+	}
+	if ctx.Args.Relocatable {
+		ehdr.Type = uint16(elf.ET_REL)
+	}
+	ehdr.Machine = uint16(ctx.Target.ELFMachine())
 	ehdr.Version = uint32(elf.EV_CURRENT)
-	ehdr.Entry = GetEntryAddress(ctx)
-	ehdr.Phoff = ctx.Phdr.Shdr.Offset
+	ehdr.Flags = ctx.EFlags
+	if ctx.Phdr != nil {
+		ehdr.Entry = GetEntryAddress(ctx)
+		ehdr.Phoff = ctx.Phdr.Shdr.Offset
+		ehdr.Phnum = uint16(ctx.Phdr.Shdr.Size / PhdrSize(ctx))
+	}
 	ehdr.Shoff = ctx.Shdr.Shdr.Offset
-	ehdr.Ehsize = uint16(ELFHeaderSize)
-	ehdr.Phentsize = uint16(ProgramHeaderSize)
-	ehdr.Phnum = uint16(ctx.Phdr.Shdr.Size) / uint16(ProgramHeaderSize)
-	ehdr.Shentsize = uint16(SectionHeaderSize)
-	ehdr.Shnum = uint16(ctx.Shdr.Shdr.Size) / uint16(SectionHeaderSize)
+	ehdr.Ehsize = uint16(EhdrSize(ctx))
+	ehdr.Phentsize = uint16(PhdrSize(ctx))
+	ehdr.Shentsize = uint16(ShdrSize(ctx))
+	ehdr.Shnum = uint16(ctx.Shdr.Shdr.Size / ShdrSize(ctx))
+	ehdr.Shstrndx = uint16(ctx.Shstrtab.Shndx)
 
-	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.LittleEndian, ehdr)
-	utils.MustNo(err)
-	copy(ctx.Buf[o.Shdr.Offset:], buf.Bytes())
+	WriteEhdr(ctx, ctx.Buf[o.Shdr.Offset:], ehdr)
 }
 
+// GetEntryAddress resolves the -e argument. As with GNU ld, it is
+// looked up as a symbol first and then parsed as a number. If neither
+// works, the start of .text is used.
 func GetEntryAddress(ctx *Context) uint64 {
-	for _, osec := range ctx.OutputSections {
-		if osec.Name == ".text" {
-			return osec.Shdr.Addr
-		}
+	if sym, ok := ctx.SymbolMap[ctx.Args.Entry]; ok && sym.File != nil {
+		return sym.GetAddr()
+	}
+
+	if addr, err := strconv.ParseUint(ctx.Args.Entry, 0, 64); err == nil {
+		return addr
 	}
-	return 0
-}
 
-func GetFlags(ctx *Context) uint32 {
-	utils.Assert(len(ctx.Objs) > 0)
-	flags := ctx.Objs[0].GetEhdr().Flags
+	// Shared libraries usually have no entry point.
+	if ctx.Args.Shared {
+		return 0
+	}
 
-	for _, obj := range ctx.Objs[1:] {
-		if obj.GetEhdr().Flags&EF_RISCV_RVC != 0 {
-			flags |= EF_RISCV_RVC
-			break
+	for _, osec := range ctx.OutputSections {
+		if osec.Name == ".text" && len(osec.Members) > 0 {
+			utils.Warn(fmt.Sprintf("cannot find entry symbol %s; defaulting to 0x%x",
+				ctx.Args.Entry, osec.Shdr.Addr))
+			return osec.Shdr.Addr
 		}
 	}
-	return flags
+
+	utils.Warn(fmt.Sprintf("cannot find entry symbol %s; not setting start address",
+		ctx.Args.Entry))
+	return 0
 }
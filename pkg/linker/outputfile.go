@@ -0,0 +1,61 @@
+package linker
+
+import (
+	"os"
+	"path/filepath"
+	"rvld/pkg/utils"
+)
+
+// OutputFile is the destination of the link. The image is built in a
+// temporary file next to the destination, which is renamed over it
+// only once everything has been written, so a failed link never leaves
+// a partially written output behind.
+type OutputFile struct {
+	Path string
+	Perm os.FileMode
+	File *os.File
+	Buf  []byte
+}
+
+// OpenOutputFile creates the output image. perm is its mode before the
+// umask is applied.
+func OpenOutputFile(path string, size uint64, perm os.FileMode) *OutputFile {
+	o := &OutputFile{Path: path, Perm: perm}
+
+	// Special files such as /dev/null cannot be replaced by rename, so
+	// they are written in place.
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() {
+		o.Buf = make([]byte, size)
+		return o
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	utils.MustNo(err)
+	o.File = f
+
+	utils.AtFatal(func() {
+		os.Remove(f.Name())
+	})
+
+	utils.MustNo(f.Truncate(int64(size)))
+	o.Buf = mapFile(f, size)
+	return o
+}
+
+func (o *OutputFile) Close() {
+	if o.File == nil {
+		f, err := os.OpenFile(o.Path, os.O_WRONLY, 0)
+		utils.MustNo(err)
+		_, err = f.Write(o.Buf)
+		utils.MustNo(err)
+		utils.MustNo(f.Close())
+		return
+	}
+
+	unmapFile(o.File, o.Buf)
+	o.Buf = nil
+
+	utils.MustNo(o.File.Chmod(o.Perm &^ getUmask()))
+	utils.MustNo(o.File.Close())
+	utils.MustNo(os.Rename(o.File.Name(), o.Path))
+}
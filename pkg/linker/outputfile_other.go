@@ -0,0 +1,22 @@
+//go:build !unix
+
+package linker
+
+import (
+	"io/fs"
+	"os"
+	"rvld/pkg/utils"
+)
+
+func mapFile(f *os.File, size uint64) []byte {
+	return make([]byte, size)
+}
+
+func unmapFile(f *os.File, buf []byte) {
+	_, err := f.WriteAt(buf, 0)
+	utils.MustNo(err)
+}
+
+func getUmask() fs.FileMode {
+	return 022
+}
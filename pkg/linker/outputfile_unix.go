@@ -0,0 +1,32 @@
+//go:build unix
+
+package linker
+
+import (
+	"io/fs"
+	"os"
+	"rvld/pkg/utils"
+	"syscall"
+)
+
+func mapFile(f *os.File, size uint64) []byte {
+	if size == 0 {
+		return nil
+	}
+
+	buf, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	utils.MustNo(err)
+	return buf
+}
+
+func unmapFile(f *os.File, buf []byte) {
+	if buf != nil {
+		utils.MustNo(syscall.Munmap(buf))
+	}
+}
+
+func getUmask() fs.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return fs.FileMode(mask)
+}
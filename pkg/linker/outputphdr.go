@@ -35,6 +35,39 @@ func ToPhdrFlags(chunk Chunker) uint32 {
 	return ret
 }
 
+func isBss(chunk Chunker) bool {
+	shdr := chunk.GetShdr()
+	return shdr.Type == uint32(elf.SHT_NOBITS) && shdr.Flags&uint64(elf.SHF_TLS) == 0
+}
+
+// StartsNewSegment reports whether chunk cannot share a PT_LOAD with
+// prev, the loadable chunk before it.
+func StartsNewSegment(ctx *Context, prev, chunk Chunker) bool {
+	if isBss(prev) && !isBss(chunk) {
+		return true
+	}
+	if !HasSectionsCommand(ctx) {
+		return ToPhdrFlags(prev) != ToPhdrFlags(chunk)
+	}
+
+	// A linker script may put sections far apart, or load them at
+	// addresses other than their own.
+	p, c := prev.GetShdr(), chunk.GetShdr()
+	end := p.Addr + p.Size
+	if c.Addr < end || GetLoadAddr(ctx, chunk)-c.Addr != GetLoadAddr(ctx, prev)-p.Addr {
+		return true
+	}
+
+	// It may also put sections with other permissions on the page where
+	// the segment ends. As the loader maps whole pages, they share the
+	// segment, which gets the permissions of both.
+	pageSize := ctx.Target.PageSize()
+	if ToPhdrFlags(prev) != ToPhdrFlags(chunk) {
+		return c.Addr >= utils.AlignTo(end, pageSize)
+	}
+	return c.Addr-end >= pageSize
+}
+
 func CreatePhdr(ctx *Context) []ProgramHeader {
 	vec := make([]ProgramHeader, 0)
 
@@ -51,12 +84,13 @@ func CreatePhdr(ctx *Context) []ProgramHeader {
 			phdr.FileSize = chunk.GetShdr().Size
 		}
 		phdr.VAddr = chunk.GetShdr().Addr
-		phdr.PAddr = chunk.GetShdr().Addr
+		phdr.PAddr = GetLoadAddr(ctx, chunk)
 		phdr.MemSize = chunk.GetShdr().Size
 	}
 
 	push := func(chunk Chunker) {
 		phdr := &vec[len(vec)-1]
+		phdr.Flags |= ToPhdrFlags(chunk)
 		phdr.Align = uint64(math.Max(float64(phdr.Align), float64(chunk.GetShdr().Addralign)))
 		if chunk.GetShdr().Type != uint32(elf.SHT_NOBITS) {
 			phdr.FileSize = chunk.GetShdr().Addr + chunk.GetShdr().Size - uint64(phdr.VAddr)
@@ -68,16 +102,18 @@ func CreatePhdr(ctx *Context) []ProgramHeader {
 		return chunk.GetShdr().Flags&uint64(elf.SHF_TLS) != 0
 	}
 
-	isBss := func(chunk Chunker) bool {
-		return chunk.GetShdr().Type == uint32(elf.SHT_NOBITS) && !isTls(chunk)
-	}
-
 	isNote := func(chunk Chunker) bool {
 		shdr := chunk.GetShdr()
 		return shdr.Type == uint32(elf.SHT_NOTE) && shdr.Flags&uint64(elf.SHF_ALLOC) != 0
 	}
 
-	define(uint64(elf.PT_PHDR), uint64(elf.PF_R), 8, ctx.Phdr)
+	if ctx.Phdr.Shdr.Flags&uint64(elf.SHF_ALLOC) != 0 {
+		define(uint64(elf.PT_PHDR), uint64(elf.PF_R), 8, ctx.Phdr)
+	}
+
+	if ctx.Interp != nil {
+		define(uint64(elf.PT_INTERP), uint64(elf.PF_R), 1, ctx.Interp)
+	}
 
 	end := len(ctx.Chunks)
 
@@ -103,7 +139,7 @@ func CreatePhdr(ctx *Context) []ProgramHeader {
 		}
 
 		chunks = utils.RemoveIf(chunks, func(chunk Chunker) bool {
-			return isTbss(chunk)
+			return isTbss(chunk) || chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0
 		})
 
 		end := len(chunks)
@@ -111,21 +147,8 @@ func CreatePhdr(ctx *Context) []ProgramHeader {
 			first := chunks[i]
 			i++
 
-			if first.GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0 {
-				break
-			}
-
-			flags := ToPhdrFlags(first)
-			define(uint64(elf.PT_LOAD), uint64(flags), PageSize, first)
-
-			if !isBss(first) {
-				for i < end && !isBss(chunks[i]) && ToPhdrFlags(chunks[i]) == flags {
-					push(chunks[i])
-					i++
-				}
-			}
-
-			for i < end && isBss(chunks[i]) && ToPhdrFlags(chunks[i]) == flags {
+			define(uint64(elf.PT_LOAD), uint64(ToPhdrFlags(first)), int64(ctx.Target.PageSize()), first)
+			for i < end && !StartsNewSegment(ctx, chunks[i-1], chunks[i]) {
 				push(chunks[i])
 				i++
 			}
@@ -138,25 +161,48 @@ func CreatePhdr(ctx *Context) []ProgramHeader {
 			continue
 		}
 		define(uint64(elf.PT_TLS), uint64(ToPhdrFlags(ctx.Chunks[i])), 1, ctx.Chunks[i])
+		tls := &vec[len(vec)-1]
 		i++
 
 		for i < len(ctx.Chunks) && isTls(ctx.Chunks[i]) {
 			push(ctx.Chunks[i])
 			i++
 		}
+
+		ctx.TlsBegin = tls.VAddr
+		ctx.TpAddr = ctx.Target.TpAddr(tls)
+	}
+
+	if ctx.Dynamic != nil {
+		define(uint64(elf.PT_DYNAMIC), uint64(ToPhdrFlags(ctx.Dynamic)), 1, ctx.Dynamic)
+	}
+
+	if ctx.EhFrameHdr != nil {
+		define(uint64(elf.PT_GNU_EH_FRAME), uint64(elf.PF_R), 4, ctx.EhFrameHdr)
 	}
 
-	phdr := &vec[len(vec)-1]
-	ctx.TpAddr = uint64(phdr.VAddr)
+	// The stack is only executable with -z execstack.
+	stack := ProgramHeader{Type: uint32(elf.PT_GNU_STACK), Flags: uint32(elf.PF_R | elf.PF_W), Align: 1}
+	if ctx.Args.ZExecStack {
+		stack.Flags |= uint32(elf.PF_X)
+	}
+	vec = append(vec, stack)
+
+	if ctx.RiscvAttributes != nil {
+		define(uint64(PT_RISCV_ATTRIBUTES), uint64(elf.PF_R), 1, ctx.RiscvAttributes)
+	}
 
 	return vec
 }
 
 func (o *OutputPhdr) UpdateShdr(ctx *Context) {
 	o.Phdrs = CreatePhdr(ctx)
-	o.Shdr.Size = uint64(len(o.Phdrs)) * uint64(ProgramHeaderSize)
+	o.Shdr.Size = uint64(len(o.Phdrs)) * PhdrSize(ctx)
 }
 
 func (o *OutputPhdr) CopyBuf(ctx *Context) {
-	utils.Write(ctx.Buf[o.Shdr.Offset:], o.Phdrs)
+	base := ctx.Buf[o.Shdr.Offset:]
+	for i, phdr := range o.Phdrs {
+		WritePhdr(ctx, base[uint64(i)*PhdrSize(ctx):], phdr)
+	}
 }
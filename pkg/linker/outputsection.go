@@ -5,7 +5,14 @@ import "debug/elf"
 type OutputSection struct {
 	Chunk
 	Members []*InputSection
+	Thunks  []*Thunk
 	Idx     uint32
+
+	// Relocations of the members, with -r.
+	RelocSection *RelocSection
+
+	// The linker script description that the section comes from.
+	Desc *OutputSectionDesc
 }
 
 func NewOutputSection(name string, typ uint32, flags uint64, idx uint32) *OutputSection {
@@ -30,11 +37,27 @@ func (o *OutputSection) CopyBuf(ctx *Context) {
 	for _, isec := range o.Members {
 		isec.WriteTo(ctx, base[isec.Offset:])
 	}
+
+	for _, t := range o.Thunks {
+		t.CopyBuf(ctx, base[t.Offset:], o.Shdr.Addr+t.Offset)
+	}
 }
 
 func GetOutputSection(ctx *Context, name string, typ uint32, flags uint64) *OutputSection {
-	name = GetOutputName(name, flags)
-	flags = flags &^ uint64(elf.SHF_GROUP) &^ uint64(elf.SHF_COMPRESSED) &^ uint64(elf.SHF_LINK_ORDER)
+	// Relocatable output keeps the input section names, and each member
+	// of a section group gets an output section of its own, so that the
+	// group stays intact.
+	if ctx.Args.Relocatable {
+		flags = flags &^ uint64(elf.SHF_COMPRESSED) &^ uint64(elf.SHF_LINK_ORDER)
+		if flags&uint64(elf.SHF_GROUP) != 0 {
+			osec := NewOutputSection(name, typ, flags, uint32(len(ctx.OutputSections)))
+			ctx.OutputSections = append(ctx.OutputSections, osec)
+			return osec
+		}
+	} else {
+		name = GetOutputName(name, flags)
+		flags = flags &^ uint64(elf.SHF_GROUP) &^ uint64(elf.SHF_COMPRESSED) &^ uint64(elf.SHF_LINK_ORDER)
+	}
 
 	find := func() *OutputSection {
 		for _, osec := range ctx.OutputSections {
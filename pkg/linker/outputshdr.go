@@ -1,7 +1,5 @@
 package linker
 
-import "rvld/pkg/utils"
-
 type OutputShdr struct {
 	Chunk
 }
@@ -22,16 +20,16 @@ func (o *OutputShdr) UpdateShdr(ctx *Context) {
 		}
 	}
 
-	o.Shdr.Size = (n + 1) * uint64(SectionHeaderSize)
+	o.Shdr.Size = (n + 1) * ShdrSize(ctx)
 }
 
 func (o *OutputShdr) CopyBuf(ctx *Context) {
 	base := ctx.Buf[o.Shdr.Offset:]
-	utils.Write[SectionHeader](base, SectionHeader{})
+	WriteShdr(ctx, base, SectionHeader{})
 
 	for _, chunk := range ctx.Chunks {
 		if chunk.GetShndx() > 0 {
-			utils.Write[SectionHeader](base[chunk.GetShndx()*int64(SectionHeaderSize):], *chunk.GetShdr())
+			WriteShdr(ctx, base[uint64(chunk.GetShndx())*ShdrSize(ctx):], *chunk.GetShdr())
 		}
 	}
 }
@@ -3,10 +3,124 @@ package linker
 import (
 	"debug/elf"
 	"math"
+	"os"
 	"rvld/pkg/utils"
 	"sort"
+	"strings"
 )
 
+var internalSymbols = []string{
+	"__ehdr_start",
+	"__executable_start",
+	"__init_array_start",
+	"__init_array_end",
+	"__fini_array_start",
+	"__fini_array_end",
+	"__preinit_array_start",
+	"__preinit_array_end",
+	"_etext",
+	"etext",
+	"_edata",
+	"edata",
+	"__bss_start",
+	"_end",
+	"end",
+	"__global_pointer$",
+	"_DYNAMIC",
+	"__rela_iplt_start",
+	"__rela_iplt_end",
+}
+
+// CreateInternalFile creates an object file that defines the symbols
+// the linker is expected to provide. It is placed after all input
+// files, so a definition in a real object always takes precedence.
+func CreateInternalFile(ctx *Context) {
+	obj := &ObjectFile{}
+	obj.File = &File{Name: "<internal>"}
+	obj.IsAlive = true
+	obj.FirstGlobal = 1
+
+	ctx.InternalObj = obj
+	ctx.Objs = append(ctx.Objs, obj)
+
+	ctx.InternalEsyms = make([]Sym64, 1)
+	obj.Symbols = append(obj.Symbols, NewSymbol(""))
+
+	seen := make(map[string]bool)
+	add := func(name string, vis elf.SymVis) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+
+		esym := Sym64{
+			Info:  uint8(elf.STB_GLOBAL)<<4 | uint8(elf.STT_NOTYPE),
+			Other: uint8(vis),
+			Shndx: uint16(elf.SHN_ABS),
+		}
+		ctx.InternalEsyms = append(ctx.InternalEsyms, esym)
+		obj.Symbols = append(obj.Symbols, GetSymbolByName(ctx, name))
+	}
+
+	for _, name := range internalSymbols {
+		if name == "__global_pointer$" && ctx.Target.ELFMachine() != elf.EM_RISCV {
+			continue
+		}
+		if name == "_DYNAMIC" && !NeedsDynamicSections(ctx) {
+			continue
+		}
+		add(name, elf.STV_HIDDEN)
+	}
+
+	// __start_<sec> and __stop_<sec> delimit the output section <sec>,
+	// if there is one, for code that refers to them.
+	sections := make(map[string]bool)
+	for _, file := range ctx.Objs {
+		for _, isec := range file.Sections {
+			if isec != nil {
+				sections[isec.Name()] = true
+			}
+		}
+	}
+
+	startStop := make([]string, 0)
+	for name := range ctx.SymbolMap {
+		if sec, ok := GetStartStopSection(name); ok && sections[sec] {
+			startStop = append(startStop, name)
+		}
+	}
+	sort.Strings(startStop)
+	for _, name := range startStop {
+		add(name, elf.STV_HIDDEN)
+	}
+
+	// A PROVIDE only defines a symbol that something refers to.
+	if ctx.Script != nil {
+		refs := ctx.Script.referencedSymbols()
+		names := make([]string, 0, len(ctx.Script.Symbols))
+		for name := range ctx.Script.Symbols {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			a := ctx.Script.Symbols[name]
+			if _, ok := ctx.SymbolMap[name]; a.Provide && !ok && !refs[name] {
+				delete(ctx.Script.Symbols, name)
+				continue
+			}
+
+			vis := elf.STV_DEFAULT
+			if a.Hidden {
+				vis = elf.STV_HIDDEN
+			}
+			add(name, vis)
+		}
+	}
+
+	obj.SymTable = ctx.InternalEsyms
+}
+
 func ResolveSymbols(ctx *Context) {
 	for _, file := range ctx.Objs {
 		file.ResolveSymbols()
@@ -24,6 +138,65 @@ func ResolveSymbols(ctx *Context) {
 		return !file.IsAlive
 	})
 
+	for _, file := range ctx.Objs {
+		file.ParseSections(ctx)
+	}
+
+	// Symbols that were owned by discarded archive members are now
+	// unresolved, so give the remaining files a chance to define them.
+	for _, file := range ctx.Objs {
+		file.ResolveSymbols()
+	}
+
+	for _, dso := range ctx.Dsos {
+		dso.ResolveDsoSymbols()
+	}
+
+	ctx.Dsos = utils.RemoveIf(ctx.Dsos, func(dso *ObjectFile) bool {
+		if dso.AsNeeded && !isReferencedDso(ctx, dso) {
+			dso.ClearSymbols()
+			return true
+		}
+		return false
+	})
+
+	if ctx.InternalObj != nil {
+		dropUnreferencedInternalSymbols(ctx)
+	}
+
+	if ctx.Args.Shared || ctx.Args.Relocatable {
+		for _, file := range ctx.Objs {
+			file.ClaimUnresolvedSymbols()
+		}
+	}
+
+	// A plain assignment in a linker script overrides a definition in
+	// an input file.
+	if ctx.Script != nil && ctx.InternalObj != nil {
+		obj := ctx.InternalObj
+		for i := obj.FirstGlobal; i < len(obj.Symbols); i++ {
+			sym := obj.Symbols[i]
+			if a := ctx.Script.Symbols[sym.Name]; a != nil && !a.Provide && sym.File != obj {
+				sym.File = obj
+				sym.SetInputSection(nil)
+				sym.Value = 0
+				sym.SymIdx = int32(i)
+			}
+		}
+	}
+}
+
+// isReferencedDso reports whether an object refers to a symbol that the
+// shared library defines.
+func isReferencedDso(ctx *Context, dso *ObjectFile) bool {
+	for _, file := range ctx.Objs {
+		for i := file.FirstGlobal; i < len(file.SymTable); i++ {
+			if file.SymTable[i].IsUndef() && file.Symbols[i].File == dso {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func MarkLiveObjects(ctx *Context) {
@@ -35,6 +208,19 @@ func MarkLiveObjects(ctx *Context) {
 		}
 	}
 
+	// The entry symbol and -u symbols act as undefined references, so
+	// that archive members defining them get pulled in.
+	names := ctx.Args.Undefined
+	if !ctx.Args.Relocatable {
+		names = append(names, ctx.Args.Entry)
+	}
+	for _, name := range names {
+		if sym, ok := ctx.SymbolMap[name]; ok && sym.File != nil && !sym.File.IsAlive {
+			sym.File.IsAlive = true
+			roots = append(roots, sym.File)
+		}
+	}
+
 	utils.Assert(len(roots) > 0)
 
 	for len(roots) > 0 {
@@ -63,19 +249,121 @@ func CreateSyntheticSections(ctx *Context) {
 		return chunk
 	}
 
-	ctx.Ehdr = push(NewOutputEhdr()).(*OutputEhdr)
-	ctx.Phdr = push(NewOutputPhdr()).(*OutputPhdr)
+	ctx.Ehdr = push(NewOutputEhdr(ctx)).(*OutputEhdr)
 	ctx.Shdr = push(NewOutputShdr()).(*OutputShdr)
-	ctx.Got = push(NewGotSection()).(*GotSection)
+
+	// Relocatable output has no segments, and its relocations are left
+	// for the final link, so it needs no GOT either.
+	if ctx.Args.Relocatable {
+		for _, file := range ctx.Objs {
+			for _, group := range file.Groups {
+				push(group)
+			}
+		}
+	} else {
+		ctx.Phdr = push(NewOutputPhdr()).(*OutputPhdr)
+		ctx.Got = push(NewGotSection(ctx)).(*GotSection)
+	}
+
+	if !ctx.Args.StripAll || ctx.Args.Relocatable {
+		ctx.Symtab = push(NewSymtabSection(ctx)).(*SymtabSection)
+		ctx.Strtab = push(NewStrtabSection()).(*StrtabSection)
+	}
+	ctx.Shstrtab = push(NewShstrtabSection()).(*ShstrtabSection)
+
+	for _, file := range ctx.Objs {
+		if len(file.Cies) > 0 {
+			ctx.EhFrame = push(NewEhFrameSection()).(*EhFrameSection)
+			if ctx.Args.EhFrameHdr {
+				ctx.EhFrameHdr = push(NewEhFrameHdrSection()).(*EhFrameHdrSection)
+			}
+			break
+		}
+	}
+
+	if ctx.Args.BuildId != BuildIdNone && !ctx.Args.Relocatable {
+		ctx.BuildId = push(NewBuildIdSection(ctx)).(*BuildIdSection)
+	}
+
+	if attrs := MergeRiscvAttributes(ctx); attrs != nil {
+		ctx.RiscvAttributes = push(attrs).(*RiscvAttributesSection)
+	}
+
+	if NeedsDynamicSections(ctx) {
+		if !ctx.Args.Shared && !ctx.Args.Static && !ctx.Args.NoDynamicLinker {
+			ctx.Interp = push(NewInterpSection()).(*InterpSection)
+		}
+		ctx.Dynsym = push(NewDynsymSection(ctx)).(*DynsymSection)
+		ctx.Dynstr = push(NewDynstrSection()).(*DynstrSection)
+		ctx.Hash = push(NewHashSection()).(*HashSection)
+		ctx.Dynamic = push(NewDynamicSection(ctx)).(*DynamicSection)
+		ctx.RelaDyn = push(NewRelaDynSection(ctx)).(*RelaDynSection)
+		ctx.Plt = push(NewPltSection()).(*PltSection)
+		ctx.GotPlt = push(NewGotPltSection(ctx)).(*GotPltSection)
+		ctx.RelaPlt = push(NewRelaPltSection(ctx)).(*RelaPltSection)
+		ctx.Copyrel = push(NewCopyrelSection()).(*CopyrelSection)
+
+		for _, dso := range ctx.Dsos {
+			ctx.Dynstr.AddString(dso.Soname)
+		}
+		if ctx.Args.Soname != "" {
+			ctx.Dynstr.AddString(ctx.Args.Soname)
+		}
+	} else if hasIfuncSymbols(ctx) {
+		// A static executable still needs PLT entries for ifuncs.
+		ctx.Plt = push(NewPltSection()).(*PltSection)
+		ctx.GotPlt = push(NewGotPltSection(ctx)).(*GotPltSection)
+		ctx.RelaPlt = push(NewRelaPltSection(ctx)).(*RelaPltSection)
+	}
+}
+
+func hasIfuncSymbols(ctx *Context) bool {
+	for _, file := range ctx.Objs {
+		for i := range file.SymTable {
+			esym := &file.SymTable[i]
+			if elf.SymType(esym.Type()) == STT_GNU_IFUNC && !esym.IsUndef() {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func SetOutputSectionOffsets(ctx *Context) uint64 {
-	addr := IMAGE_BASE
+	// Sections of a relocatable file all start at address 0.
+	if ctx.Args.Relocatable {
+		fileoff := uint64(0)
+		for _, chunk := range ctx.Chunks {
+			shdr := chunk.GetShdr()
+			fileoff = utils.AlignTo(fileoff, shdr.Addralign)
+			shdr.Offset = fileoff
+			if shdr.Type != uint32(elf.SHT_NOBITS) {
+				fileoff += shdr.Size
+			}
+		}
+		return fileoff
+	}
+
+	if HasSectionsCommand(ctx) {
+		fileoff := ctx.Script.AssignAddresses(ctx)
+		checkSegmentOffsets(ctx)
+		return fileoff
+	}
+
+	addr := GetImageBase(ctx)
+	flags := uint32(0)
 	for _, chunk := range ctx.Chunks {
 		if chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) == 0 {
 			continue
 		}
 
+		// Segments with different permissions must not share a page,
+		// as the loader maps whole pages.
+		if f := ToPhdrFlags(chunk); f != flags {
+			addr = utils.AlignTo(addr, ctx.Target.PageSize())
+			flags = f
+		}
+
 		addr = utils.AlignTo(addr, chunk.GetShdr().Addralign)
 		chunk.GetShdr().Addr = addr
 
@@ -109,9 +397,224 @@ func SetOutputSectionOffsets(ctx *Context) uint64 {
 	}
 
 	ctx.Phdr.UpdateShdr(ctx)
+	checkSegmentOffsets(ctx)
 	return fileoff
 }
 
+// checkSegmentOffsets verifies that every segment can be mapped, which
+// needs its file offset and address to be congruent modulo its alignment.
+func checkSegmentOffsets(ctx *Context) {
+	for _, phdr := range ctx.Phdr.Phdrs {
+		if phdr.Align > 1 {
+			utils.Assert(phdr.Offset%phdr.Align == phdr.VAddr%phdr.Align)
+		}
+	}
+}
+
+// dropUnreferencedInternalSymbols undefines the symbols that the internal
+// file provides, such as _end, if nothing refers to them, as they are
+// only provided on demand. Those that a script assigns stay.
+func dropUnreferencedInternalSymbols(ctx *Context) {
+	refs := make(map[*Symbol]bool)
+	for _, file := range append(ctx.Objs, ctx.Dsos...) {
+		for i := file.FirstGlobal; i < len(file.Symbols); i++ {
+			if file.SymTable[i].IsUndef() {
+				refs[file.Symbols[i]] = true
+			}
+		}
+	}
+
+	names := append([]string{ctx.Args.Entry}, ctx.Args.Undefined...)
+	if ctx.Script != nil {
+		for name := range ctx.Script.referencedSymbols() {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if sym, ok := ctx.SymbolMap[name]; ok {
+			refs[sym] = true
+		}
+	}
+
+	obj := ctx.InternalObj
+	for _, sym := range obj.Symbols[obj.FirstGlobal:] {
+		if sym.File == obj && !refs[sym] && (ctx.Script == nil || ctx.Script.Symbols[sym.Name] == nil) {
+			sym.Clear()
+		}
+	}
+}
+
+// FixSyntheticSymbols sets the values of the symbols defined by the
+// internal file once all chunks have their final addresses.
+func FixSyntheticSymbols(ctx *Context) {
+	get := func(name string) *Symbol {
+		if ctx.Script != nil && ctx.Script.Symbols[name] != nil {
+			return nil
+		}
+		if sym, ok := ctx.SymbolMap[name]; ok && sym.File == ctx.InternalObj {
+			return sym
+		}
+		return nil
+	}
+
+	start := func(name string, chunk Chunker) {
+		if sym := get(name); sym != nil && chunk != nil {
+			sym.SetOutputChunk(chunk)
+			sym.Value = 0
+		}
+	}
+
+	stop := func(name string, chunk Chunker) {
+		if sym := get(name); sym != nil && chunk != nil {
+			sym.SetOutputChunk(chunk)
+			sym.Value = chunk.GetShdr().Size
+		}
+	}
+
+	find := func(name string) Chunker {
+		for _, chunk := range ctx.Chunks {
+			if chunk.GetName() == name {
+				return chunk
+			}
+		}
+		return nil
+	}
+
+	// If the headers are not loaded, __ehdr_start stays 0, which is only
+	// right for weak references.
+	if ctx.Ehdr.Shdr.Flags&uint64(elf.SHF_ALLOC) != 0 {
+		start("__ehdr_start", ctx.Ehdr)
+	} else if sym := get("__ehdr_start"); sym != nil {
+		for _, file := range ctx.Objs {
+			for i := file.FirstGlobal; i < len(file.Symbols); i++ {
+				esym := &file.SymTable[i]
+				if file.Symbols[i] == sym && esym.IsUndef() && elf.SymBind(esym.Bind()) != elf.STB_WEAK {
+					utils.Fatal(file.File.DisplayName() + ": __ehdr_start is referenced, but the headers are not loaded")
+				}
+			}
+		}
+	}
+	start("__executable_start", ctx.Ehdr)
+	start("_DYNAMIC", ctx.Dynamic)
+
+	// The C runtime of a static executable applies the IRELATIVE
+	// relocations itself. Otherwise they are applied along with all the
+	// others, and the range is left empty.
+	if ctx.RelaPlt != nil && ctx.Dynamic == nil {
+		start("__rela_iplt_start", ctx.RelaPlt)
+		stop("__rela_iplt_end", ctx.RelaPlt)
+	}
+
+	for _, name := range []string{".init_array", ".fini_array", ".preinit_array"} {
+		chunk := find(name)
+		start("__"+name[1:]+"_start", chunk)
+		stop("__"+name[1:]+"_end", chunk)
+	}
+
+	for _, sym := range ctx.InternalObj.Symbols {
+		if sec, ok := GetStartStopSection(sym.Name); ok {
+			if strings.HasPrefix(sym.Name, "__start_") {
+				start(sym.Name, find(sec))
+			} else {
+				stop(sym.Name, find(sec))
+			}
+		}
+	}
+
+	var text, data, bss, last Chunker
+	for _, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		if shdr.Flags&uint64(elf.SHF_ALLOC) == 0 || isTbss(chunk) {
+			continue
+		}
+
+		if shdr.Flags&uint64(elf.SHF_EXECINSTR) != 0 {
+			text = chunk
+		}
+
+		if shdr.Type == uint32(elf.SHT_NOBITS) {
+			if bss == nil {
+				bss = chunk
+			}
+		} else {
+			data = chunk
+		}
+		last = chunk
+	}
+
+	stop("_etext", text)
+	stop("etext", text)
+	stop("_edata", data)
+	stop("edata", data)
+	stop("_end", last)
+	stop("end", last)
+
+	if bss != nil {
+		start("__bss_start", bss)
+	} else {
+		stop("__bss_start", data)
+	}
+
+	// __global_pointer$ is 0x800 past the start of the small data area,
+	// so that gp-relative accesses can reach both directions of it.
+	if sym := get("__global_pointer$"); sym != nil {
+		chunk := find(".sdata")
+		if chunk == nil {
+			for _, c := range ctx.Chunks {
+				shdr := c.GetShdr()
+				if shdr.Flags&uint64(elf.SHF_ALLOC) != 0 && shdr.Flags&uint64(elf.SHF_WRITE) != 0 &&
+					shdr.Flags&uint64(elf.SHF_TLS) == 0 {
+					chunk = c
+					break
+				}
+			}
+		}
+
+		if chunk != nil {
+			sym.SetOutputChunk(chunk)
+			sym.Value = 0x800
+		}
+	}
+
+	// With SECTIONS, the layout has already evaluated them.
+	if ctx.Script != nil && !HasSectionsCommand(ctx) {
+		ctx.Script.AssignSymbols(ctx)
+	}
+}
+
+// StripDebugSections discards the DWARF sections of all input files.
+// It must run before section pieces are registered, as some of them,
+// e.g. .debug_str, are mergeable.
+func StripDebugSections(ctx *Context) {
+	for _, file := range ctx.Objs {
+		for i, isec := range file.Sections {
+			if isec == nil || isec.Shdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
+				continue
+			}
+
+			name := isec.Name()
+			if strings.HasPrefix(name, ".debug") || strings.HasPrefix(name, ".zdebug") {
+				isec.IsAlive = false
+				file.MergeableSections[i] = nil
+			}
+		}
+	}
+}
+
+// ReadRetainSymbolsFile reads the file given to --retain-symbols-file,
+// which lists one symbol name per line.
+func ReadRetainSymbolsFile(ctx *Context, path string) {
+	contents, err := os.ReadFile(path)
+	utils.MustNo(err)
+
+	ctx.RetainSymbols = make(map[string]bool)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			ctx.RetainSymbols[name] = true
+		}
+	}
+}
+
 func BinSections(ctx *Context) {
 	group := make([][]*InputSection, len(ctx.OutputSections))
 	for _, file := range ctx.Objs {
@@ -128,13 +631,17 @@ func BinSections(ctx *Context) {
 	for idx, osec := range ctx.OutputSections {
 		osec.Members = group[idx]
 	}
+
+	if HasSectionsCommand(ctx) {
+		ctx.Script.BinSections(ctx)
+	}
 }
 
 func CollectOutputSections(ctx *Context) []Chunker {
 	osecs := make([]Chunker, 0)
 
 	for _, osec := range ctx.OutputSections {
-		if len(osec.Members) > 0 {
+		if len(osec.Members) > 0 || osec.Desc != nil && osec.Desc.advancesDot() {
 			osecs = append(osecs, osec)
 		}
 	}
@@ -164,50 +671,105 @@ func ComputeSectionsSize(ctx *Context) {
 
 		osec.Shdr.Size = offset
 		osec.Shdr.Addralign = 1 << p2align
+		setMergeEntsize(osec)
+	}
+
+	if ctx.EhFrame != nil {
+		ctx.EhFrame.Construct(ctx)
+		ctx.EhFrame.RedirectEhFrameSymbols(ctx)
+	}
+
+	if ctx.EhFrameHdr != nil {
+		ctx.EhFrameHdr.Shdr.Size = EhFrameHdrSize + uint64(len(ctx.EhFrame.Fdes))*8
 	}
 }
 
-func SortOutputSections(ctx *Context) {
-	rank := func(chunk Chunker) int32 {
-		typ := chunk.GetShdr().Type
-		flags := chunk.GetShdr().Flags
+// setMergeEntsize gives a mergeable output section, which is one that
+// relocatable output copies as it is, the entry size of its members.
+// The section can not be merged if they disagree.
+func setMergeEntsize(osec *OutputSection) {
+	if osec.Shdr.Flags&uint64(elf.SHF_MERGE) == 0 || len(osec.Members) == 0 {
+		return
+	}
 
-		if chunk == ctx.Ehdr {
-			return 0
+	entsize := osec.Members[0].Shdr().Entsize
+	for _, isec := range osec.Members[1:] {
+		if isec.Shdr().Entsize != entsize {
+			osec.Shdr.Flags &^= uint64(elf.SHF_MERGE | elf.SHF_STRINGS)
+			return
 		}
-		if chunk == ctx.Phdr {
+	}
+	osec.Shdr.Entsize = entsize
+}
+
+// getRank returns the position of the chunk in the default layout.
+func getRank(ctx *Context, chunk Chunker) int32 {
+	typ := chunk.GetShdr().Type
+	flags := chunk.GetShdr().Flags
+
+	if chunk == ctx.Ehdr {
+		return 0
+	}
+	if chunk == ctx.Phdr || typ == uint32(elf.SHT_GROUP) {
+		return 1
+	}
+	if ctx.Interp != nil && chunk == ctx.Interp {
+		return 2
+	}
+	// Notes that are not loaded, such as .note.stapsdt, go with the
+	// other non-alloc sections.
+	if typ == uint32(elf.SHT_NOTE) && flags&uint64(elf.SHF_ALLOC) != 0 {
+		return 3
+	}
+	if flags&uint64(elf.SHF_ALLOC) == 0 {
+		return math.MaxInt32 - 1
+	}
+	if chunk == ctx.Shdr {
+		return math.MaxInt32
+	}
+
+	b2i := func(b bool) int {
+		if b {
 			return 1
 		}
-		if typ == uint32(elf.SHT_NOTE) {
-			return 2
-		}
-		if flags&uint64(elf.SHF_ALLOC) == 0 {
-			return math.MaxInt32 - 1
-		}
-		if chunk == ctx.Shdr {
-			return math.MaxInt32
-		}
+		return 0
+	}
 
-		b2i := func(b bool) int {
-			if b {
-				return 1
-			}
-			return 0
-		}
+	writeable := b2i(flags&uint64(elf.SHF_WRITE) != 0)
+	notExec := b2i(flags&uint64(elf.SHF_EXECINSTR) == 0)
+	notTls := b2i(flags&uint64(elf.SHF_TLS) == 0)
+	isBss := b2i(typ == uint32(elf.SHT_NOBITS))
 
-		writeable := b2i(flags&uint64(elf.SHF_WRITE) != 0)
-		notExec := b2i(flags&uint64(elf.SHF_EXECINSTR) == 0)
-		notTls := b2i(flags&uint64(elf.SHF_TLS) == 0)
-		isBss := b2i(typ == uint32(elf.SHT_NOBITS))
+	return int32(writeable<<7 | notExec<<6 | notTls<<5 | isBss<<4)
+}
 
-		return int32(writeable<<7 | notExec<<6 | notTls<<5 | isBss<<4)
+func SortOutputSections(ctx *Context) {
+	if HasSectionsCommand(ctx) {
+		ctx.Script.SortChunks(ctx)
+		return
 	}
 
 	sort.SliceStable(ctx.Chunks, func(i, j int) bool {
-		return rank(ctx.Chunks[i]) < rank(ctx.Chunks[j])
+		return getRank(ctx, ctx.Chunks[i]) < getRank(ctx, ctx.Chunks[j])
 	})
 }
 
+// AssignSectionIndices numbers every chunk that gets a section header
+// and registers its name in .shstrtab. It must run after the chunks
+// are sorted, because the indices follow the final chunk order.
+func AssignSectionIndices(ctx *Context) {
+	shndx := int64(1)
+	for _, chunk := range ctx.Chunks {
+		if chunk == ctx.Ehdr || chunk == ctx.Phdr || chunk == ctx.Shdr {
+			continue
+		}
+
+		chunk.SetShndx(shndx)
+		shndx++
+		chunk.GetShdr().Name = ctx.Shstrtab.AddString(chunk.GetName())
+	}
+}
+
 func ComputeMergedSectionSizes(ctx *Context) {
 	for _, osec := range ctx.MergedSections {
 		osec.AssginOffsets()
@@ -216,25 +778,83 @@ func ComputeMergedSectionSizes(ctx *Context) {
 
 func ScanRelocations(ctx *Context) {
 	for _, file := range ctx.Objs {
-		file.ScanRelocations()
+		file.ScanRelocations(ctx)
 	}
 
 	syms := make([]*Symbol, 0)
-	for _, file := range ctx.Objs {
+	for _, file := range append(ctx.Objs, ctx.Dsos...) {
+		// Unresolved weak symbols have no file and may be collected more
+		// than once, but their flags are cleared after the first time.
 		for _, sym := range file.Symbols {
-			if sym.File == file && sym.Flags != 0 {
+			if (sym.File == file || sym.File == nil) && sym.Flags != 0 {
 				syms = append(syms, sym)
 			}
 		}
 	}
 
 	for _, sym := range syms {
+		if sym.IsPreemptible(ctx) || sym.Flags&NeedsDynsym != 0 {
+			ctx.Dynsym.AddSymbol(ctx, sym)
+		}
+		if sym.Flags&NeedsGot != 0 {
+			ctx.Got.AddGotSymbol(ctx, sym)
+		}
 		if sym.Flags&NeedsGotTp != 0 {
-			ctx.Got.AddGotTpSymbol(sym)
+			ctx.Got.AddGotTpSymbol(ctx, sym)
+		}
+		if sym.Flags&NeedsTlsGd != 0 {
+			ctx.Got.AddTlsGdSymbol(ctx, sym)
+		}
+		if sym.Flags&NeedsPlt != 0 {
+			ctx.Plt.AddSymbol(ctx, sym)
+		}
+		if sym.Flags&NeedsCopyrel != 0 {
+			ctx.Copyrel.AddSymbol(ctx, sym)
 		}
 		sym.Flags = 0
 	}
 
+	// Definitions that shared libraries refer to have to be visible to
+	// the dynamic linker.
+	for _, dso := range ctx.Dsos {
+		for i := dso.FirstGlobal; i < len(dso.Symbols); i++ {
+			sym := dso.Symbols[i]
+			if !dso.SymTable[i].IsUndef() || sym.File == nil || sym.IsImported() {
+				continue
+			}
+
+			if elf.SymVis(sym.ELFSym().Other&3) == elf.STV_DEFAULT {
+				ctx.Dynsym.AddSymbol(ctx, sym)
+			}
+		}
+	}
+
+	// A shared library, or an executable linked with --export-dynamic,
+	// exports all of its global definitions, except for hidden ones.
+	for _, file := range ctx.Objs {
+		if file == ctx.InternalObj {
+			continue
+		}
+
+		for _, sym := range file.Symbols[file.FirstGlobal:] {
+			if sym.File == file && isExported(ctx, sym) {
+				ctx.Dynsym.AddSymbol(ctx, sym)
+			}
+		}
+	}
+
+	// Reserve the slots of .rela.dyn for the relocations each section
+	// emits when it is copied.
+	if ctx.RelaDyn != nil {
+		for _, file := range ctx.Objs {
+			for _, isec := range file.Sections {
+				if isec != nil && isec.IsAlive {
+					isec.DynRelocIdx = ctx.RelaDyn.NumSectionRelocs
+					ctx.RelaDyn.NumSectionRelocs += isec.NumDynRelocs
+				}
+			}
+		}
+	}
 }
 
 func isTbss(chunk Chunker) bool {
@@ -0,0 +1,129 @@
+package linker
+
+import "debug/elf"
+
+// PltSection holds the stubs through which calls into shared libraries
+// and ifuncs go. Each stub jumps to the address in its .got.plt slot.
+type PltSection struct {
+	Chunk
+	Syms []*Symbol
+}
+
+func NewPltSection() *PltSection {
+	p := &PltSection{Chunk: NewChunk()}
+	p.Name = ".plt"
+	p.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	p.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR)
+	p.Shdr.Addralign = 16
+	return p
+}
+
+// AddSymbol creates a PLT entry for sym. An imported symbol or an ifunc
+// refers to the entry from now on, so that direct references reach the
+// stub. A preemptible definition keeps its address and only calls are
+// redirected.
+func (p *PltSection) AddSymbol(ctx *Context, sym *Symbol) {
+	if sym.PltIdx >= 0 {
+		return
+	}
+
+	sym.PltIdx = int32(len(p.Syms))
+	p.Syms = append(p.Syms, sym)
+	if sym.IsImported() || sym.IsIfunc(ctx) {
+		sym.SetOutputChunk(p)
+		sym.Value = ctx.Target.PltHeaderSize() + uint64(sym.PltIdx)*ctx.Target.PltEntrySize()
+	}
+
+	// The slot of an ifunc is filled by an IRELATIVE relocation, which
+	// needs no dynamic symbol.
+	if !sym.IsIfunc(ctx) {
+		ctx.Dynsym.AddSymbol(ctx, sym)
+	}
+}
+
+func (p *PltSection) UpdateShdr(ctx *Context) {
+	p.Shdr.Size = 0
+	if len(p.Syms) > 0 {
+		p.Shdr.Size = ctx.Target.PltHeaderSize() + uint64(len(p.Syms))*ctx.Target.PltEntrySize()
+	}
+}
+
+func (p *PltSection) CopyBuf(ctx *Context) {
+	if len(p.Syms) == 0 {
+		return
+	}
+
+	base := ctx.Buf[p.Shdr.Offset:]
+	ctx.Target.WritePltHeader(ctx, base)
+	for i, sym := range p.Syms {
+		off := ctx.Target.PltHeaderSize() + uint64(i)*ctx.Target.PltEntrySize()
+		ctx.Target.WritePltEntry(ctx, base[off:], sym)
+	}
+}
+
+// GotPltSection starts with words reserved for the dynamic linker,
+// followed by one slot per PLT entry.
+type GotPltSection struct {
+	Chunk
+}
+
+func NewGotPltSection(ctx *Context) *GotPltSection {
+	g := &GotPltSection{Chunk: NewChunk()}
+	g.Name = ".got.plt"
+	g.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	g.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+	g.Shdr.Addralign = WordSize(ctx)
+	return g
+}
+
+func (g *GotPltSection) UpdateShdr(ctx *Context) {
+	g.Shdr.Size = ctx.Target.GotPltHeaderSize(ctx) + uint64(len(ctx.Plt.Syms))*WordSize(ctx)
+}
+
+func (g *GotPltSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[g.Shdr.Offset:]
+	if ctx.Dynamic != nil {
+		WriteWord(ctx, base, ctx.Dynamic.Shdr.Addr)
+	}
+
+	for _, sym := range ctx.Plt.Syms {
+		WriteWord(ctx, base[sym.GetGotPltAddr(ctx)-g.Shdr.Addr:], ctx.Target.GotPltEntry(ctx, sym))
+	}
+}
+
+// RelaPltSection holds the relocations of the .got.plt slots. In a
+// static executable, it only has IRELATIVE relocations, which the C
+// runtime finds through __rela_iplt_start and __rela_iplt_end.
+type RelaPltSection struct {
+	Chunk
+}
+
+func NewRelaPltSection(ctx *Context) *RelaPltSection {
+	r := &RelaPltSection{Chunk: NewChunk()}
+	r.Name = ".rela.plt"
+	r.Shdr.Type = uint32(elf.SHT_RELA)
+	r.Shdr.Flags = uint64(elf.SHF_ALLOC | elf.SHF_INFO_LINK)
+	r.Shdr.Entsize = RelaEntSize(ctx)
+	r.Shdr.Addralign = WordSize(ctx)
+	return r
+}
+
+func (r *RelaPltSection) UpdateShdr(ctx *Context) {
+	r.Shdr.Size = uint64(len(ctx.Plt.Syms)) * RelaEntSize(ctx)
+	if ctx.Dynsym != nil {
+		r.Shdr.Link = uint32(ctx.Dynsym.Shndx)
+	}
+	r.Shdr.Info = uint32(ctx.GotPlt.Shndx)
+}
+
+func (r *RelaPltSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[r.Shdr.Offset:]
+	types := ctx.Target.DynRelocs()
+	for i, sym := range ctx.Plt.Syms {
+		rel := Rela{Offset: sym.GetGotPltAddr(ctx), Type: types.JumpSlot, Sym: uint32(sym.DynsymIdx)}
+		if sym.IsIfunc(ctx) {
+			rel = Rela{Offset: sym.GetGotPltAddr(ctx), Type: types.IRelative, Addend: int64(sym.GetIfuncResolverAddr())}
+		}
+		WriteRela(ctx, base[uint64(i)*RelaEntSize(ctx):], rel)
+	}
+}
@@ -0,0 +1,230 @@
+package linker
+
+import (
+	"debug/elf"
+	"rvld/pkg/utils"
+)
+
+// RelocSection holds the relocations of an output section in
+// relocatable output. They are those of the members, rewritten against
+// the output sections and symbol table.
+type RelocSection struct {
+	Chunk
+	OutputSection *OutputSection
+}
+
+func NewRelocSection(ctx *Context, osec *OutputSection) *RelocSection {
+	r := &RelocSection{Chunk: NewChunk(), OutputSection: osec}
+	r.Name = ".rela" + osec.Name
+	r.Shdr.Type = uint32(elf.SHT_RELA)
+	r.Shdr.Flags = uint64(elf.SHF_INFO_LINK) | osec.Shdr.Flags&uint64(elf.SHF_GROUP)
+	r.Shdr.Entsize = RelaEntSize(ctx)
+	r.Shdr.Addralign = WordSize(ctx)
+	return r
+}
+
+func (r *RelocSection) UpdateShdr(ctx *Context) {
+	n := 0
+	for _, isec := range r.OutputSection.Members {
+		n += len(isec.GetRels())
+	}
+
+	r.Shdr.Size = uint64(n) * RelaEntSize(ctx)
+	r.Shdr.Link = uint32(ctx.Symtab.Shndx)
+	r.Shdr.Info = uint32(r.OutputSection.Shndx)
+}
+
+func (r *RelocSection) CopyBuf(ctx *Context) {
+	base := ctx.Buf[r.Shdr.Offset:]
+	for _, isec := range r.OutputSection.Members {
+		for _, rel := range isec.GetRels() {
+			WriteRela(ctx, base, isec.GetOutputRela(rel))
+			base = base[RelaEntSize(ctx):]
+		}
+	}
+}
+
+// GetOutputRela translates a relocation of the section for relocatable
+// output. A reference to a section symbol becomes a reference to the
+// symbol of the output section, with the offset into it folded into the
+// addend.
+func (i *InputSection) GetOutputRela(rel Rela) Rela {
+	out := rel
+	out.Offset += uint64(i.Offset)
+	if rel.Sym == 0 {
+		return out
+	}
+
+	o := i.File
+	esym := &o.SymTable[rel.Sym]
+	if elf.SymType(esym.Type()) != elf.STT_SECTION {
+		out.Sym = uint32(o.Symbols[rel.Sym].SymtabIdx)
+		return out
+	}
+
+	shndx := o.GetShndx(esym, int(rel.Sym))
+	if m := o.MergeableSections[shndx]; m != nil {
+		frag, off := m.GetFragment(uint32(esym.Value + uint64(rel.Addend)))
+		utils.Assert(frag != nil)
+		out.Sym = uint32(frag.OutputSection.Shndx)
+		out.Addend = int64(frag.Offset) + int64(off)
+		return out
+	}
+
+	if isec := o.Sections[shndx]; isec != nil && isec.IsAlive {
+		out.Sym = uint32(isec.OutputSection.Shndx)
+		out.Addend += int64(isec.Offset)
+		return out
+	}
+
+	out.Sym = 0
+	return out
+}
+
+// CreateRelocSections creates a relocation section for each output
+// section whose members have relocations. The address-significance
+// table is kept only if every input has one, as a file without it may
+// take the address of any of its symbols.
+func CreateRelocSections(ctx *Context) {
+	for _, osec := range ctx.OutputSections {
+		if len(osec.Members) == 0 {
+			continue
+		}
+
+		for _, isec := range osec.Members {
+			if len(isec.GetRels()) > 0 {
+				osec.RelocSection = NewRelocSection(ctx, osec)
+				ctx.Chunks = append(ctx.Chunks, osec.RelocSection)
+				break
+			}
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		if file.Addrsig == nil {
+			return
+		}
+	}
+	if len(ctx.Objs) > 0 {
+		ctx.Chunks = append(ctx.Chunks, NewAddrsigSection())
+	}
+}
+
+// AddrsigSection is the .llvm_addrsig of relocatable output. It lists
+// the symbols that the inputs mark as address-significant by their
+// index in the output symbol table, so that --icf=safe still works in
+// the final link.
+type AddrsigSection struct {
+	Chunk
+	Contents []byte
+}
+
+func NewAddrsigSection() *AddrsigSection {
+	a := &AddrsigSection{Chunk: NewChunk()}
+	a.Name = ".llvm_addrsig"
+	a.Shdr.Type = SHT_LLVM_ADDRSIG
+	a.Shdr.Flags = SHF_EXCLUDE
+	a.Shdr.Addralign = 1
+	return a
+}
+
+// UpdateShdr has to run after that of .symtab, which assigns the symbol
+// indices. It does, as the section is created after .symtab and both
+// are sorted with the other non-alloc sections.
+func (a *AddrsigSection) UpdateShdr(ctx *Context) {
+	a.Contents = nil
+	seen := make(map[*Symbol]bool)
+	for _, file := range ctx.Objs {
+		for data := file.Addrsig; len(data) > 0; {
+			idx, n := utils.ReadUleb(data)
+			data = data[n:]
+			if idx >= uint64(len(file.Symbols)) {
+				continue
+			}
+
+			sym := file.Symbols[idx]
+			if sym == nil || sym.SymtabIdx == 0 || seen[sym] {
+				continue
+			}
+			seen[sym] = true
+			a.Contents = utils.AppendUleb(a.Contents, uint64(sym.SymtabIdx))
+		}
+	}
+
+	a.Shdr.Size = uint64(len(a.Contents))
+	a.Shdr.Link = uint32(ctx.Symtab.Shndx)
+}
+
+func (a *AddrsigSection) CopyBuf(ctx *Context) {
+	copy(ctx.Buf[a.Shdr.Offset:], a.Contents)
+}
+
+// GroupSection is a section group (usually a COMDAT group) of an input
+// file, which relocatable output keeps so that the final link can still
+// deduplicate it.
+type GroupSection struct {
+	Chunk
+	File      *ObjectFile
+	Signature uint32
+	Flag      uint32
+	Members   []uint32
+}
+
+func NewGroupSection(file *ObjectFile, shdr *SectionHeader) *GroupSection {
+	words := utils.ReadSlice[uint32](file.GetBytesFromShdr(shdr), 4)
+	utils.Assert(len(words) > 0)
+
+	g := &GroupSection{
+		Chunk:     NewChunk(),
+		File:      file,
+		Signature: shdr.Info,
+		Flag:      words[0],
+		Members:   words[1:],
+	}
+	g.Name = ".group"
+	g.Shdr.Type = uint32(elf.SHT_GROUP)
+	g.Shdr.Entsize = 4
+	g.Shdr.Addralign = 4
+	return g
+}
+
+// getOutputMembers returns the output sections that the members of the
+// group ended up in, along with their relocation sections.
+func (g *GroupSection) getOutputMembers() []uint32 {
+	members := make([]uint32, 0)
+	for _, shndx := range g.Members {
+		isec := g.File.Sections[shndx]
+		if isec == nil || !isec.IsAlive {
+			continue
+		}
+
+		members = append(members, uint32(isec.OutputSection.Shndx))
+		if isec.OutputSection.RelocSection != nil {
+			members = append(members, uint32(isec.OutputSection.RelocSection.Shndx))
+		}
+	}
+	return members
+}
+
+func (g *GroupSection) UpdateShdr(ctx *Context) {
+	g.Shdr.Size = uint64(1+len(g.getOutputMembers())) * 4
+	g.Shdr.Link = uint32(ctx.Symtab.Shndx)
+}
+
+func (g *GroupSection) CopyBuf(ctx *Context) {
+	// The symbol table indices are only known once .symtab has been
+	// laid out, so the signature is resolved here.
+	esym := &g.File.SymTable[g.Signature]
+	if elf.SymType(esym.Type()) == elf.STT_SECTION {
+		isec := g.File.GetSecion(esym, int(g.Signature))
+		g.Shdr.Info = uint32(isec.OutputSection.Shndx)
+	} else {
+		g.Shdr.Info = uint32(g.File.Symbols[g.Signature].SymtabIdx)
+	}
+
+	base := ctx.Buf[g.Shdr.Offset:]
+	utils.Write(base, g.Flag)
+	for i, shndx := range g.getOutputMembers() {
+		utils.Write(base[(i+1)*4:], shndx)
+	}
+}
@@ -0,0 +1,482 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"rvld/pkg/utils"
+)
+
+// TargetRISCV is the backend for both RV32 and RV64, which only differ
+// in the ELF class.
+type TargetRISCV struct {
+	Type MachineType
+}
+
+func (t *TargetRISCV) MachineType() MachineType {
+	return t.Type
+}
+
+func (t *TargetRISCV) ELFMachine() elf.Machine {
+	return elf.EM_RISCV
+}
+
+func (t *TargetRISCV) PageSize() uint64 {
+	return 4096
+}
+
+// CreateThunks does nothing, as calls made with auipc and jalr reach ±2GiB.
+func (t *TargetRISCV) CreateThunks(ctx *Context) bool {
+	return false
+}
+
+// TpAddr returns the value of tp, which points to the beginning of the
+// TLS block on RISC-V.
+func (t *TargetRISCV) TpAddr(tls *ProgramHeader) uint64 {
+	return tls.VAddr
+}
+
+// MergeFlags merges e_flags of all input files. RVC and TSO are sticky
+// if any input uses them, while the float ABI and RVE must agree, since
+// code built for different calling conventions cannot be mixed.
+func (t *TargetRISCV) MergeFlags(ctx *Context) uint32 {
+	var first *ObjectFile
+	flags := uint32(0)
+
+	for _, obj := range ctx.Objs {
+		if obj == ctx.InternalObj {
+			continue
+		}
+
+		f := obj.GetEhdr().Flags
+		if first == nil {
+			first = obj
+			flags = f
+			continue
+		}
+
+		if f&EF_RISCV_FLOAT_ABI != flags&EF_RISCV_FLOAT_ABI {
+			utils.Fatal(fmt.Sprintf("cannot link object files with different floating-point ABI: %s uses %s, %s uses %s",
+				first.File.DisplayName(), floatABIName(flags),
+				obj.File.DisplayName(), floatABIName(f)))
+		}
+
+		if f&EF_RISCV_RVE != flags&EF_RISCV_RVE {
+			utils.Fatal(fmt.Sprintf("cannot link RVE and non-RVE object files: %s and %s",
+				first.File.DisplayName(), obj.File.DisplayName()))
+		}
+
+		flags |= f & (EF_RISCV_RVC | EF_RISCV_TSO)
+	}
+
+	return flags
+}
+
+func floatABIName(flags uint32) string {
+	switch flags & EF_RISCV_FLOAT_ABI {
+	case EF_RISCV_FLOAT_ABI_SOFT:
+		return "soft-float"
+	case EF_RISCV_FLOAT_ABI_SINGLE:
+		return "single-float"
+	case EF_RISCV_FLOAT_ABI_DOUBLE:
+		return "double-float"
+	}
+	return "quad-float"
+}
+
+func (t *TargetRISCV) ScanRelocations(ctx *Context, i *InputSection) {
+	rels := i.GetRels()
+	for _, rel := range rels {
+		sym := i.File.Symbols[rel.Sym]
+		typ := elf.R_RISCV(rel.Type)
+		switch typ {
+		case elf.R_RISCV_32, elf.R_RISCV_64:
+			if t.isWordReloc(typ) {
+				i.ScanAbsWord(ctx, sym, typ)
+			} else {
+				i.ScanAbs(ctx, sym, typ)
+			}
+		case elf.R_RISCV_HI20:
+			i.ScanAbs(ctx, sym, typ)
+		case elf.R_RISCV_PCREL_HI20:
+			i.ScanPcRel(ctx, sym, typ)
+		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT, elf.R_RISCV_BRANCH, elf.R_RISCV_JAL:
+			sym.MarkCall(ctx)
+		case elf.R_RISCV_GOT_HI20:
+			sym.Flags |= NeedsGot
+		case elf.R_RISCV_TLS_GOT_HI20:
+			sym.Flags |= NeedsGotTp
+		case elf.R_RISCV_TLS_GD_HI20:
+			sym.Flags |= NeedsTlsGd
+		case elf.R_RISCV_TPREL_HI20:
+			i.ScanTlsLe(ctx, sym, typ)
+		}
+	}
+}
+
+// isWordReloc reports whether typ is an address-sized absolute
+// relocation, which is the only kind the dynamic linker can apply.
+func (t *TargetRISCV) isWordReloc(typ elf.R_RISCV) bool {
+	if t.Type == MachineTypeRISCV32 {
+		return typ == elf.R_RISCV_32
+	}
+	return typ == elf.R_RISCV_64
+}
+
+func (t *TargetRISCV) ApplyRelocAlloc(ctx *Context, i *InputSection, base []byte) {
+	rels := i.GetRels()
+
+	for _, rel := range rels {
+		if rel.Type == uint32(elf.R_RISCV_NONE) || rel.Type == uint32(elf.R_RISCV_RELAX) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		S, A := i.GetSymAddrAndAddend(rel)
+		P := i.GetAddr() + rel.Offset
+
+		typ := elf.R_RISCV(rel.Type)
+		if sym.PltIdx >= 0 && (typ == elf.R_RISCV_BRANCH || typ == elf.R_RISCV_JAL ||
+			typ == elf.R_RISCV_CALL || typ == elf.R_RISCV_CALL_PLT) {
+			S = sym.GetPltAddr(ctx)
+		}
+
+		switch typ {
+		case elf.R_RISCV_32, elf.R_RISCV_64:
+			if t.isWordReloc(typ) {
+				i.ApplyAbsWord(ctx, loc, rel, S, A)
+			} else {
+				utils.Write(loc, uint32(S+A))
+			}
+		case elf.R_RISCV_BRANCH:
+			WriteBtype(loc, uint32(S+A-P))
+		case elf.R_RISCV_JAL:
+			WriteJtype(loc, uint32(S+A-P))
+		case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
+			val := uint32(S + A - P)
+			WriteUtype(loc, val)
+			WriteItype(loc[4:], val)
+		case elf.R_RISCV_GOT_HI20:
+			utils.Write(loc, uint32(sym.GetGotAddr(ctx)+A-P))
+		case elf.R_RISCV_TLS_GOT_HI20:
+			utils.Write(loc, uint32(sym.GetGotTpAddr(ctx)+A-P))
+		case elf.R_RISCV_TLS_GD_HI20:
+			utils.Write(loc, uint32(sym.GetTlsGdAddr(ctx)+A-P))
+		case elf.R_RISCV_PCREL_HI20:
+			utils.Write(loc, uint32(S+A-P))
+		case elf.R_RISCV_HI20:
+			WriteUtype(loc, uint32(S+A))
+		case elf.R_RISCV_LO12_I, elf.R_RISCV_LO12_S:
+			val := S + A
+			if rel.Type == uint32(elf.R_RISCV_LO12_I) {
+				WriteItype(loc, uint32(val))
+			} else {
+				WriteStype(loc, uint32(val))
+			}
+
+			if utils.SignExtend(val, 11) == val {
+				SetRs1(loc, 0)
+			}
+		case elf.R_RISCV_TPREL_LO12_I, elf.R_RISCV_TPREL_LO12_S:
+			val := S + A - ctx.TpAddr
+			if rel.Type == uint32(elf.R_RISCV_TPREL_LO12_I) {
+				WriteItype(loc, uint32(val))
+			} else {
+				WriteStype(loc, uint32(val))
+			}
+
+			if utils.SignExtend(val, 11) == val {
+				SetRs1(loc, 4)
+			}
+		}
+	}
+
+	for a := 0; a < len(rels); a++ {
+		switch elf.R_RISCV(rels[a].Type) {
+		case elf.R_RISCV_PCREL_LO12_I, elf.R_RISCV_PCREL_LO12_S:
+			sym := i.File.Symbols[rels[a].Sym]
+			utils.Assert(sym.InputSection == i)
+			loc := base[rels[a].Offset:]
+			val := utils.Read[uint32](base[sym.Value:])
+
+			if rels[a].Type == uint32(elf.R_RISCV_PCREL_LO12_I) {
+				WriteItype(loc, val)
+			} else {
+				WriteStype(loc, val)
+			}
+		}
+	}
+
+	for a := 0; a < len(rels); a++ {
+		switch elf.R_RISCV(rels[a].Type) {
+		case elf.R_RISCV_PCREL_HI20, elf.R_RISCV_GOT_HI20, elf.R_RISCV_TLS_GOT_HI20, elf.R_RISCV_TLS_GD_HI20:
+			loc := base[rels[a].Offset:]
+			val := utils.Read[uint32](loc)
+
+			utils.Write(loc, utils.Read[uint32](i.Contents[rels[a].Offset:]))
+			WriteUtype(loc, val)
+		}
+	}
+}
+
+const R_RISCV_SET_ULEB128 uint32 = 60
+const R_RISCV_SUB_ULEB128 uint32 = 61
+
+const R_RISCV_IRELATIVE uint32 = 58
+
+func (t *TargetRISCV) ApplyRelocNonAlloc(ctx *Context, i *InputSection, base []byte) {
+	for _, rel := range i.GetRels() {
+		if rel.Type == uint32(elf.R_RISCV_NONE) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		if sym.File == nil {
+			continue
+		}
+
+		S, A := i.GetSymAddrAndAddend(rel)
+
+		switch rel.Type {
+		case uint32(elf.R_RISCV_32), uint32(elf.R_RISCV_64):
+			if tombstone, ok := i.GetTombstone(rel); ok {
+				S, A = tombstone, 0
+			}
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		case R_RISCV_SET_ULEB128:
+			utils.OverwriteUleb(loc, S+A)
+		case R_RISCV_SUB_ULEB128:
+			val, _ := utils.ReadUleb(loc)
+			utils.OverwriteUleb(loc, val-(S+A))
+		default:
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		}
+	}
+}
+
+// ApplyDataReloc applies a relocation that patches data rather than
+// instructions, as found in .eh_frame and debug sections. Label
+// differences, e.g. code ranges and CFA advances, are expressed as
+// ADD/SUB and SET/SUB pairs on RISC-V because of linker relaxation.
+func (t *TargetRISCV) ApplyDataReloc(loc []byte, typ uint32, S, A, P uint64) {
+	val := S + A
+
+	switch elf.R_RISCV(typ) {
+	case elf.R_RISCV_NONE:
+	case elf.R_RISCV_32:
+		utils.Write(loc, uint32(val))
+	case elf.R_RISCV_64:
+		utils.Write(loc, val)
+	case elf.R_RISCV_32_PCREL:
+		utils.Write(loc, uint32(val-P))
+	case elf.R_RISCV_ADD8:
+		loc[0] += uint8(val)
+	case elf.R_RISCV_ADD16:
+		utils.Write(loc, utils.Read[uint16](loc)+uint16(val))
+	case elf.R_RISCV_ADD32:
+		utils.Write(loc, utils.Read[uint32](loc)+uint32(val))
+	case elf.R_RISCV_ADD64:
+		utils.Write(loc, utils.Read[uint64](loc)+val)
+	case elf.R_RISCV_SUB8:
+		loc[0] -= uint8(val)
+	case elf.R_RISCV_SUB16:
+		utils.Write(loc, utils.Read[uint16](loc)-uint16(val))
+	case elf.R_RISCV_SUB32:
+		utils.Write(loc, utils.Read[uint32](loc)-uint32(val))
+	case elf.R_RISCV_SUB64:
+		utils.Write(loc, utils.Read[uint64](loc)-val)
+	case elf.R_RISCV_SUB6:
+		loc[0] = loc[0]&0xc0 | (loc[0]-uint8(val))&0x3f
+	case elf.R_RISCV_SET6:
+		loc[0] = loc[0]&0xc0 | uint8(val)&0x3f
+	case elf.R_RISCV_SET8:
+		loc[0] = uint8(val)
+	case elf.R_RISCV_SET16:
+		utils.Write(loc, uint16(val))
+	case elf.R_RISCV_SET32:
+		utils.Write(loc, uint32(val))
+	default:
+		utils.Fatal(fmt.Sprintf("unsupported relocation in data section: %v", elf.R_RISCV(typ)))
+	}
+}
+
+// DynamicLinker picks the loader of the float ABI the inputs use.
+func (t *TargetRISCV) DynamicLinker(ctx *Context) string {
+	abi := "lp64"
+	if t.Type == MachineTypeRISCV32 {
+		abi = "ilp32"
+	}
+
+	switch ctx.EFlags & EF_RISCV_FLOAT_ABI {
+	case EF_RISCV_FLOAT_ABI_SINGLE:
+		abi += "f"
+	case EF_RISCV_FLOAT_ABI_DOUBLE:
+		abi += "d"
+	}
+
+	return "/lib/ld-linux-" + MachineTypeStringer{t.Type}.String() + "-" + abi + ".so.1"
+}
+
+func (t *TargetRISCV) DynRelocs() DynRelocTypes {
+	if t.Type == MachineTypeRISCV32 {
+		return DynRelocTypes{
+			Abs:       uint32(elf.R_RISCV_32),
+			Relative:  uint32(elf.R_RISCV_RELATIVE),
+			GlobDat:   uint32(elf.R_RISCV_32),
+			JumpSlot:  uint32(elf.R_RISCV_JUMP_SLOT),
+			Copy:      uint32(elf.R_RISCV_COPY),
+			TpOff:     uint32(elf.R_RISCV_TLS_TPREL32),
+			DtpMod:    uint32(elf.R_RISCV_TLS_DTPMOD32),
+			DtpOff:    uint32(elf.R_RISCV_TLS_DTPREL32),
+			IRelative: R_RISCV_IRELATIVE,
+		}
+	}
+
+	return DynRelocTypes{
+		Abs:       uint32(elf.R_RISCV_64),
+		Relative:  uint32(elf.R_RISCV_RELATIVE),
+		GlobDat:   uint32(elf.R_RISCV_64),
+		JumpSlot:  uint32(elf.R_RISCV_JUMP_SLOT),
+		Copy:      uint32(elf.R_RISCV_COPY),
+		TpOff:     uint32(elf.R_RISCV_TLS_TPREL64),
+		DtpMod:    uint32(elf.R_RISCV_TLS_DTPMOD64),
+		DtpOff:    uint32(elf.R_RISCV_TLS_DTPREL64),
+		IRelative: R_RISCV_IRELATIVE,
+	}
+}
+
+func (t *TargetRISCV) PltHeaderSize() uint64 {
+	return 32
+}
+
+func (t *TargetRISCV) PltEntrySize() uint64 {
+	return 16
+}
+
+// GotPltHeaderSize covers the two words the dynamic linker stores the
+// resolver and the link map in.
+func (t *TargetRISCV) GotPltHeaderSize(ctx *Context) uint64 {
+	return 2 * WordSize(ctx)
+}
+
+func (t *TargetRISCV) WritePltHeader(ctx *Context, buf []byte) {
+	insns := []uint32{
+		0x0000_0397, // auipc  t2, %pcrel_hi(.got.plt)
+		0x41c3_0333, // sub    t1, t1, t3
+		0x0003_be03, // ld     t3, %pcrel_lo(1b)(t2)
+		0xfd43_0313, // addi   t1, t1, -44
+		0x0003_8293, // addi   t0, t2, %pcrel_lo(1b)
+		0x0013_5313, // srli   t1, t1, 1
+		0x0082_b283, // ld     t0, 8(t0)
+		0x000e_0067, // jr     t3
+	}
+	if t.Type == MachineTypeRISCV32 {
+		insns[2] = 0x0003_ae03 // lw     t3, %pcrel_lo(1b)(t2)
+		insns[5] = 0x0023_5313 // srli   t1, t1, 2
+		insns[6] = 0x0042_a283 // lw     t0, 4(t0)
+	}
+
+	for i, insn := range insns {
+		utils.Write(buf[i*4:], insn)
+	}
+
+	disp := uint32(ctx.GotPlt.Shdr.Addr - ctx.Plt.Shdr.Addr)
+	WriteUtype(buf, disp)
+	WriteItype(buf[8:], disp)
+	WriteItype(buf[16:], disp)
+}
+
+func (t *TargetRISCV) WritePltEntry(ctx *Context, buf []byte, sym *Symbol) {
+	insns := []uint32{
+		0x0000_0e17, // auipc  t3, %pcrel_hi(foo@.got.plt)
+		0x000e_3e03, // ld     t3, %pcrel_lo(1b)(t3)
+		0x000e_0367, // jalr   t1, t3
+		0x0000_0013, // nop
+	}
+	if t.Type == MachineTypeRISCV32 {
+		insns[1] = 0x000e_2e03 // lw     t3, %pcrel_lo(1b)(t3)
+	}
+
+	for i, insn := range insns {
+		utils.Write(buf[i*4:], insn)
+	}
+
+	disp := uint32(sym.GetGotPltAddr(ctx) - sym.GetPltAddr(ctx))
+	WriteUtype(buf, disp)
+	WriteItype(buf[4:], disp)
+}
+
+// GotPltEntry points to the PLT header, which works out the index of
+// the entry from the return address in t1.
+func (t *TargetRISCV) GotPltEntry(ctx *Context, sym *Symbol) uint64 {
+	return ctx.Plt.Shdr.Addr
+}
+
+// github.com/jameslzhu/riscv-card/riscv-card.pdf
+func itype(val uint32) uint32 {
+	return val << 20
+}
+
+func stype(val uint32) uint32 {
+	return utils.Bits(val, 11, 5)<<25 | utils.Bits(val, 4, 0)<<7
+}
+
+func btype(val uint32) uint32 {
+	return utils.Bit(val, 12)<<31 | utils.Bits(val, 10, 5)<<25 |
+		utils.Bits(val, 4, 1)<<8 | utils.Bit(val, 11)<<7
+}
+
+func utype(val uint32) uint32 {
+	return (val + 0x800) & 0xffff_f000
+}
+
+func jtype(val uint32) uint32 {
+	return utils.Bit(val, 20)<<31 | utils.Bits(val, 10, 1)<<21 |
+		utils.Bit(val, 11)<<20 | utils.Bits(val, 19, 12)<<12
+}
+
+func cbtype(val uint16) uint16 {
+	return utils.Bit(val, 8)<<12 | utils.Bit(val, 4)<<11 | utils.Bit(val, 3)<<10 |
+		utils.Bit(val, 7)<<6 | utils.Bit(val, 6)<<5 | utils.Bit(val, 2)<<4 |
+		utils.Bit(val, 1)<<3 | utils.Bit(val, 5)<<2
+}
+
+func cjtype(val uint16) uint16 {
+	return utils.Bit(val, 11)<<12 | utils.Bit(val, 4)<<11 | utils.Bit(val, 9)<<10 |
+		utils.Bit(val, 8)<<9 | utils.Bit(val, 10)<<8 | utils.Bit(val, 6)<<7 |
+		utils.Bit(val, 7)<<6 | utils.Bit(val, 3)<<5 | utils.Bit(val, 2)<<4 |
+		utils.Bit(val, 1)<<3 | utils.Bit(val, 5)<<2
+}
+
+func WriteItype(loc []byte, val uint32) {
+	mask := uint32(0b000000_00000_11111_111_11111_1111111)
+	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|itype(val))
+}
+
+func WriteStype(loc []byte, val uint32) {
+	mask := uint32(0b000000_11111_11111_111_00000_1111111)
+	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|stype(val))
+}
+
+func WriteBtype(loc []byte, val uint32) {
+	mask := uint32(0b000000_11111_11111_111_00000_1111111)
+	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|btype(val))
+}
+
+func WriteUtype(loc []byte, val uint32) {
+	mask := uint32(0b000000_00000_00000_000_11111_1111111)
+	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|utype(val))
+}
+
+func WriteJtype(loc []byte, val uint32) {
+	mask := uint32(0b000000_00000_00000_000_11111_1111111)
+	utils.Write[uint32](loc, (utils.Read[uint32](loc)&mask)|jtype(val))
+}
+
+func SetRs1(loc []byte, rs1 uint32) {
+	utils.Write[uint32](loc, utils.Read[uint32](loc)&(0b111111_11111_00000_111_11111_1111111))
+	utils.Write[uint32](loc, utils.Read[uint32](loc)|(rs1<<15))
+}
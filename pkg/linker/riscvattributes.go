@@ -0,0 +1,450 @@
+package linker
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"rvld/pkg/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const SHT_RISCV_ATTRIBUTES uint32 = 0x70000003
+const PT_RISCV_ATTRIBUTES uint32 = 0x70000003
+
+const (
+	TagFile                  = 1
+	TagRISCVStackAlign       = 4
+	TagRISCVArch             = 5
+	TagRISCVUnalignedAccess  = 6
+	TagRISCVPrivSpec         = 8
+	TagRISCVPrivSpecMinor    = 10
+	TagRISCVPrivSpecRevision = 12
+)
+
+type RiscvAttributes struct {
+	StackAlign         uint64
+	Arch               string
+	UnalignedAccess    bool
+	HasUnalignedAccess bool
+	PrivSpec           [3]uint64
+}
+
+// ParseRiscvAttributes decodes the "riscv" vendor subsection of a
+// .riscv.attributes section. Other vendors are skipped.
+func ParseRiscvAttributes(file *File, data []byte) *RiscvAttributes {
+	attrs := &RiscvAttributes{}
+
+	if len(data) == 0 {
+		return attrs
+	}
+
+	if data[0] != 'A' {
+		utils.Fatal(fmt.Sprintf("%s: unsupported .riscv.attributes format version", file.DisplayName()))
+	}
+	data = data[1:]
+
+	corrupted := func() {
+		utils.Fatal(fmt.Sprintf("%s: corrupted .riscv.attributes section", file.DisplayName()))
+	}
+
+	// Each of these returns the number of bytes it consumed, and fails
+	// instead of reading past the end of data.
+	readUleb := func(data []byte) (uint64, int) {
+		for i, b := range data {
+			if b&0x80 == 0 {
+				return utils.ReadUleb(data[:i+1])
+			}
+		}
+		corrupted()
+		return 0, 0
+	}
+
+	readString := func(data []byte) (string, int) {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			corrupted()
+		}
+		return string(data[:end]), end + 1
+	}
+
+	// readSize reads the length of a (sub-)subsection that starts hdr
+	// bytes before data and includes its own header.
+	readSize := func(data []byte, hdr int) int {
+		if len(data) < 4 {
+			corrupted()
+		}
+		size := int(utils.Read[uint32](data))
+		if size < hdr+4 || size > hdr+len(data) {
+			corrupted()
+		}
+		return size
+	}
+
+	for len(data) > 0 {
+		size := readSize(data, 0)
+		subsec := data[4:size]
+		data = data[size:]
+
+		vendor, n := readString(subsec)
+		subsec = subsec[n:]
+
+		if vendor != "riscv" {
+			continue
+		}
+
+		for len(subsec) > 0 {
+			tag, n := readUleb(subsec)
+			size := readSize(subsec[n:], n)
+			body := subsec[n+4 : size]
+			subsec = subsec[size:]
+
+			if tag != TagFile {
+				continue
+			}
+
+			for len(body) > 0 {
+				tag, n := readUleb(body)
+				body = body[n:]
+
+				// By the ABI convention, odd tags carry a string and even
+				// tags carry an integer.
+				if tag%2 == 1 {
+					str, n := readString(body)
+					if tag == TagRISCVArch {
+						attrs.Arch = str
+					}
+					body = body[n:]
+					continue
+				}
+
+				val, n := readUleb(body)
+				body = body[n:]
+
+				switch tag {
+				case TagRISCVStackAlign:
+					attrs.StackAlign = val
+				case TagRISCVUnalignedAccess:
+					attrs.UnalignedAccess = val != 0
+					attrs.HasUnalignedAccess = true
+				case TagRISCVPrivSpec:
+					attrs.PrivSpec[0] = val
+				case TagRISCVPrivSpecMinor:
+					attrs.PrivSpec[1] = val
+				case TagRISCVPrivSpecRevision:
+					attrs.PrivSpec[2] = val
+				}
+			}
+		}
+	}
+
+	return attrs
+}
+
+type RiscvAttributesSection struct {
+	Chunk
+	Attrs    RiscvAttributes
+	Contents []byte
+}
+
+func NewRiscvAttributesSection() *RiscvAttributesSection {
+	r := &RiscvAttributesSection{
+		Chunk: NewChunk(),
+	}
+
+	r.Name = ".riscv.attributes"
+	r.Shdr.Type = SHT_RISCV_ATTRIBUTES
+
+	return r
+}
+
+// MergeRiscvAttributes combines the attributes of all live input
+// files. It returns nil if no input has a .riscv.attributes section.
+func MergeRiscvAttributes(ctx *Context) *RiscvAttributesSection {
+	var r *RiscvAttributesSection
+	var stackAlignFile, privSpecFile, archFile *ObjectFile
+	exts := make(map[string][2]int)
+	xlen := ""
+
+	for _, file := range ctx.Objs {
+		attrs := file.RiscvAttributes
+		if attrs == nil {
+			continue
+		}
+
+		if r == nil {
+			r = NewRiscvAttributesSection()
+		}
+
+		if attrs.StackAlign != 0 {
+			if stackAlignFile == nil {
+				r.Attrs.StackAlign = attrs.StackAlign
+				stackAlignFile = file
+			} else if r.Attrs.StackAlign != attrs.StackAlign {
+				utils.Fatal(fmt.Sprintf("cannot link object files with different stack alignment: %s uses %d, %s uses %d",
+					stackAlignFile.File.DisplayName(), r.Attrs.StackAlign,
+					file.File.DisplayName(), attrs.StackAlign))
+			}
+		}
+
+		if attrs.Arch != "" {
+			x, e := ParseArchString(file, attrs.Arch)
+			if archFile == nil {
+				xlen = x
+				archFile = file
+			} else if x != xlen {
+				utils.Fatal(fmt.Sprintf("cannot link object files with different XLEN: %s is %s, %s is %s",
+					archFile.File.DisplayName(), xlen, file.File.DisplayName(), x))
+			}
+
+			for name, ver := range e {
+				if old, ok := exts[name]; !ok || old[0] < ver[0] || (old[0] == ver[0] && old[1] < ver[1]) {
+					exts[name] = ver
+				}
+			}
+		}
+
+		if attrs.HasUnalignedAccess {
+			r.Attrs.HasUnalignedAccess = true
+			r.Attrs.UnalignedAccess = r.Attrs.UnalignedAccess || attrs.UnalignedAccess
+		}
+
+		if attrs.PrivSpec != [3]uint64{} {
+			if privSpecFile == nil {
+				r.Attrs.PrivSpec = attrs.PrivSpec
+				privSpecFile = file
+			} else if r.Attrs.PrivSpec != attrs.PrivSpec {
+				utils.Warn(fmt.Sprintf("linking object files with different privileged spec versions: %s uses %s, %s uses %s",
+					privSpecFile.File.DisplayName(), privSpecName(r.Attrs.PrivSpec),
+					file.File.DisplayName(), privSpecName(attrs.PrivSpec)))
+
+				if comparePrivSpec(attrs.PrivSpec, r.Attrs.PrivSpec) > 0 {
+					r.Attrs.PrivSpec = attrs.PrivSpec
+					privSpecFile = file
+				}
+			}
+		}
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	if archFile != nil {
+		r.Attrs.Arch = FormatArchString(xlen, exts)
+	}
+
+	r.Contents = r.Attrs.Encode()
+	r.Shdr.Size = uint64(len(r.Contents))
+	return r
+}
+
+func privSpecName(v [3]uint64) string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func comparePrivSpec(a, b [3]uint64) int {
+	for i := 0; i < 3; i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+var archVersionRe = regexp.MustCompile(`^([a-z][a-z0-9]*?)(\d+)p(\d+)$`)
+
+// noVersion marks an extension whose version is neither given nor known,
+// which is written back without one.
+var noVersion = [2]int{-1, -1}
+
+// defaultExtVersions are the versions GNU as assumes for the 20191213
+// ISA spec when an arch string omits them.
+var defaultExtVersions = map[string][2]int{
+	"i": {2, 1}, "e": {2, 0}, "m": {2, 0}, "a": {2, 1}, "f": {2, 2}, "d": {2, 2},
+	"q": {2, 2}, "c": {2, 0}, "h": {1, 0}, "v": {1, 0},
+	"zicsr": {2, 0}, "zifencei": {2, 0},
+	"zba": {1, 0}, "zbb": {1, 0}, "zbc": {1, 0}, "zbs": {1, 0},
+}
+
+func defaultExtVersion(name string) [2]int {
+	if ver, ok := defaultExtVersions[name]; ok {
+		return ver
+	}
+	return noVersion
+}
+
+// ParseArchString splits an ISA string such as
+// "rv64i2p1_m2p0_zicsr2p0" into its XLEN and extensions.
+func ParseArchString(file *ObjectFile, arch string) (string, map[string][2]int) {
+	arch = strings.ToLower(arch)
+	if !strings.HasPrefix(arch, "rv32") && !strings.HasPrefix(arch, "rv64") {
+		utils.Fatal(fmt.Sprintf("%s: invalid Tag_RISCV_arch: %s", file.File.DisplayName(), arch))
+	}
+
+	xlen := arch[:4]
+	exts := make(map[string][2]int)
+
+	readNum := func(s string) (int, string) {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		n, _ := strconv.Atoi(s[:i])
+		return n, s[i:]
+	}
+
+	for i, tok := range strings.Split(arch[4:], "_") {
+		if tok == "" {
+			continue
+		}
+
+		if tok[0] == 'z' || tok[0] == 's' || tok[0] == 'x' {
+			if m := archVersionRe.FindStringSubmatch(tok); m != nil {
+				major, _ := strconv.Atoi(m[2])
+				minor, _ := strconv.Atoi(m[3])
+				exts[m[1]] = [2]int{major, minor}
+			} else {
+				exts[tok] = defaultExtVersion(tok)
+			}
+			continue
+		}
+
+		// Single-letter extensions may be concatenated, e.g. "imac" or
+		// "i2p1m2p0".
+		for tok != "" {
+			name := tok[:1]
+			tok = tok[1:]
+
+			ver := defaultExtVersion(name)
+			if tok != "" && tok[0] >= '0' && tok[0] <= '9' {
+				ver[1] = 0
+				ver[0], tok = readNum(tok)
+				if tok != "" && tok[0] == 'p' {
+					ver[1], tok = readNum(tok[1:])
+				}
+			}
+
+			if i == 0 && name == "g" {
+				for _, e := range []string{"i", "m", "a", "f", "d", "zicsr", "zifencei"} {
+					exts[e] = defaultExtVersion(e)
+				}
+				continue
+			}
+			exts[name] = ver
+		}
+	}
+
+	return xlen, exts
+}
+
+const singleLetterOrder = "iemafdqlcbkjtpvnh"
+
+func extRank(name string) (int, int) {
+	switch name[0] {
+	case 'z':
+		return 1, strings.IndexByte(singleLetterOrder, name[1])
+	case 's':
+		return 2, 0
+	case 'x':
+		return 3, 0
+	}
+
+	if len(name) == 1 {
+		if idx := strings.IndexByte(singleLetterOrder, name[0]); idx >= 0 {
+			return 0, idx
+		}
+	}
+	return 0, len(singleLetterOrder)
+}
+
+// FormatArchString writes extensions back in canonical order, which is
+// the base ISA, single-letter extensions, then Z, S and X extensions.
+func FormatArchString(xlen string, exts map[string][2]int) string {
+	names := make([]string, 0, len(exts))
+	for name := range exts {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		ci, ri := extRank(names[i])
+		cj, rj := extRank(names[j])
+		if ci != cj {
+			return ci < cj
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		if ver := exts[name]; ver != noVersion {
+			parts = append(parts, fmt.Sprintf("%s%dp%d", name, ver[0], ver[1]))
+		} else {
+			parts = append(parts, name)
+		}
+	}
+
+	return xlen + strings.Join(parts, "_")
+}
+
+func (a *RiscvAttributes) Encode() []byte {
+	attrs := make([]byte, 0)
+	if a.StackAlign != 0 {
+		attrs = utils.AppendUleb(attrs, TagRISCVStackAlign)
+		attrs = utils.AppendUleb(attrs, a.StackAlign)
+	}
+
+	if a.Arch != "" {
+		attrs = utils.AppendUleb(attrs, TagRISCVArch)
+		attrs = append(attrs, a.Arch...)
+		attrs = append(attrs, 0)
+	}
+
+	if a.HasUnalignedAccess {
+		val := uint64(0)
+		if a.UnalignedAccess {
+			val = 1
+		}
+		attrs = utils.AppendUleb(attrs, TagRISCVUnalignedAccess)
+		attrs = utils.AppendUleb(attrs, val)
+	}
+
+	if a.PrivSpec != [3]uint64{} {
+		attrs = utils.AppendUleb(attrs, TagRISCVPrivSpec)
+		attrs = utils.AppendUleb(attrs, a.PrivSpec[0])
+		attrs = utils.AppendUleb(attrs, TagRISCVPrivSpecMinor)
+		attrs = utils.AppendUleb(attrs, a.PrivSpec[1])
+		attrs = utils.AppendUleb(attrs, TagRISCVPrivSpecRevision)
+		attrs = utils.AppendUleb(attrs, a.PrivSpec[2])
+	}
+
+	// Tag_File sub-subsection: tag, 4-byte size, attributes.
+	file := utils.AppendUleb(nil, TagFile)
+	file = binaryAppendUint32(file, uint32(len(file)+4+len(attrs)))
+	file = append(file, attrs...)
+
+	// "riscv" vendor subsection: 4-byte size, vendor name, contents.
+	vendor := "riscv\x00"
+	buf := []byte{'A'}
+	buf = binaryAppendUint32(buf, uint32(4+len(vendor)+len(file)))
+	buf = append(buf, vendor...)
+	buf = append(buf, file...)
+	return buf
+}
+
+func binaryAppendUint32(buf []byte, val uint32) []byte {
+	var bs [4]byte
+	utils.Write(bs[:], val)
+	return append(buf, bs[:]...)
+}
+
+func (r *RiscvAttributesSection) CopyBuf(ctx *Context) {
+	copy(ctx.Buf[r.Shdr.Offset:], r.Contents)
+}
@@ -0,0 +1,738 @@
+package linker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"rvld/pkg/utils"
+	"strconv"
+	"strings"
+)
+
+// LinkerScript is a script given with -T. Only the commonly used subset
+// of the GNU ld command language is understood.
+type LinkerScript struct {
+	Memory []*MemoryRegion
+
+	// Top-level commands in the order they appear: symbol assignments,
+	// ASSERTs and SECTIONS.
+	Commands []ScriptCommand
+
+	// The contents of all SECTIONS commands. A script without SECTIONS
+	// leaves the layout to the linker.
+	Sections    []ScriptCommand
+	HasSections bool
+
+	// Symbols defined by assignments, by name.
+	Symbols map[string]*SymbolAssignment
+
+	// Load addresses of the chunks placed by the script, which differ
+	// from their addresses when AT or AT> is used.
+	LoadAddrs map[Chunker]uint64
+
+	// Alloc orphans that no output section description could take, and
+	// which go after all of them.
+	Orphans []Chunker
+}
+
+// ScriptCommand is one of *SymbolAssignment, *ScriptAssert,
+// *SectionsCommand, *OutputSectionDesc and *InputSectionDesc.
+type ScriptCommand interface{}
+
+type SectionsCommand struct {
+	Commands []ScriptCommand
+}
+
+type MemoryRegion struct {
+	Name   string
+	Attrs  string
+	Origin uint64
+	Length uint64
+	Cursor uint64
+}
+
+type SymbolAssignment struct {
+	Name    string
+	Op      string
+	Expr    *ScriptExpr
+	Provide bool
+	Hidden  bool
+}
+
+type ScriptAssert struct {
+	Expr *ScriptExpr
+	Msg  string
+}
+
+type OutputSectionDesc struct {
+	Name      string
+	Addr      *ScriptExpr
+	Lma       *ScriptExpr
+	Align     *ScriptExpr
+	NoLoad    bool
+	Region    string
+	LmaRegion string
+	Commands  []ScriptCommand
+
+	// The output section that the input sections matched by this
+	// description go to, and all chunks placed here, including orphans
+	// that follow it.
+	Section *OutputSection
+	Chunks  []Chunker
+	Orphans []Chunker
+
+	addr uint64
+	lma  uint64
+	size uint64
+}
+
+type InputSectionDesc struct {
+	FilePattern  *regexp.Regexp
+	ExcludeFiles []*regexp.Regexp
+	Patterns     []*regexp.Regexp
+	Sort         string
+	Keep         bool
+
+	// Matched input sections, in input order.
+	Sections []*InputSection
+}
+
+// ScriptExpr is an expression node. Op is "num", "sym", ".", "call",
+// "?:" or a unary or binary operator.
+type ScriptExpr struct {
+	Op   string
+	Val  uint64
+	Name string
+	Args []*ScriptExpr
+}
+
+type scriptParser struct {
+	path string
+	src  string
+	pos  int
+}
+
+// ParseLinkerScript reads the script given to -T.
+func ParseLinkerScript(ctx *Context, path string) *LinkerScript {
+	contents, err := os.ReadFile(path)
+	utils.MustNo(err)
+
+	s := &LinkerScript{
+		Symbols:   make(map[string]*SymbolAssignment),
+		LoadAddrs: make(map[Chunker]uint64),
+	}
+	p := &scriptParser{path: path, src: string(contents)}
+
+	for !p.atEOF() {
+		tok := p.next(false)
+		switch tok {
+		case "ENTRY":
+			p.expect("(")
+			entry := p.next(false)
+			p.expect(")")
+			// -e takes precedence over ENTRY.
+			if ctx.Args.Entry == "_start" {
+				ctx.Args.Entry = entry
+			}
+		case "OUTPUT_ARCH", "OUTPUT_FORMAT":
+			p.skipArgs()
+		case "SEARCH_DIR":
+			p.readSearchDir(ctx)
+		case "MEMORY":
+			s.Memory = append(s.Memory, p.readMemory()...)
+		case "SECTIONS":
+			cmds := p.readSections()
+			s.HasSections = true
+			s.Sections = append(s.Sections, cmds...)
+			s.Commands = append(s.Commands, &SectionsCommand{Commands: cmds})
+		case ";":
+		default:
+			p.pos -= len(tok)
+			cmd := p.readCommand()
+			if cmd == nil {
+				p.fail("unknown directive: " + tok)
+			}
+			s.Commands = append(s.Commands, cmd)
+		}
+	}
+
+	s.forEachCommand(func(cmd ScriptCommand) {
+		if a, ok := cmd.(*SymbolAssignment); ok && a.Name != "." && s.Symbols[a.Name] == nil {
+			s.Symbols[a.Name] = a
+		}
+	})
+	return s
+}
+
+// ReadScriptFile reads an input file that is a linker script, such as
+// glibc's libc.so, which names the files to link in its place.
+func ReadScriptFile(ctx *Context, file *File) {
+	p := &scriptParser{path: file.Name, src: string(file.Contents)}
+	dir := filepath.Dir(file.Name)
+
+	for !p.atEOF() {
+		switch tok := p.next(false); tok {
+		case "INPUT", "GROUP":
+			p.readInputList(ctx, dir)
+		case "OUTPUT_ARCH", "OUTPUT_FORMAT":
+			p.skipArgs()
+		case "SEARCH_DIR":
+			p.readSearchDir(ctx)
+		case ";":
+		default:
+			p.fail("unknown directive: " + tok)
+		}
+	}
+}
+
+// readInputList reads the files of INPUT or GROUP. The members of
+// archives are resolved regardless of their order, so a group is no
+// different from a plain list.
+func (p *scriptParser) readInputList(ctx *Context, dir string) {
+	p.expect("(")
+	for !p.consume(")") {
+		if p.consume(",") {
+			continue
+		}
+
+		if p.consume("AS_NEEDED") {
+			asNeeded := ctx.Args.AsNeeded
+			ctx.Args.AsNeeded = true
+			p.readInputList(ctx, dir)
+			ctx.Args.AsNeeded = asNeeded
+			continue
+		}
+
+		ReadFile(ctx, FindScriptInput(ctx, dir, unquote(p.next(false))))
+	}
+}
+
+func (p *scriptParser) readSearchDir(ctx *Context) {
+	p.expect("(")
+	ctx.Args.LibraryPaths = append(ctx.Args.LibraryPaths, unquote(p.next(false)))
+	p.expect(")")
+}
+
+// skipArgs skips the arguments of a command that does not matter to
+// the linker, e.g. OUTPUT_FORMAT, as the format follows from the input.
+func (p *scriptParser) skipArgs() {
+	p.expect("(")
+	for !p.consume(")") {
+		p.next(false)
+	}
+}
+
+// forEachCommand visits all commands, including those in SECTIONS and
+// in output section descriptions.
+func (s *LinkerScript) forEachCommand(fn func(ScriptCommand)) {
+	var visit func(cmds []ScriptCommand)
+	visit = func(cmds []ScriptCommand) {
+		for _, cmd := range cmds {
+			fn(cmd)
+			switch cmd := cmd.(type) {
+			case *SectionsCommand:
+				visit(cmd.Commands)
+			case *OutputSectionDesc:
+				visit(cmd.Commands)
+			}
+		}
+	}
+	visit(s.Commands)
+}
+
+// HasSectionsCommand reports whether a linker script decides the
+// layout of the output.
+func HasSectionsCommand(ctx *Context) bool {
+	return ctx.Script != nil && ctx.Script.HasSections && !ctx.Args.Relocatable
+}
+
+func (p *scriptParser) fail(msg string) {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	utils.Fatal(fmt.Sprintf("%s:%d: %s", p.path, line, msg))
+}
+
+func (p *scriptParser) skipSpace() {
+	for p.pos < len(p.src) {
+		if strings.HasPrefix(p.src[p.pos:], "/*") {
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.fail("unclosed comment")
+			}
+			p.pos += end + 4
+			continue
+		}
+
+		switch p.src[p.pos] {
+		case ' ', '\t', '\n', '\r', '\f', '\v':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *scriptParser) atEOF() bool {
+	p.skipSpace()
+	return p.pos >= len(p.src)
+}
+
+const (
+	scriptWordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" +
+		"0123456789_.$/\\~=+[]*?-!^"
+	scriptExprWordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz" +
+		"0123456789_.$"
+)
+
+var scriptOperators = []string{
+	"<<=", ">>=", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+=", "-=", "*=", "/=", "&=", "|=",
+}
+
+// lex returns the next token. Outside of expressions, words are loose
+// so that file names and section name patterns are single tokens. In
+// expressions, operators split words.
+func (p *scriptParser) lex(expr bool) string {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return ""
+	}
+
+	s := p.src[p.pos:]
+	if s[0] == '"' {
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			p.fail("unclosed quote")
+		}
+		return s[:end+2]
+	}
+
+	chars := scriptWordChars
+	if expr {
+		chars = scriptExprWordChars
+	}
+	for _, op := range scriptOperators {
+		if strings.HasPrefix(s, op) && (expr || !strings.ContainsRune(chars, rune(op[0]))) {
+			return op
+		}
+	}
+
+	n := 0
+	for n < len(s) && strings.IndexByte(chars, s[n]) >= 0 {
+		n++
+	}
+	if n == 0 {
+		n = 1
+	}
+	return s[:n]
+}
+
+func (p *scriptParser) peek(expr bool) string {
+	pos := p.pos
+	tok := p.lex(expr)
+	p.pos = pos
+	return tok
+}
+
+func (p *scriptParser) next(expr bool) string {
+	tok := p.lex(expr)
+	if tok == "" {
+		p.fail("unexpected end of file")
+	}
+	p.pos += len(tok)
+	return tok
+}
+
+// consume and expect lex in expression mode, so that punctuation is
+// never glued to the token that follows it.
+func (p *scriptParser) consume(tok string) bool {
+	if p.peek(true) == tok {
+		p.next(true)
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(tok string) {
+	if got := p.next(true); got != tok {
+		p.fail(fmt.Sprintf("%s expected, but got %s", tok, got))
+	}
+}
+
+func unquote(tok string) string {
+	if len(tok) >= 2 && tok[0] == '"' {
+		return tok[1 : len(tok)-1]
+	}
+	return tok
+}
+
+func (p *scriptParser) readMemory() []*MemoryRegion {
+	regions := make([]*MemoryRegion, 0)
+	p.expect("{")
+	for !p.consume("}") {
+		r := &MemoryRegion{Name: p.next(false)}
+		if p.consume("(") {
+			for !p.consume(")") {
+				r.Attrs += p.next(false)
+			}
+		}
+		p.expect(":")
+
+		for _, names := range [][]string{{"ORIGIN", "org", "o"}, {"LENGTH", "len", "l"}} {
+			key := p.next(true)
+			if key != names[0] && key != names[1] && key != names[2] {
+				p.fail(fmt.Sprintf("%s expected, but got %s", names[0], key))
+			}
+			p.expect("=")
+			val := p.readExpr().Eval(nil)
+			if names[0] == "ORIGIN" {
+				r.Origin = val
+				p.consume(",")
+			} else {
+				r.Length = val
+			}
+		}
+		regions = append(regions, r)
+	}
+	return regions
+}
+
+func (p *scriptParser) readSections() []ScriptCommand {
+	cmds := make([]ScriptCommand, 0)
+	p.expect("{")
+	for !p.consume("}") {
+		if p.consume(";") {
+			continue
+		}
+		if cmd := p.readCommand(); cmd != nil {
+			cmds = append(cmds, cmd)
+			continue
+		}
+		cmds = append(cmds, p.readOutputSectionDesc())
+	}
+	return cmds
+}
+
+// readCommand reads a symbol assignment or an ASSERT, or returns nil if
+// neither comes next.
+func (p *scriptParser) readCommand() ScriptCommand {
+	switch tok := p.peek(true); tok {
+	case "PROVIDE", "PROVIDE_HIDDEN", "HIDDEN":
+		p.next(true)
+		p.expect("(")
+		a := p.readAssignment()
+		a.Provide = tok != "HIDDEN"
+		a.Hidden = tok != "PROVIDE"
+		p.expect(")")
+		p.consume(";")
+		return a
+	case "ASSERT":
+		p.next(true)
+		p.expect("(")
+		a := &ScriptAssert{Expr: p.readExpr()}
+		p.expect(",")
+		a.Msg = unquote(p.next(false))
+		p.expect(")")
+		p.consume(";")
+		return a
+	}
+
+	pos := p.pos
+	p.next(true)
+	op := p.peek(true)
+	p.pos = pos
+	if op != "=" && !isCompoundAssignment(op) {
+		return nil
+	}
+
+	a := p.readAssignment()
+	p.expect(";")
+	return a
+}
+
+func isCompoundAssignment(op string) bool {
+	switch op {
+	case "+=", "-=", "*=", "/=", "<<=", ">>=", "&=", "|=":
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) readAssignment() *SymbolAssignment {
+	a := &SymbolAssignment{Name: unquote(p.next(true)), Op: p.next(true)}
+	if a.Op != "=" && !isCompoundAssignment(a.Op) {
+		p.fail("= expected, but got " + a.Op)
+	}
+	a.Expr = p.readExpr()
+	return a
+}
+
+func (p *scriptParser) readOutputSectionDesc() *OutputSectionDesc {
+	d := &OutputSectionDesc{Name: p.next(false)}
+
+	if p.peek(true) != ":" && !p.readSectionType(d) {
+		d.Addr = p.readExpr()
+		p.readSectionType(d)
+	}
+	p.expect(":")
+
+	for {
+		if p.consume("AT") {
+			p.expect("(")
+			d.Lma = p.readExpr()
+			p.expect(")")
+		} else if p.consume("ALIGN") {
+			p.expect("(")
+			d.Align = p.readExpr()
+			p.expect(")")
+		} else {
+			break
+		}
+	}
+
+	p.expect("{")
+	for !p.consume("}") {
+		if p.consume(";") {
+			continue
+		}
+		if cmd := p.readCommand(); cmd != nil {
+			d.Commands = append(d.Commands, cmd)
+			continue
+		}
+
+		switch tok := p.peek(false); tok {
+		case "KEEP":
+			p.next(false)
+			p.expect("(")
+			desc := p.readInputSectionDesc()
+			desc.Keep = true
+			p.expect(")")
+			d.Commands = append(d.Commands, desc)
+		case "CONSTRUCTORS", "CREATE_OBJECT_SYMBOLS":
+			p.next(false)
+		case "FILL", "BYTE", "SHORT", "LONG", "QUAD", "SQUAD":
+			p.fail(tok + " is not supported")
+		default:
+			d.Commands = append(d.Commands, p.readInputSectionDesc())
+		}
+	}
+
+	for {
+		if p.consume(">") {
+			d.Region = p.next(false)
+		} else if p.consume("AT") {
+			p.expect(">")
+			d.LmaRegion = p.next(false)
+		} else if p.consume("=") {
+			p.readExpr()
+		} else {
+			break
+		}
+	}
+	p.consume(",")
+	return d
+}
+
+// readSectionType reads an output section type such as (NOLOAD), if
+// one comes next.
+func (p *scriptParser) readSectionType(d *OutputSectionDesc) bool {
+	pos := p.pos
+	if !p.consume("(") {
+		return false
+	}
+
+	switch typ := p.next(true); typ {
+	case "NOLOAD":
+		d.NoLoad = true
+	case "COPY", "INFO", "OVERLAY", "DSECT", "READONLY":
+		p.fail("unsupported output section type: " + typ)
+	default:
+		p.pos = pos
+		return false
+	}
+	p.expect(")")
+	return true
+}
+
+func (p *scriptParser) readInputSectionDesc() *InputSectionDesc {
+	d := &InputSectionDesc{}
+
+	tok := p.next(false)
+	if tok == "EXCLUDE_FILE" {
+		d.ExcludeFiles = p.readPatternList()
+		tok = p.next(false)
+	}
+	d.FilePattern = compileGlob(tok)
+
+	// A file name alone stands for all of its sections.
+	if !p.consume("(") {
+		d.Patterns = []*regexp.Regexp{compileGlob("*")}
+		return d
+	}
+
+	depth := 0
+	for {
+		tok := p.next(false)
+		switch tok {
+		case ")":
+			if depth == 0 {
+				return d
+			}
+			depth--
+		case "EXCLUDE_FILE":
+			d.ExcludeFiles = append(d.ExcludeFiles, p.readPatternList()...)
+		case "SORT", "SORT_BY_NAME", "SORT_BY_ALIGNMENT", "SORT_BY_INIT_PRIORITY", "SORT_NONE":
+			p.expect("(")
+			if d.Sort == "" {
+				d.Sort = tok
+			}
+			depth++
+		default:
+			d.Patterns = append(d.Patterns, compileGlob(tok))
+		}
+	}
+}
+
+func (p *scriptParser) readPatternList() []*regexp.Regexp {
+	pats := make([]*regexp.Regexp, 0)
+	p.expect("(")
+	for !p.consume(")") {
+		pats = append(pats, compileGlob(p.next(false)))
+	}
+	return pats
+}
+
+// compileGlob converts a wildcard pattern to a regular expression.
+func compileGlob(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+var scriptPrecedence = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5,
+	"==": 6, "!=": 6, "<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8, "+": 9, "-": 9, "*": 10, "/": 10, "%": 10,
+}
+
+func (p *scriptParser) readExpr() *ScriptExpr {
+	e := p.readBinary(1)
+	if p.peek(true) != "?" {
+		return e
+	}
+	p.next(true)
+	then := p.readExpr()
+	p.expect(":")
+	return &ScriptExpr{Op: "?:", Args: []*ScriptExpr{e, then, p.readExpr()}}
+}
+
+func (p *scriptParser) readBinary(minPrec int) *ScriptExpr {
+	lhs := p.readUnary()
+	for {
+		op := p.peek(true)
+		prec, ok := scriptPrecedence[op]
+		if !ok || prec < minPrec {
+			return lhs
+		}
+		p.next(true)
+		rhs := p.readBinary(prec + 1)
+		lhs = &ScriptExpr{Op: op, Args: []*ScriptExpr{lhs, rhs}}
+	}
+}
+
+func (p *scriptParser) readUnary() *ScriptExpr {
+	switch tok := p.peek(true); tok {
+	case "-", "~", "!", "+":
+		p.next(true)
+		return &ScriptExpr{Op: tok, Args: []*ScriptExpr{p.readUnary()}}
+	}
+	return p.readPrimary()
+}
+
+func (p *scriptParser) readPrimary() *ScriptExpr {
+	tok := p.next(true)
+	if tok == "(" {
+		e := p.readExpr()
+		p.expect(")")
+		return e
+	}
+	if tok == "." {
+		return &ScriptExpr{Op: "."}
+	}
+	if tok == "SIZEOF_HEADERS" {
+		return &ScriptExpr{Op: "call", Name: tok}
+	}
+	if val, ok := parseScriptNumber(tok); ok {
+		return &ScriptExpr{Op: "num", Val: val}
+	}
+
+	if p.peek(true) != "(" {
+		return &ScriptExpr{Op: "sym", Name: unquote(tok)}
+	}
+
+	p.next(true)
+	e := &ScriptExpr{Op: "call", Name: tok}
+	switch tok {
+	case "ADDR", "LOADADDR", "SIZEOF", "ALIGNOF", "ORIGIN", "LENGTH", "DEFINED", "CONSTANT":
+		// These take a name rather than an expression.
+		e.Args = []*ScriptExpr{{Op: "sym", Name: unquote(p.next(false))}}
+	case "SEGMENT_START":
+		p.next(false)
+		p.expect(",")
+		e.Args = []*ScriptExpr{p.readExpr()}
+	case "ALIGN", "ABSOLUTE", "MAX", "MIN", "LOG2CEIL":
+		e.Args = append(e.Args, p.readExpr())
+		for p.consume(",") {
+			e.Args = append(e.Args, p.readExpr())
+		}
+	default:
+		p.fail("unknown function: " + tok)
+	}
+	p.expect(")")
+	return e
+}
+
+// parseScriptNumber parses a number, which may be in hex and have a K
+// or M suffix.
+func parseScriptNumber(tok string) (uint64, bool) {
+	mul := uint64(1)
+	if strings.HasSuffix(tok, "K") || strings.HasSuffix(tok, "k") {
+		mul, tok = 1024, tok[:len(tok)-1]
+	} else if strings.HasSuffix(tok, "M") || strings.HasSuffix(tok, "m") {
+		mul, tok = 1024*1024, tok[:len(tok)-1]
+	}
+
+	base := 10
+	if s, ok := utils.RemovePrefix(strings.ToLower(tok), "0x"); ok {
+		tok, base = s, 16
+	}
+
+	val, err := strconv.ParseUint(tok, base, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val * mul, true
+}
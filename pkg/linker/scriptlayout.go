@@ -0,0 +1,958 @@
+package linker
+
+import (
+	"debug/elf"
+	"fmt"
+	"math/bits"
+	"path/filepath"
+	"regexp"
+	"rvld/pkg/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MapInputSection returns the output section that the script puts isec
+// in, or nil if no description matches. Sections matched by /DISCARD/
+// are killed.
+func (s *LinkerScript) MapInputSection(ctx *Context, isec *InputSection, name string) *OutputSection {
+	for _, cmd := range s.Sections {
+		d, ok := cmd.(*OutputSectionDesc)
+		if !ok {
+			continue
+		}
+
+		for _, cmd := range d.Commands {
+			desc, ok := cmd.(*InputSectionDesc)
+			if !ok || !desc.Match(isec.File.File, name) {
+				continue
+			}
+
+			if d.Name == "/DISCARD/" {
+				isec.IsAlive = false
+				return nil
+			}
+
+			desc.Sections = append(desc.Sections, isec)
+			return d.getOutputSection(ctx, isec.Shdr())
+		}
+	}
+	return nil
+}
+
+// Match reports whether the description covers the named section of
+// file. Archive members match by their own name, or as archive(member).
+func (d *InputSectionDesc) Match(file *File, name string) bool {
+	names := []string{file.Name, filepath.Base(file.Name)}
+	if file.Parent != nil {
+		names = append(names, file.DisplayName(), filepath.Base(file.DisplayName()))
+	}
+
+	matchFile := func(pat *regexp.Regexp) bool {
+		for _, name := range names {
+			if pat.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !matchFile(d.FilePattern) {
+		return false
+	}
+
+	for _, pat := range d.ExcludeFiles {
+		if matchFile(pat) {
+			return false
+		}
+	}
+
+	for _, pat := range d.Patterns {
+		if pat.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *OutputSectionDesc) getOutputSection(ctx *Context, shdr *SectionHeader) *OutputSection {
+	flags := shdr.Flags &^ uint64(elf.SHF_GROUP|elf.SHF_COMPRESSED|elf.SHF_LINK_ORDER|elf.SHF_MERGE|elf.SHF_STRINGS)
+	if d.Section == nil {
+		typ := shdr.Type
+		if d.NoLoad {
+			typ = uint32(elf.SHT_NOBITS)
+		}
+		d.createOutputSection(ctx, typ, flags)
+		return d.Section
+	}
+
+	d.Section.Shdr.Flags |= flags
+	if d.Section.Shdr.Type == uint32(elf.SHT_NOBITS) && shdr.Type != uint32(elf.SHT_NOBITS) && !d.NoLoad {
+		d.Section.Shdr.Type = uint32(elf.SHT_PROGBITS)
+	}
+	return d.Section
+}
+
+func (d *OutputSectionDesc) createOutputSection(ctx *Context, typ uint32, flags uint64) {
+	d.Section = NewOutputSection(d.Name, typ, flags, uint32(len(ctx.OutputSections)))
+	d.Section.Desc = d
+	ctx.OutputSections = append(ctx.OutputSections, d.Section)
+}
+
+// advancesDot reports whether the description moves the location
+// counter itself, so that it takes space even without any input.
+func (d *OutputSectionDesc) advancesDot() bool {
+	for _, cmd := range d.Commands {
+		if a, ok := cmd.(*SymbolAssignment); ok && a.Name == "." {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *LinkerScript) outputSectionDescs() []*OutputSectionDesc {
+	descs := make([]*OutputSectionDesc, 0)
+	for _, cmd := range s.Sections {
+		if d, ok := cmd.(*OutputSectionDesc); ok && d.Name != "/DISCARD/" {
+			descs = append(descs, d)
+		}
+	}
+	return descs
+}
+
+func isLiveSection(isec *InputSection) bool {
+	return isec.IsAlive && isec.File.IsAlive
+}
+
+// BinSections orders the members of the output sections of the script
+// as the input section descriptions list them.
+func (s *LinkerScript) BinSections(ctx *Context) {
+	for _, d := range s.outputSectionDescs() {
+		if d.Section == nil {
+			if !d.advancesDot() {
+				continue
+			}
+			typ := uint32(elf.SHT_PROGBITS)
+			if d.NoLoad {
+				typ = uint32(elf.SHT_NOBITS)
+			}
+			d.createOutputSection(ctx, typ, uint64(elf.SHF_ALLOC|elf.SHF_WRITE))
+		}
+
+		d.Section.Members = nil
+		for _, cmd := range d.Commands {
+			if desc, ok := cmd.(*InputSectionDesc); ok {
+				desc.sortSections()
+				for _, isec := range desc.Sections {
+					if isLiveSection(isec) {
+						d.Section.Members = append(d.Section.Members, isec)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (d *InputSectionDesc) sortSections() {
+	switch d.Sort {
+	case "SORT", "SORT_BY_NAME":
+		sort.SliceStable(d.Sections, func(i, j int) bool {
+			return d.Sections[i].Name() < d.Sections[j].Name()
+		})
+	case "SORT_BY_ALIGNMENT":
+		sort.SliceStable(d.Sections, func(i, j int) bool {
+			return d.Sections[i].P2Align > d.Sections[j].P2Align
+		})
+	case "SORT_BY_INIT_PRIORITY":
+		sort.SliceStable(d.Sections, func(i, j int) bool {
+			return getInitPriority(d.Sections[i].Name()) < getInitPriority(d.Sections[j].Name())
+		})
+	}
+}
+
+// getInitPriority returns the priority in the name of a constructor
+// section, e.g. 101 for .init_array.00101. The priorities of .ctors and
+// .dtors count down.
+func getInitPriority(name string) uint64 {
+	idx := strings.LastIndexByte(name, '.')
+	prio, err := strconv.ParseUint(name[idx+1:], 10, 64)
+	if idx <= 0 || err != nil {
+		return 65536
+	}
+	if strings.HasPrefix(name, ".ctors") || strings.HasPrefix(name, ".dtors") {
+		return 65535 - prio
+	}
+	return prio
+}
+
+// SortChunks puts the chunks in the order of the output section
+// descriptions. A synthetic chunk is placed by a description of the
+// same name. The remaining chunks are orphans, which follow the last
+// placed chunk with the same flags.
+func (s *LinkerScript) SortChunks(ctx *Context) {
+	placed := map[Chunker]bool{ctx.Ehdr: true, ctx.Phdr: true, ctx.Shdr: true}
+	descs := s.outputSectionDescs()
+
+	for _, d := range descs {
+		d.Chunks, d.Orphans = nil, nil
+		for _, chunk := range ctx.Chunks {
+			if chunk == d.Section {
+				d.Chunks = append(d.Chunks, chunk)
+				placed[chunk] = true
+			}
+		}
+		for _, chunk := range ctx.Chunks {
+			if !placed[chunk] && chunk.GetName() == d.Name {
+				d.Chunks = append(d.Chunks, chunk)
+				placed[chunk] = true
+			}
+		}
+	}
+
+	orphans := make([]Chunker, 0)
+	for _, chunk := range ctx.Chunks {
+		if !placed[chunk] {
+			orphans = append(orphans, chunk)
+		}
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return getRank(ctx, orphans[i]) < getRank(ctx, orphans[j])
+	})
+
+	isAlloc := func(chunk Chunker) bool {
+		return chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) != 0
+	}
+
+	s.Orphans = nil
+	nonAlloc := make([]Chunker, 0)
+	for _, chunk := range orphans {
+		if !isAlloc(chunk) {
+			nonAlloc = append(nonAlloc, chunk)
+			continue
+		}
+
+		var anchor, last *OutputSectionDesc
+		for _, d := range descs {
+			for _, c := range d.Chunks {
+				if !isAlloc(c) {
+					continue
+				}
+				last = d
+				if ToPhdrFlags(c) == ToPhdrFlags(chunk) && isBss(c) == isBss(chunk) {
+					anchor = d
+				}
+			}
+		}
+
+		if anchor == nil {
+			anchor = last
+		}
+		if anchor == nil {
+			s.Orphans = append(s.Orphans, chunk)
+		} else {
+			anchor.Orphans = append(anchor.Orphans, chunk)
+		}
+	}
+
+	// Non-alloc sections go after all alloc ones, so that they do not
+	// split segments in the file.
+	chunks := []Chunker{ctx.Ehdr, ctx.Phdr}
+	for _, d := range descs {
+		for _, chunk := range append(d.Chunks, d.Orphans...) {
+			if isAlloc(chunk) {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	chunks = append(chunks, s.Orphans...)
+	for _, d := range descs {
+		for _, chunk := range d.Chunks {
+			if !isAlloc(chunk) {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	chunks = append(chunks, nonAlloc...)
+	ctx.Chunks = append(chunks, ctx.Shdr)
+}
+
+// GetLoadAddr returns the address at which the chunk is loaded, which
+// a linker script may set apart from its address.
+func GetLoadAddr(ctx *Context, chunk Chunker) uint64 {
+	if ctx.Script != nil {
+		if lma, ok := ctx.Script.LoadAddrs[chunk]; ok {
+			return lma
+		}
+	}
+	return chunk.GetShdr().Addr
+}
+
+// scriptLayout is the state of address assignment by a linker script.
+type scriptLayout struct {
+	ctx    *Context
+	script *LinkerScript
+	final  bool
+
+	// The location counter, and the output section it is in, if any.
+	dot      uint64
+	cur      Chunker
+	curStart uint64
+
+	// The last chunk placed. Symbols defined with . outside of output
+	// sections are relative to it.
+	last Chunker
+
+	prevRegion *MemoryRegion
+	lmaOffset  uint64
+	assigned   map[string]bool
+}
+
+// AssignAddresses lays out the chunks as the script says, and returns
+// the size of the output file.
+func (s *LinkerScript) AssignAddresses(ctx *Context) uint64 {
+	// Forward references, e.g. to the size of a later section, see the
+	// values of the first pass. The number of segments depends on the
+	// addresses, and the layout is redone until the size of the program
+	// headers, and so SIZEOF_HEADERS, settles. A few rounds are enough
+	// unless they keep shrinking, which leaves a harmless gap.
+	for round := 0; ; round++ {
+		size := ctx.Phdr.Shdr.Size
+		for i := 0; i < 2; i++ {
+			st := &scriptLayout{ctx: ctx, script: s, final: i == 1, assigned: make(map[string]bool)}
+			st.run()
+		}
+
+		allocateHeaders(ctx)
+		ctx.Phdr.UpdateShdr(ctx)
+		if ctx.Phdr.Shdr.Size == size || ctx.Phdr.Shdr.Size < size && round >= 3 {
+			break
+		}
+	}
+
+	fileoff := assignScriptFileOffsets(ctx)
+	ctx.Phdr.UpdateShdr(ctx)
+	return fileoff
+}
+
+// AssignSymbols evaluates the assignments and assertions of a script
+// without SECTIONS, once the default layout has given addresses.
+func (s *LinkerScript) AssignSymbols(ctx *Context) {
+	for i := 0; i < 2; i++ {
+		st := &scriptLayout{ctx: ctx, script: s, final: i == 1, assigned: make(map[string]bool)}
+		for _, cmd := range s.Commands {
+			switch cmd := cmd.(type) {
+			case *SymbolAssignment:
+				st.assign(cmd)
+			case *ScriptAssert:
+				st.check(cmd)
+			}
+		}
+	}
+}
+
+// allocateHeaders loads the file and program headers if they fit in the
+// page of the first section, below it. This is the case with the usual
+// . = <base> + SIZEOF_HEADERS, but not with a section at the start of
+// a memory region.
+func allocateHeaders(ctx *Context) {
+	var first Chunker
+	for _, chunk := range ctx.Chunks {
+		if chunk != ctx.Ehdr && chunk != ctx.Phdr && chunk.GetShdr().Flags&uint64(elf.SHF_ALLOC) != 0 {
+			first = chunk
+			break
+		}
+	}
+
+	pageSize := ctx.Target.PageSize()
+	size := ctx.Ehdr.Shdr.Size + ctx.Phdr.Shdr.Size
+	if first == nil || first.GetShdr().Addr%pageSize < size {
+		ctx.Ehdr.Shdr.Flags = 0
+		ctx.Phdr.Shdr.Flags = 0
+		return
+	}
+
+	ctx.Ehdr.Shdr.Addr = first.GetShdr().Addr &^ (pageSize - 1)
+	ctx.Phdr.Shdr.Addr = ctx.Ehdr.Shdr.Addr + ctx.Ehdr.Shdr.Size
+}
+
+func (st *scriptLayout) run() {
+	for _, r := range st.script.Memory {
+		r.Cursor = r.Origin
+	}
+
+	for _, cmd := range st.script.Commands {
+		switch cmd := cmd.(type) {
+		case *SymbolAssignment:
+			st.assign(cmd)
+		case *ScriptAssert:
+			st.check(cmd)
+		case *SectionsCommand:
+			for _, cmd := range cmd.Commands {
+				switch cmd := cmd.(type) {
+				case *SymbolAssignment:
+					st.assign(cmd)
+				case *ScriptAssert:
+					st.check(cmd)
+				case *OutputSectionDesc:
+					st.layoutSection(cmd)
+				}
+			}
+		}
+	}
+
+	for _, chunk := range st.script.Orphans {
+		st.place(chunk)
+	}
+}
+
+func (st *scriptLayout) findRegion(name string) *MemoryRegion {
+	if name == "" {
+		return nil
+	}
+	for _, r := range st.script.Memory {
+		if r.Name == name {
+			return r
+		}
+	}
+	utils.Fatal("memory region not defined: " + name)
+	return nil
+}
+
+func (st *scriptLayout) checkRegion(r *MemoryRegion, name string) {
+	if st.final && r.Cursor > r.Origin+r.Length {
+		utils.Fatal(fmt.Sprintf("section %s will not fit in region %s: overflowed by %d bytes",
+			name, r.Name, r.Cursor-r.Origin-r.Length))
+	}
+}
+
+// place puts a chunk at the location counter.
+func (st *scriptLayout) place(chunk Chunker) {
+	shdr := chunk.GetShdr()
+	if shdr.Flags&uint64(elf.SHF_ALLOC) == 0 {
+		shdr.Addr = 0
+		return
+	}
+
+	st.dot = utils.AlignTo(st.dot, shdr.Addralign)
+	shdr.Addr = st.dot
+	if !isTbss(chunk) {
+		st.dot += shdr.Size
+	}
+	st.last = chunk
+}
+
+func (st *scriptLayout) layoutSection(d *OutputSectionDesc) {
+	alloc := false
+	align := uint64(1)
+	for _, chunk := range d.Chunks {
+		shdr := chunk.GetShdr()
+		alloc = alloc || shdr.Flags&uint64(elf.SHF_ALLOC) != 0
+		if align < shdr.Addralign {
+			align = shdr.Addralign
+		}
+	}
+	if d.Align != nil {
+		if a := d.Align.Eval(st); align < a {
+			align = a
+		}
+		if d.Section != nil && d.Section.Shdr.Addralign < align {
+			d.Section.Shdr.Addralign = align
+		}
+	}
+
+	// Non-alloc sections are at address 0 and do not move the location
+	// counter.
+	if !alloc {
+		saved := st.dot
+		st.dot = 0
+		st.layoutContents(d)
+		st.dot = saved
+		return
+	}
+
+	region := st.findRegion(d.Region)
+	lmaRegion := st.findRegion(d.LmaRegion)
+
+	addr := st.dot
+	if d.Addr != nil {
+		addr = d.Addr.Eval(st)
+	} else {
+		if region != nil {
+			addr = region.Cursor
+		}
+		addr = utils.AlignTo(addr, align)
+	}
+
+	st.dot = addr
+	d.addr = addr
+	st.layoutContents(d)
+	d.size = st.dot - addr
+
+	// Without AT or AT>, a section is loaded at the same offset from its
+	// address as the one before it in the same region.
+	lma := addr
+	if d.Lma != nil {
+		lma = d.Lma.Eval(st)
+	} else if lmaRegion != nil {
+		lma = utils.AlignTo(lmaRegion.Cursor, align)
+	} else if region != nil && region == st.prevRegion {
+		lma = addr + st.lmaOffset
+	}
+	d.lma = lma
+	st.lmaOffset = lma - addr
+	st.prevRegion = region
+
+	for _, chunk := range d.Orphans {
+		st.place(chunk)
+	}
+	for _, chunk := range append(d.Chunks, d.Orphans...) {
+		st.script.LoadAddrs[chunk] = chunk.GetShdr().Addr + st.lmaOffset
+	}
+
+	if region != nil {
+		region.Cursor = st.dot
+		st.checkRegion(region, d.Name)
+	}
+	if lmaRegion != nil {
+		lmaRegion.Cursor = lma + st.dot - addr
+		st.checkRegion(lmaRegion, d.Name)
+	}
+}
+
+// layoutContents places the input sections of the description and runs
+// the assignments among them. Other chunks of the same name, which are
+// synthetic, go where the first input section description is.
+func (st *scriptLayout) layoutContents(d *OutputSectionDesc) {
+	var osec *OutputSection
+	extras := make([]Chunker, 0)
+	for _, chunk := range d.Chunks {
+		if chunk == d.Section {
+			osec = d.Section
+		} else {
+			extras = append(extras, chunk)
+		}
+	}
+
+	placeExtras := func() {
+		for _, chunk := range extras {
+			st.place(chunk)
+		}
+		extras = nil
+	}
+
+	if osec == nil {
+		st.cur = nil
+	} else {
+		osec.Shdr.Addr = st.dot
+		st.cur, st.curStart = osec, st.dot
+		st.last = osec
+	}
+
+	// The contents of an output section with range extension thunks
+	// were laid out when the thunks were created.
+	if osec != nil && len(osec.Thunks) > 0 {
+		st.dot += osec.Shdr.Size
+	}
+
+	for _, cmd := range d.Commands {
+		switch cmd := cmd.(type) {
+		case *SymbolAssignment:
+			st.assign(cmd)
+		case *ScriptAssert:
+			st.check(cmd)
+		case *InputSectionDesc:
+			if osec == nil {
+				placeExtras()
+				continue
+			}
+			if len(osec.Thunks) > 0 {
+				continue
+			}
+			for _, isec := range cmd.Sections {
+				if isLiveSection(isec) {
+					st.dot = utils.AlignTo(st.dot, 1<<isec.P2Align)
+					isec.Offset = uint32(st.dot - osec.Shdr.Addr)
+					st.dot += uint64(isec.ShSize)
+				}
+			}
+		}
+	}
+
+	if osec != nil {
+		osec.Shdr.Size = st.dot - osec.Shdr.Addr
+		if isTbss(osec) {
+			st.dot = osec.Shdr.Addr
+		}
+	}
+	st.cur = nil
+	placeExtras()
+}
+
+func (st *scriptLayout) assign(a *SymbolAssignment) {
+	ctx := st.ctx
+
+	if a.Name == "." {
+		val := a.Expr.Eval(st)
+		// In an output section, a number assigned to . is an offset from
+		// the start of the section.
+		if st.cur != nil && a.Op == "=" && a.Expr.isConstant() {
+			val += st.curStart
+		}
+
+		dot := applyAssignment(a.Op, st.dot, val)
+		if st.final && st.cur != nil && dot < st.dot {
+			utils.Fatal(fmt.Sprintf("unable to move location counter backward in %s", st.cur.GetName()))
+		}
+		st.dot = dot
+		return
+	}
+
+	// A PROVIDE loses to a definition in an input file.
+	sym, ok := ctx.SymbolMap[a.Name]
+	if !ok || sym.File != ctx.InternalObj {
+		return
+	}
+
+	val := applyAssignment(a.Op, sym.GetAddr(), a.Expr.Eval(st))
+	st.assigned[a.Name] = true
+
+	chunk := st.cur
+	if chunk == nil {
+		chunk = st.last
+	}
+
+	if chunk == nil || a.Expr.isAbsolute() {
+		sym.SetOutputChunk(nil)
+		sym.Value = val
+	} else {
+		sym.SetOutputChunk(chunk)
+		sym.Value = val - chunk.GetShdr().Addr
+	}
+}
+
+func applyAssignment(op string, old, val uint64) uint64 {
+	switch op {
+	case "+=":
+		return old + val
+	case "-=":
+		return old - val
+	case "*=":
+		return old * val
+	case "/=":
+		if val == 0 {
+			utils.Fatal("division by zero in linker script")
+		}
+		return old / val
+	case "<<=":
+		return old << val
+	case ">>=":
+		return old >> val
+	case "&=":
+		return old & val
+	case "|=":
+		return old | val
+	}
+	return val
+}
+
+func (st *scriptLayout) check(a *ScriptAssert) {
+	if val := a.Expr.Eval(st); st.final && val == 0 {
+		utils.Fatal(a.Msg)
+	}
+}
+
+// getSection returns the address, load address and size of a section
+// named in an expression.
+func (st *scriptLayout) getSection(name string) (uint64, uint64, uint64) {
+	for _, d := range st.script.outputSectionDescs() {
+		if d.Name == name {
+			return d.addr, d.lma, d.size
+		}
+	}
+	for _, chunk := range st.ctx.Chunks {
+		if chunk.GetName() == name {
+			shdr := chunk.GetShdr()
+			return shdr.Addr, GetLoadAddr(st.ctx, chunk), shdr.Size
+		}
+	}
+	utils.Fatal("undefined section in linker script: " + name)
+	return 0, 0, 0
+}
+
+// isConstant reports whether the value of the expression does not
+// depend on where things are placed.
+func (e *ScriptExpr) isConstant() bool {
+	switch e.Op {
+	case ".", "sym":
+		return false
+	case "call":
+		switch e.Name {
+		case "ADDR", "LOADADDR", "DEFINED":
+			return false
+		case "ALIGN":
+			if len(e.Args) == 1 {
+				return false
+			}
+		}
+	}
+
+	for _, arg := range e.Args {
+		if !arg.isConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+// isAbsolute reports whether a symbol defined by the expression is
+// absolute rather than relative to a section.
+func (e *ScriptExpr) isAbsolute() bool {
+	if e.Op == "call" && (e.Name == "ABSOLUTE" || e.Name == "LOADADDR") {
+		return true
+	}
+	return e.isConstant()
+}
+
+// Eval evaluates the expression. The layout may be nil where only
+// constants are allowed, e.g. in MEMORY.
+func (e *ScriptExpr) Eval(st *scriptLayout) uint64 {
+	if st == nil && !e.isConstant() {
+		utils.Fatal("expression must be a constant")
+	}
+
+	arg := func(i int) uint64 {
+		return e.Args[i].Eval(st)
+	}
+
+	switch e.Op {
+	case "num":
+		return e.Val
+	case ".":
+		return st.dot
+	case "sym":
+		sym, ok := st.ctx.SymbolMap[e.Name]
+		if !ok || sym.File == nil {
+			utils.Fatal("undefined symbol in linker script: " + e.Name)
+		}
+		return sym.GetAddr()
+	case "call":
+		return e.call(st)
+	case "?:":
+		if arg(0) != 0 {
+			return arg(1)
+		}
+		return arg(2)
+	}
+
+	if len(e.Args) == 1 {
+		switch e.Op {
+		case "-":
+			return -arg(0)
+		case "~":
+			return ^arg(0)
+		case "!":
+			return b2u(arg(0) == 0)
+		}
+		return arg(0)
+	}
+
+	lhs, rhs := arg(0), arg(1)
+	switch e.Op {
+	case "+":
+		return lhs + rhs
+	case "-":
+		return lhs - rhs
+	case "*":
+		return lhs * rhs
+	case "/", "%":
+		if rhs == 0 {
+			utils.Fatal("division by zero in linker script")
+		}
+		if e.Op == "/" {
+			return lhs / rhs
+		}
+		return lhs % rhs
+	case "<<":
+		return lhs << rhs
+	case ">>":
+		return lhs >> rhs
+	case "&":
+		return lhs & rhs
+	case "|":
+		return lhs | rhs
+	case "^":
+		return lhs ^ rhs
+	case "==":
+		return b2u(lhs == rhs)
+	case "!=":
+		return b2u(lhs != rhs)
+	case "<":
+		return b2u(lhs < rhs)
+	case "<=":
+		return b2u(lhs <= rhs)
+	case ">":
+		return b2u(lhs > rhs)
+	case ">=":
+		return b2u(lhs >= rhs)
+	case "&&":
+		return b2u(lhs != 0 && rhs != 0)
+	case "||":
+		return b2u(lhs != 0 || rhs != 0)
+	}
+
+	utils.Fatal("unknown operator in linker script: " + e.Op)
+	return 0
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *ScriptExpr) call(st *scriptLayout) uint64 {
+	arg := func(i int) uint64 {
+		return e.Args[i].Eval(st)
+	}
+	name := func() string {
+		return e.Args[0].Name
+	}
+
+	switch e.Name {
+	case "ALIGN":
+		if len(e.Args) == 1 {
+			return utils.AlignTo(st.dot, arg(0))
+		}
+		return utils.AlignTo(arg(0), arg(1))
+	case "ABSOLUTE", "SEGMENT_START":
+		return arg(0)
+	case "MAX", "MIN":
+		a, b := arg(0), arg(1)
+		if (a < b) == (e.Name == "MAX") {
+			return b
+		}
+		return a
+	case "LOG2CEIL":
+		if v := arg(0); v > 1 {
+			return uint64(bits.Len64(v - 1))
+		}
+		return 0
+	case "ADDR":
+		addr, _, _ := st.getSection(name())
+		return addr
+	case "LOADADDR":
+		_, lma, _ := st.getSection(name())
+		return lma
+	case "SIZEOF":
+		_, _, size := st.getSection(name())
+		return size
+	case "ALIGNOF":
+		for _, chunk := range st.ctx.Chunks {
+			if chunk.GetName() == name() {
+				return chunk.GetShdr().Addralign
+			}
+		}
+		return 0
+	case "ORIGIN", "LENGTH":
+		r := st.findRegion(name())
+		if e.Name == "ORIGIN" {
+			return r.Origin
+		}
+		return r.Length
+	case "DEFINED":
+		// A symbol that the script defines counts only once it has been
+		// assigned.
+		sym, ok := st.ctx.SymbolMap[name()]
+		if !ok || sym.File == nil {
+			return 0
+		}
+		if _, ok := st.script.Symbols[name()]; ok && sym.File == st.ctx.InternalObj {
+			return b2u(st.assigned[name()])
+		}
+		return 1
+	case "CONSTANT":
+		switch name() {
+		case "MAXPAGESIZE", "COMMONPAGESIZE":
+			return st.ctx.Target.PageSize()
+		}
+		utils.Fatal("unknown constant in linker script: " + name())
+	case "SIZEOF_HEADERS":
+		return EhdrSize(st.ctx) + st.ctx.Phdr.Shdr.Size
+	}
+
+	utils.Fatal("unknown function in linker script: " + e.Name)
+	return 0
+}
+
+// referencedSymbols returns the names of the symbols that expressions
+// in the script refer to.
+func (s *LinkerScript) referencedSymbols() map[string]bool {
+	refs := make(map[string]bool)
+	var visit func(e *ScriptExpr)
+	visit = func(e *ScriptExpr) {
+		if e == nil {
+			return
+		}
+		if e.Op == "sym" {
+			refs[e.Name] = true
+		}
+		if e.Op == "call" && e.Name == "DEFINED" {
+			return
+		}
+		for _, arg := range e.Args {
+			visit(arg)
+		}
+	}
+
+	s.forEachCommand(func(cmd ScriptCommand) {
+		switch cmd := cmd.(type) {
+		case *SymbolAssignment:
+			visit(cmd.Expr)
+		case *ScriptAssert:
+			visit(cmd.Expr)
+		case *OutputSectionDesc:
+			visit(cmd.Addr)
+			visit(cmd.Lma)
+			visit(cmd.Align)
+		}
+	})
+	return refs
+}
+
+// assignScriptFileOffsets gives each chunk its place in the file. A
+// chunk that starts a segment is put at an offset congruent to its
+// address modulo the page size, as the loader maps whole pages.
+func assignScriptFileOffsets(ctx *Context) uint64 {
+	fileoff := uint64(0)
+	var prev Chunker
+
+	for _, chunk := range ctx.Chunks {
+		shdr := chunk.GetShdr()
+		if shdr.Flags&uint64(elf.SHF_ALLOC) == 0 {
+			fileoff = utils.AlignTo(fileoff, shdr.Addralign)
+			shdr.Offset = fileoff
+			if shdr.Type != uint32(elf.SHT_NOBITS) {
+				fileoff += shdr.Size
+			}
+			continue
+		}
+
+		if isTbss(chunk) {
+			shdr.Offset = fileoff
+			continue
+		}
+
+		off := fileoff + (shdr.Addr-fileoff)&(ctx.Target.PageSize()-1)
+		if prev != nil && !StartsNewSegment(ctx, prev, chunk) {
+			off = prev.GetShdr().Offset + shdr.Addr - prev.GetShdr().Addr
+		}
+
+		shdr.Offset = off
+		if shdr.Type != uint32(elf.SHT_NOBITS) {
+			fileoff = off + shdr.Size
+		}
+		prev = chunk
+	}
+	return fileoff
+}
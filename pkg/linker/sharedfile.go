@@ -0,0 +1,93 @@
+package linker
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"rvld/pkg/utils"
+)
+
+const STT_GNU_IFUNC elf.SymType = 10
+
+// VERSYM_HIDDEN marks a symbol version that can only be bound to by a
+// versioned reference, e.g. the old memcpy@GLIBC_2.2.5.
+const VERSYM_HIDDEN uint16 = 0x8000
+
+func NewSharedFile(file *File) *ObjectFile {
+	o := &ObjectFile{InputFile: NewInputFile(file)}
+	o.IsDso = true
+	o.IsAlive = true
+	return o
+}
+
+// ParseDso reads the dynamic symbol table of a shared library. Unlike
+// relocatable objects, no sections are taken from it.
+func (o *ObjectFile) ParseDso(ctx *Context) {
+	o.Soname = filepath.Base(o.File.Name)
+
+	dynsym := o.FindSection(uint32(elf.SHT_DYNSYM))
+	if dynsym == nil {
+		return
+	}
+
+	o.FirstGlobal = int(dynsym.Info)
+	o.FillUpSymbols(dynsym)
+	o.SymStrTable = o.GetBytesFromIndex(uint64(dynsym.Link))
+
+	if shdr := o.FindSection(uint32(elf.SHT_DYNAMIC)); shdr != nil {
+		strtab := o.GetBytesFromIndex(uint64(shdr.Link))
+		for _, ent := range ReadDynEntries(o.GetBytesFromShdr(shdr), o.Is64) {
+			if ent.Tag == uint64(elf.DT_SONAME) {
+				o.Soname = GetNameFromTable(strtab, uint32(ent.Val))
+			}
+		}
+	}
+
+	if shdr := o.FindSection(uint32(elf.SHT_GNU_VERSYM)); shdr != nil {
+		o.Versyms = utils.ReadSlice[uint16](o.GetBytesFromShdr(shdr), 2)
+	}
+
+	o.LocalSymbols = make([]Symbol, o.FirstGlobal)
+	o.Symbols = make([]*Symbol, len(o.SymTable))
+	for i := 0; i < o.FirstGlobal; i++ {
+		o.LocalSymbols[i] = *NewSymbol("")
+		o.LocalSymbols[i].File = o
+		o.Symbols[i] = &o.LocalSymbols[i]
+	}
+
+	for i := o.FirstGlobal; i < len(o.SymTable); i++ {
+		name := GetNameFromTable(o.SymStrTable, o.SymTable[i].Name)
+		if o.IsHiddenVersion(i) {
+			o.Symbols[i] = NewSymbol(name)
+		} else {
+			o.Symbols[i] = GetSymbolByName(ctx, name)
+		}
+	}
+}
+
+func (o *ObjectFile) IsHiddenVersion(idx int) bool {
+	if idx >= len(o.Versyms) {
+		return false
+	}
+	return o.Versyms[idx]&VERSYM_HIDDEN != 0 || o.Versyms[idx] == 0
+}
+
+// ResolveDsoSymbols binds the symbols that no object file defines to
+// this library. It runs after all object files are resolved, so a
+// definition in the executable always wins.
+func (o *ObjectFile) ResolveDsoSymbols() {
+	for i := o.FirstGlobal; i < len(o.SymTable); i++ {
+		sym := o.Symbols[i]
+		esym := &o.SymTable[i]
+
+		if esym.IsUndef() || o.IsHiddenVersion(i) {
+			continue
+		}
+
+		if sym.File == nil {
+			sym.File = o
+			sym.SetInputSection(nil)
+			sym.Value = esym.Value
+			sym.SymIdx = int32(i)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package linker
+
+import "debug/elf"
+
+type ShstrtabSection struct {
+	Chunk
+	Contents []byte
+	Offsets  map[string]uint32
+}
+
+func NewShstrtabSection() *ShstrtabSection {
+	s := &ShstrtabSection{
+		Chunk:    NewChunk(),
+		Contents: []byte{0},
+		Offsets:  map[string]uint32{"": 0},
+	}
+
+	s.Name = ".shstrtab"
+	s.Shdr.Type = uint32(elf.SHT_STRTAB)
+
+	return s
+}
+
+// AddString interns name and returns its offset, so sections sharing
+// a name share a single string.
+func (s *ShstrtabSection) AddString(name string) uint32 {
+	if off, ok := s.Offsets[name]; ok {
+		return off
+	}
+
+	off := uint32(len(s.Contents))
+	s.Offsets[name] = off
+	s.Contents = append(s.Contents, name...)
+	s.Contents = append(s.Contents, 0)
+	s.Shdr.Size = uint64(len(s.Contents))
+	return off
+}
+
+func (s *ShstrtabSection) CopyBuf(ctx *Context) {
+	copy(ctx.Buf[s.Shdr.Offset:], s.Contents)
+}
@@ -0,0 +1,20 @@
+package linker
+
+import "debug/elf"
+
+// StrtabSection holds the names of .symtab entries. Its size and
+// contents are computed by SymtabSection.
+type StrtabSection struct {
+	Chunk
+}
+
+func NewStrtabSection() *StrtabSection {
+	s := &StrtabSection{
+		Chunk: NewChunk(),
+	}
+
+	s.Name = ".strtab"
+	s.Shdr.Type = uint32(elf.SHT_STRTAB)
+
+	return s
+}
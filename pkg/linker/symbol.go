@@ -1,26 +1,45 @@
 package linker
 
-import "rvld/pkg/utils"
+import (
+	"debug/elf"
+	"rvld/pkg/utils"
+)
 
 const (
-	NeedsGotTp uint32 = 1 << 0
+	NeedsGotTp   uint32 = 1 << 0
+	NeedsGot     uint32 = 1 << 1
+	NeedsPlt     uint32 = 1 << 2
+	NeedsCopyrel uint32 = 1 << 3
+	NeedsDynsym  uint32 = 1 << 4
+	NeedsTlsGd   uint32 = 1 << 5
 )
 
 type Symbol struct {
 	File            *ObjectFile
 	InputSection    *InputSection
 	SectionFragment *SectionFragment
+	OutputChunk     Chunker
 	Name            string
 	Value           uint64
 	SymIdx          int32
+	GotIdx          int32
 	GotTpIdx        int32
+	TlsGdIdx        int32
+	PltIdx          int32
+	DynsymIdx       int32
 	Flags           uint32
+
+	// Index in the output .symtab, which relocations refer to in
+	// relocatable output.
+	SymtabIdx int32
 }
 
 func NewSymbol(name string) *Symbol {
 	s := &Symbol{
-		Name:   name,
-		SymIdx: -1,
+		Name:      name,
+		SymIdx:    -1,
+		PltIdx:    -1,
+		DynsymIdx: -1,
 	}
 
 	return s
@@ -29,11 +48,21 @@ func NewSymbol(name string) *Symbol {
 func (s *Symbol) SetInputSection(isec *InputSection) {
 	s.InputSection = isec
 	s.SectionFragment = nil
+	s.OutputChunk = nil
 }
 
 func (s *Symbol) SetSectionFragment(frag *SectionFragment) {
 	s.InputSection = nil
 	s.SectionFragment = frag
+	s.OutputChunk = nil
+}
+
+// SetOutputChunk makes the symbol relative to an output chunk. It is
+// used by linker-synthesized symbols, which have no input section.
+func (s *Symbol) SetOutputChunk(chunk Chunker) {
+	s.InputSection = nil
+	s.SectionFragment = nil
+	s.OutputChunk = chunk
 }
 
 func GetSymbolByName(ctx *Context, name string) *Symbol {
@@ -52,6 +81,9 @@ func (s *Symbol) ELFSym() *Sym64 {
 func (s *Symbol) Clear() {
 	s.File = nil
 	s.InputSection = nil
+	s.SectionFragment = nil
+	s.OutputChunk = nil
+	s.Value = 0
 	s.SymIdx = -1
 }
 
@@ -64,9 +96,153 @@ func (s *Symbol) GetAddr() uint64 {
 		return s.InputSection.GetAddr() + s.Value
 	}
 
+	if s.OutputChunk != nil {
+		return s.OutputChunk.GetShdr().Addr + s.Value
+	}
+
 	return s.Value
 }
 
+func (s *Symbol) GetGotAddr(ctx *Context) uint64 {
+	return ctx.Got.Shdr.Addr + uint64(s.GotIdx)*WordSize(ctx)
+}
+
 func (s *Symbol) GetGotTpAddr(ctx *Context) uint64 {
-	return ctx.Got.Shdr.Addr + uint64(s.GotTpIdx)*8
+	return ctx.Got.Shdr.Addr + uint64(s.GotTpIdx)*WordSize(ctx)
+}
+
+func (s *Symbol) GetTlsGdAddr(ctx *Context) uint64 {
+	return ctx.Got.Shdr.Addr + uint64(s.TlsGdIdx)*WordSize(ctx)
+}
+
+func (s *Symbol) GetPltAddr(ctx *Context) uint64 {
+	return ctx.Plt.Shdr.Addr + ctx.Target.PltHeaderSize() + uint64(s.PltIdx)*ctx.Target.PltEntrySize()
+}
+
+func (s *Symbol) GetGotPltAddr(ctx *Context) uint64 {
+	return ctx.GotPlt.Shdr.Addr + ctx.Target.GotPltHeaderSize(ctx) + uint64(s.PltIdx)*WordSize(ctx)
+}
+
+// GetCallAddr returns the address calls to the symbol go to.
+func (s *Symbol) GetCallAddr(ctx *Context) uint64 {
+	if s.PltIdx >= 0 {
+		return s.GetPltAddr(ctx)
+	}
+	return s.GetAddr()
+}
+
+// IsImported reports whether the symbol is defined by a shared library,
+// or left undefined in a shared library being built, and therefore
+// resolved by the dynamic linker at load time.
+func (s *Symbol) IsImported() bool {
+	if s.File == nil || s.SymIdx < 0 {
+		return false
+	}
+	return s.File.IsDso || s.ELFSym().IsUndef()
+}
+
+// IsPreemptible reports whether a definition in another module may take
+// the place of the symbol at run time. References to such a symbol have
+// to go through the dynamic linker.
+func (s *Symbol) IsPreemptible(ctx *Context) bool {
+	if s.IsImported() {
+		return true
+	}
+
+	if !ctx.Args.Shared || s.File == nil || s.SymIdx < 0 || s.File == ctx.InternalObj {
+		return false
+	}
+
+	esym := s.ELFSym()
+	return elf.SymBind(esym.Bind()) != elf.STB_LOCAL && elf.SymVis(esym.Other&3) == elf.STV_DEFAULT
+}
+
+// IsAbsolute reports whether the symbol's address stays the same
+// wherever the output is loaded. Unresolved weak symbols are 0.
+func (s *Symbol) IsAbsolute(ctx *Context) bool {
+	if s.File == nil {
+		return true
+	}
+	if s.File == ctx.InternalObj || s.File.IsDso || s.SymIdx < 0 {
+		return false
+	}
+	return s.ELFSym().IsAbs()
+}
+
+// IsIfunc reports whether the symbol is an indirect function that the
+// output resolves itself. Its resolver is called at startup, and all
+// references go through a PLT entry filled with the result.
+func (s *Symbol) IsIfunc(ctx *Context) bool {
+	if s.File == nil || s.File.IsDso || s.SymIdx < 0 {
+		return false
+	}
+	return elf.SymType(s.ELFSym().Type()) == STT_GNU_IFUNC && !s.IsPreemptible(ctx)
+}
+
+// GetIfuncResolverAddr returns the address of the resolver of an ifunc,
+// which the symbol itself no longer points to once it has a PLT entry.
+func (s *Symbol) GetIfuncResolverAddr() uint64 {
+	esym := s.ELFSym()
+	isec := s.File.GetSecion(esym, int(s.SymIdx))
+	if isec.Leader != nil {
+		isec = isec.Leader
+	}
+	return isec.GetAddr() + esym.Value
+}
+
+// MarkCall records a call to the symbol. Calls to a preemptible symbol
+// go through a PLT entry.
+func (s *Symbol) MarkCall(ctx *Context) {
+	if s.IsPreemptible(ctx) {
+		s.Flags |= NeedsPlt
+	}
+}
+
+// MarkDirectAccess records a reference to the address of the symbol
+// that does not go through the GOT. Code in an executable assumes such
+// addresses are link-time constants, so an imported function gets a
+// PLT entry as its canonical address and imported data is copied into
+// the executable.
+func (s *Symbol) MarkDirectAccess() {
+	if !s.IsImported() {
+		return
+	}
+
+	switch elf.SymType(s.ELFSym().Type()) {
+	case elf.STT_FUNC, STT_GNU_IFUNC:
+		s.Flags |= NeedsPlt
+	default:
+		s.Flags |= NeedsCopyrel
+	}
+}
+
+// IsSymtabCandidate reports whether the symbol is defined in a part of
+// the output that survived, so that it can be listed in .symtab.
+func (s *Symbol) IsSymtabCandidate() bool {
+	esym := s.ELFSym()
+	if elf.SymType(esym.Type()) == elf.STT_SECTION || esym.IsUndef() || esym.IsCommon() {
+		return false
+	}
+
+	if s.SectionFragment != nil || s.OutputChunk != nil || esym.IsAbs() {
+		return true
+	}
+
+	return s.InputSection != nil && s.InputSection.IsAlive
+}
+
+func (s *Symbol) GetOutputShndx() int64 {
+	if s.SectionFragment != nil {
+		return s.SectionFragment.OutputSection.Shndx
+	}
+
+	if s.InputSection != nil {
+		return s.InputSection.OutputSection.Shndx
+	}
+
+	if s.OutputChunk != nil && s.OutputChunk.GetShndx() > 0 {
+		return s.OutputChunk.GetShndx()
+	}
+
+	return int64(elf.SHN_ABS)
 }
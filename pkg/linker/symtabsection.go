@@ -0,0 +1,87 @@
+package linker
+
+import "debug/elf"
+
+type SymtabSection struct {
+	Chunk
+}
+
+func NewSymtabSection(ctx *Context) *SymtabSection {
+	s := &SymtabSection{
+		Chunk: NewChunk(),
+	}
+
+	s.Name = ".symtab"
+	s.Shdr.Type = uint32(elf.SHT_SYMTAB)
+	s.Shdr.Entsize = SymSize(ctx)
+	s.Shdr.Addralign = WordSize(ctx)
+
+	return s
+}
+
+func (s *SymtabSection) UpdateShdr(ctx *Context) {
+	// The first entry of .symtab is the null symbol and the first byte
+	// of .strtab is the empty string.
+	numLocals := int64(1)
+	strtabSize := int64(1)
+
+	// Relocatable output starts with a section symbol for each section,
+	// so that the index of the symbol is that of the section.
+	if ctx.Args.Relocatable {
+		numLocals += numOutputSections(ctx)
+	}
+
+	for _, file := range ctx.Objs {
+		file.ComputeSymtabSize(ctx)
+
+		file.LocalSymtabIdx = numLocals
+		numLocals += file.NumLocalSymtab
+		file.StrtabOffset = strtabSize
+		strtabSize += file.StrtabSize
+	}
+
+	numGlobals := int64(0)
+	for _, file := range ctx.Objs {
+		file.GlobalSymtabIdx = numLocals + numGlobals
+		numGlobals += file.NumGlobalSymtab
+	}
+
+	if ctx.Args.Relocatable {
+		for _, file := range ctx.Objs {
+			file.AssignSymtabIndices(ctx)
+		}
+	}
+
+	s.Shdr.Info = uint32(numLocals)
+	s.Shdr.Link = uint32(ctx.Strtab.Shndx)
+	s.Shdr.Size = uint64(numLocals+numGlobals) * SymSize(ctx)
+	ctx.Strtab.Shdr.Size = uint64(strtabSize)
+}
+
+func (s *SymtabSection) CopyBuf(ctx *Context) {
+	WriteSym(ctx, ctx.Buf[s.Shdr.Offset:], Sym64{})
+	ctx.Buf[ctx.Strtab.Shdr.Offset] = 0
+
+	if ctx.Args.Relocatable {
+		for i := int64(1); i <= numOutputSections(ctx); i++ {
+			WriteSym(ctx, ctx.Buf[s.Shdr.Offset+uint64(i)*SymSize(ctx):], Sym64{
+				Info:  uint8(elf.STB_LOCAL)<<4 | uint8(elf.STT_SECTION),
+				Shndx: uint16(i),
+			})
+		}
+	}
+
+	for _, file := range ctx.Objs {
+		file.PopulateSymtab(ctx)
+	}
+}
+
+func numOutputSections(ctx *Context) int64 {
+	n := int64(0)
+	for _, chunk := range ctx.Chunks {
+		if chunk.GetShndx() > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package linker
+
+import "debug/elf"
+
+// Target is what the passes need to know about the architecture of
+// the output. Everything else in the linker is shared between targets.
+type Target interface {
+	MachineType() MachineType
+	ELFMachine() elf.Machine
+	PageSize() uint64
+
+	// MergeFlags returns e_flags of the output, merged from the inputs.
+	// It reports incompatible inputs as fatal errors.
+	MergeFlags(ctx *Context) uint32
+
+	// TpAddr returns the value of the thread pointer for the given
+	// PT_TLS segment.
+	TpAddr(tls *ProgramHeader) uint64
+
+	// CreateThunks makes branches that cannot reach their targets go
+	// through thunks. It runs once addresses are assigned and reports
+	// whether the layout changed, in which case it is assigned again.
+	CreateThunks(ctx *Context) bool
+
+	// ScanRelocations records which symbols need GOT entries.
+	ScanRelocations(ctx *Context, isec *InputSection)
+
+	ApplyRelocAlloc(ctx *Context, isec *InputSection, base []byte)
+	ApplyRelocNonAlloc(ctx *Context, isec *InputSection, base []byte)
+
+	// ApplyDataReloc applies a relocation in data rebuilt by the linker,
+	// such as .eh_frame.
+	ApplyDataReloc(loc []byte, typ uint32, S, A, P uint64)
+
+	// DynamicLinker returns the default program interpreter.
+	DynamicLinker(ctx *Context) string
+	DynRelocs() DynRelocTypes
+
+	// The PLT consists of a header, which calls the lazy resolver, and
+	// one entry per symbol. GotPltEntry returns the initial value of
+	// the .got.plt slot of a symbol, which leads back to the resolver.
+	PltHeaderSize() uint64
+	PltEntrySize() uint64
+	GotPltHeaderSize(ctx *Context) uint64
+	WritePltHeader(ctx *Context, buf []byte)
+	WritePltEntry(ctx *Context, buf []byte, sym *Symbol)
+	GotPltEntry(ctx *Context, sym *Symbol) uint64
+}
+
+func GetTarget(mt MachineType) Target {
+	switch mt {
+	case MachineTypeRISCV64, MachineTypeRISCV32:
+		return &TargetRISCV{Type: mt}
+	case MachineTypeX86_64:
+		return &TargetX86_64{}
+	case MachineTypeARM64:
+		return &TargetARM64{}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package linker
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"rvld/pkg/utils"
+)
+
+// TargetX86_64 is the backend for x86-64 executables and shared
+// libraries.
+type TargetX86_64 struct{}
+
+func (t *TargetX86_64) MachineType() MachineType {
+	return MachineTypeX86_64
+}
+
+func (t *TargetX86_64) ELFMachine() elf.Machine {
+	return elf.EM_X86_64
+}
+
+func (t *TargetX86_64) PageSize() uint64 {
+	return 4096
+}
+
+// CreateThunks does nothing, as calls reach ±2GiB.
+func (t *TargetX86_64) CreateThunks(ctx *Context) bool {
+	return false
+}
+
+func (t *TargetX86_64) MergeFlags(ctx *Context) uint32 {
+	return 0
+}
+
+// TpAddr returns the value of %fs, which points to the end of the TLS
+// block on x86-64. TLS variables live at negative offsets from it.
+func (t *TargetX86_64) TpAddr(tls *ProgramHeader) uint64 {
+	return utils.AlignTo(tls.VAddr+tls.MemSize, tls.Align)
+}
+
+func (t *TargetX86_64) ScanRelocations(ctx *Context, i *InputSection) {
+	rels := i.GetRels()
+	for idx := 0; idx < len(rels); idx++ {
+		rel := rels[idx]
+		sym := i.File.Symbols[rel.Sym]
+		typ := elf.R_X86_64(rel.Type)
+		switch typ {
+		case elf.R_X86_64_64:
+			i.ScanAbsWord(ctx, sym, typ)
+		case elf.R_X86_64_32, elf.R_X86_64_32S:
+			i.ScanAbs(ctx, sym, typ)
+		case elf.R_X86_64_PC32, elf.R_X86_64_PC64:
+			i.ScanPcRel(ctx, sym, typ)
+		case elf.R_X86_64_PLT32:
+			sym.MarkCall(ctx)
+		case elf.R_X86_64_GOTPCREL:
+			sym.Flags |= NeedsGot
+		case elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+			if !canRelaxGotpcrelx(ctx, i, rel, sym) {
+				sym.Flags |= NeedsGot
+			}
+		case elf.R_X86_64_GOTTPOFF:
+			sym.Flags |= NeedsGotTp
+		case elf.R_X86_64_TLSGD:
+			if canRelaxTlsGd(ctx, i, rels, idx) {
+				// The call to __tls_get_addr goes away with it.
+				idx++
+			} else {
+				sym.Flags |= NeedsTlsGd
+			}
+		case elf.R_X86_64_TLSLD:
+			if ctx.Args.Shared {
+				ctx.Got.AddTlsLd(ctx)
+			} else if relaxTlsLd(i, rels, idx) != nil {
+				idx++
+			} else {
+				utils.Fatal(fmt.Sprintf("%s: %s: unsupported TLSLD code sequence",
+					i.File.File.DisplayName(), i.Name()))
+			}
+		case elf.R_X86_64_TPOFF32, elf.R_X86_64_TPOFF64:
+			i.ScanTlsLe(ctx, sym, typ)
+		}
+	}
+}
+
+// relaxGotpcrelx returns the opcode bytes that make the GOT-indirect
+// call, jump or load at insn refer to the symbol directly, or nil if
+// the instruction is something else.
+func relaxGotpcrelx(insn []byte) []byte {
+	switch {
+	case insn[0] == 0xff && insn[1] == 0x15: // call *foo(%rip) -> addr32 call foo
+		return []byte{0x67, 0xe8}
+	case insn[0] == 0xff && insn[1] == 0x25: // jmp *foo(%rip) -> addr32 jmp foo
+		return []byte{0x67, 0xe9}
+	case insn[0] == 0x8b && insn[1]&0xc7 == 0x05: // mov foo(%rip), %reg -> lea foo(%rip), %reg
+		return []byte{0x8d, insn[1]}
+	}
+	return nil
+}
+
+// canRelaxGotpcrelx reports whether a GOT-indirect access to sym can be
+// rewritten to a PC-relative one. Besides saving the GOT slot, this
+// lets the startup code of a static PIE run before it relocates itself.
+func canRelaxGotpcrelx(ctx *Context, i *InputSection, rel Rela, sym *Symbol) bool {
+	return rel.Offset >= 2 && relaxGotpcrelx(i.Contents[rel.Offset-2:]) != nil &&
+		!sym.IsPreemptible(ctx) && !sym.IsAbsolute(ctx)
+}
+
+// Executables know the TLS offsets of their own symbols, so they do not
+// call __tls_get_addr, which static executables do not even have. The
+// general- and local-dynamic code sequences are rewritten to compute
+// addresses from %fs instead.
+
+// canRelaxTlsGd reports whether the general-dynamic sequence at
+// rels[idx] can be rewritten. It is
+//
+//	data16 lea x@tlsgd(%rip), %rdi
+//	data16 data16 rex.W call __tls_get_addr@PLT
+//
+// or the same with call *__tls_get_addr@GOTPCREL(%rip).
+func canRelaxTlsGd(ctx *Context, i *InputSection, rels []Rela, idx int) bool {
+	rel := rels[idx]
+	if ctx.Args.Shared || i.File.Symbols[rel.Sym].IsPreemptible(ctx) ||
+		idx+1 == len(rels) || rels[idx+1].Offset != rel.Offset+8 ||
+		rel.Offset < 4 || uint64(len(i.Contents)) < rel.Offset+12 {
+		return false
+	}
+
+	insn := i.Contents[rel.Offset-4:]
+	return bytes.HasPrefix(insn, []byte{0x66, 0x48, 0x8d, 0x3d}) &&
+		(bytes.HasPrefix(insn[8:], []byte{0x66, 0x66, 0x48, 0xe8}) ||
+			bytes.HasPrefix(insn[8:], []byte{0x66, 0x48, 0xff, 0x15}))
+}
+
+// relaxTlsLd returns the code that replaces the local-dynamic sequence
+// at rels[idx], which starts 3 bytes before the relocation, or nil if
+// the sequence is not known. It is
+//
+//	lea x@tlsld(%rip), %rdi
+//	call __tls_get_addr@PLT
+//
+// or the same with call *__tls_get_addr@GOTPCREL(%rip).
+func relaxTlsLd(i *InputSection, rels []Rela, idx int) []byte {
+	rel := rels[idx]
+	if idx+1 == len(rels) || rel.Offset < 3 || uint64(len(i.Contents)) < rel.Offset+10 {
+		return nil
+	}
+
+	insn := i.Contents[rel.Offset-3:]
+	if !bytes.HasPrefix(insn, []byte{0x48, 0x8d, 0x3d}) {
+		return nil
+	}
+
+	// mov %fs:0, %rax, padded to the length of the original.
+	switch next := rels[idx+1].Offset; {
+	case insn[7] == 0xe8 && next == rel.Offset+5:
+		return []byte{0x66, 0x66, 0x66, 0x64, 0x48, 0x8b, 0x04, 0x25, 0, 0, 0, 0}
+	case insn[7] == 0xff && insn[8] == 0x15 && next == rel.Offset+6:
+		return []byte{0x66, 0x66, 0x66, 0x66, 0x64, 0x48, 0x8b, 0x04, 0x25, 0, 0, 0, 0}
+	}
+	return nil
+}
+
+func (t *TargetX86_64) ApplyRelocAlloc(ctx *Context, i *InputSection, base []byte) {
+	// Offsets from the local-dynamic base become offsets from %fs when
+	// the sequence is relaxed.
+	dtpBase := ctx.TpAddr
+	if ctx.Args.Shared {
+		dtpBase = ctx.TlsBegin
+	}
+
+	rels := i.GetRels()
+	for idx := 0; idx < len(rels); idx++ {
+		rel := rels[idx]
+		if rel.Type == uint32(elf.R_X86_64_NONE) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		S, A := i.GetSymAddrAndAddend(rel)
+		P := i.GetAddr() + rel.Offset
+
+		switch elf.R_X86_64(rel.Type) {
+		case elf.R_X86_64_64:
+			i.ApplyAbsWord(ctx, loc, rel, S, A)
+		case elf.R_X86_64_32, elf.R_X86_64_32S:
+			utils.Write(loc, uint32(S+A))
+		case elf.R_X86_64_PC32:
+			utils.Write(loc, uint32(S+A-P))
+		case elf.R_X86_64_PLT32:
+			if sym.PltIdx >= 0 {
+				S = sym.GetPltAddr(ctx)
+			}
+			utils.Write(loc, uint32(S+A-P))
+		case elf.R_X86_64_PC64:
+			utils.Write(loc, S+A-P)
+		case elf.R_X86_64_GOTPCREL:
+			utils.Write(loc, uint32(sym.GetGotAddr(ctx)+A-P))
+		case elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+			if canRelaxGotpcrelx(ctx, i, rel, sym) {
+				copy(base[rel.Offset-2:], relaxGotpcrelx(i.Contents[rel.Offset-2:]))
+				utils.Write(loc, uint32(S+A-P))
+			} else {
+				utils.Write(loc, uint32(sym.GetGotAddr(ctx)+A-P))
+			}
+		case elf.R_X86_64_GOTTPOFF:
+			utils.Write(loc, uint32(sym.GetGotTpAddr(ctx)+A-P))
+		case elf.R_X86_64_TLSGD:
+			if canRelaxTlsGd(ctx, i, rels, idx) {
+				// mov %fs:0, %rax; lea x@tpoff(%rax), %rax
+				copy(base[rel.Offset-4:], []byte{
+					0x64, 0x48, 0x8b, 0x04, 0x25, 0, 0, 0, 0,
+					0x48, 0x8d, 0x80, 0, 0, 0, 0,
+				})
+				utils.Write(base[rel.Offset+8:], uint32(S-ctx.TpAddr))
+				idx++
+			} else {
+				utils.Write(loc, uint32(sym.GetTlsGdAddr(ctx)+A-P))
+			}
+		case elf.R_X86_64_TLSLD:
+			if ctx.Args.Shared {
+				utils.Write(loc, uint32(ctx.Got.GetTlsLdAddr(ctx)+A-P))
+			} else {
+				copy(base[rel.Offset-3:], relaxTlsLd(i, rels, idx))
+				idx++
+			}
+		case elf.R_X86_64_DTPOFF32:
+			utils.Write(loc, uint32(S+A-dtpBase))
+		case elf.R_X86_64_DTPOFF64:
+			utils.Write(loc, S+A-dtpBase)
+		case elf.R_X86_64_TPOFF32:
+			utils.Write(loc, uint32(S+A-ctx.TpAddr))
+		case elf.R_X86_64_TPOFF64:
+			utils.Write(loc, S+A-ctx.TpAddr)
+		default:
+			utils.Fatal(fmt.Sprintf("%s: %s: unsupported relocation: %v",
+				i.File.File.DisplayName(), i.Name(), elf.R_X86_64(rel.Type)))
+		}
+	}
+}
+
+func (t *TargetX86_64) ApplyRelocNonAlloc(ctx *Context, i *InputSection, base []byte) {
+	for _, rel := range i.GetRels() {
+		if rel.Type == uint32(elf.R_X86_64_NONE) {
+			continue
+		}
+
+		sym := i.File.Symbols[rel.Sym]
+		loc := base[rel.Offset:]
+
+		if sym.File == nil {
+			continue
+		}
+
+		S, A := i.GetSymAddrAndAddend(rel)
+
+		switch elf.R_X86_64(rel.Type) {
+		case elf.R_X86_64_32, elf.R_X86_64_64:
+			if tombstone, ok := i.GetTombstone(rel); ok {
+				S, A = tombstone, 0
+			}
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		case elf.R_X86_64_DTPOFF32:
+			utils.Write(loc, uint32(S+A-ctx.TlsBegin))
+		case elf.R_X86_64_DTPOFF64:
+			utils.Write(loc, S+A-ctx.TlsBegin)
+		default:
+			t.ApplyDataReloc(loc, rel.Type, S, A, 0)
+		}
+	}
+}
+
+func (t *TargetX86_64) ApplyDataReloc(loc []byte, typ uint32, S, A, P uint64) {
+	val := S + A
+
+	switch elf.R_X86_64(typ) {
+	case elf.R_X86_64_NONE:
+	case elf.R_X86_64_32, elf.R_X86_64_32S:
+		utils.Write(loc, uint32(val))
+	case elf.R_X86_64_64:
+		utils.Write(loc, val)
+	case elf.R_X86_64_PC32:
+		utils.Write(loc, uint32(val-P))
+	case elf.R_X86_64_PC64:
+		utils.Write(loc, val-P)
+	default:
+		utils.Fatal(fmt.Sprintf("unsupported relocation in data section: %v", elf.R_X86_64(typ)))
+	}
+}
+
+func (t *TargetX86_64) DynamicLinker(ctx *Context) string {
+	return "/lib64/ld-linux-x86-64.so.2"
+}
+
+func (t *TargetX86_64) DynRelocs() DynRelocTypes {
+	return DynRelocTypes{
+		Abs:       uint32(elf.R_X86_64_64),
+		Relative:  uint32(elf.R_X86_64_RELATIVE),
+		GlobDat:   uint32(elf.R_X86_64_GLOB_DAT),
+		JumpSlot:  uint32(elf.R_X86_64_JMP_SLOT),
+		Copy:      uint32(elf.R_X86_64_COPY),
+		TpOff:     uint32(elf.R_X86_64_TPOFF64),
+		DtpMod:    uint32(elf.R_X86_64_DTPMOD64),
+		DtpOff:    uint32(elf.R_X86_64_DTPOFF64),
+		IRelative: uint32(elf.R_X86_64_IRELATIVE),
+	}
+}
+
+func (t *TargetX86_64) PltHeaderSize() uint64 {
+	return 16
+}
+
+func (t *TargetX86_64) PltEntrySize() uint64 {
+	return 16
+}
+
+// GotPltHeaderSize covers .got.plt[0], which holds the address of
+// .dynamic, and two words filled in by the dynamic linker.
+func (t *TargetX86_64) GotPltHeaderSize(ctx *Context) uint64 {
+	return 24
+}
+
+func (t *TargetX86_64) WritePltHeader(ctx *Context, buf []byte) {
+	plt := ctx.Plt.Shdr.Addr
+	gotplt := ctx.GotPlt.Shdr.Addr
+
+	copy(buf, []byte{
+		0xff, 0x35, 0, 0, 0, 0, // push GOTPLT+8(%rip)
+		0xff, 0x25, 0, 0, 0, 0, // jmp *GOTPLT+16(%rip)
+		0x0f, 0x1f, 0x40, 0x00, // nop
+	})
+	utils.Write(buf[2:], uint32(gotplt+8-plt-6))
+	utils.Write(buf[8:], uint32(gotplt+16-plt-12))
+}
+
+func (t *TargetX86_64) WritePltEntry(ctx *Context, buf []byte, sym *Symbol) {
+	ent := sym.GetPltAddr(ctx)
+
+	copy(buf, []byte{
+		0xff, 0x25, 0, 0, 0, 0, // jmp *foo@GOTPLT(%rip)
+		0x68, 0, 0, 0, 0, // push $index
+		0xe9, 0, 0, 0, 0, // jmp PLT[0]
+	})
+	utils.Write(buf[2:], uint32(sym.GetGotPltAddr(ctx)-ent-6))
+	utils.Write(buf[7:], uint32(sym.PltIdx))
+	utils.Write(buf[12:], uint32(ctx.Plt.Shdr.Addr-ent-16))
+}
+
+// GotPltEntry points to the push instruction of the PLT entry, so the
+// first call falls through to the resolver.
+func (t *TargetX86_64) GotPltEntry(ctx *Context, sym *Symbol) uint64 {
+	return sym.GetPltAddr(ctx) + 6
+}
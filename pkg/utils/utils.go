@@ -10,12 +10,27 @@ import (
 	"strings"
 )
 
+var fatalHooks []func()
+
+// AtFatal registers a function to be run before Fatal exits, such as
+// removing a temporary output file.
+func AtFatal(fn func()) {
+	fatalHooks = append(fatalHooks, fn)
+}
+
 func Fatal(v any) {
 	fmt.Printf("rvld:\n\t\033[0;1;31mfatal\033[0m: %v\n", v)
 	debug.PrintStack()
+	for _, fn := range fatalHooks {
+		fn()
+	}
 	os.Exit(1)
 }
 
+func Warn(v any) {
+	fmt.Printf("rvld:\n\t\033[0;1;35mwarning\033[0m: %v\n", v)
+}
+
 func MustNo(err error) {
 	if err != nil {
 		Fatal(err.Error())
@@ -123,3 +138,41 @@ func Bits[T Uint](val T, hi T, lo T) T {
 func SignExtend(val uint64, size int) uint64 {
 	return uint64(int64(val<<(63-size)) >> (63 - size))
 }
+
+func ReadUleb(data []byte) (uint64, int) {
+	val := uint64(0)
+	shift := 0
+	for i, b := range data {
+		val |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return val, i + 1
+		}
+		shift += 7
+	}
+	Fatal("unterminated ULEB128")
+	return 0, 0
+}
+
+func AppendUleb(buf []byte, val uint64) []byte {
+	for {
+		b := byte(val & 0x7f)
+		val >>= 7
+		if val == 0 {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
+
+// OverwriteUleb encodes val into the ULEB128 already at data, keeping
+// its length by padding with continuation bytes.
+func OverwriteUleb(data []byte, val uint64) {
+	for i := range data {
+		if data[i]&0x80 == 0 {
+			data[i] = byte(val & 0x7f)
+			return
+		}
+		data[i] = byte(val&0x7f) | 0x80
+		val >>= 7
+	}
+}
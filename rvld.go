@@ -1,6 +1,7 @@
 package main
 
 import (
+	"debug/elf"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -30,38 +31,79 @@ func main() {
 		}
 	}
 
-	if ctx.Args.Emulation != linker.MachineTypeRISCV64 {
+	ctx.Target = linker.GetTarget(ctx.Args.Emulation)
+	if ctx.Target == nil {
 		utils.Fatal("unknown emulation type.")
 	}
 
 	// Initialization
 	linker.ReadInputFiles(ctx, remaining)
+	if !ctx.Args.Relocatable {
+		linker.CreateInternalFile(ctx)
+	}
 	linker.ResolveSymbols(ctx)
+	// Incompatible inputs are rejected before any output is created.
+	ctx.EFlags = ctx.Target.MergeFlags(ctx)
+	if ctx.Args.GcSections && !ctx.Args.Relocatable {
+		linker.GcSections(ctx)
+	}
+	if ctx.Args.StripDebug {
+		linker.StripDebugSections(ctx)
+	}
 	linker.RegisterSetionPieces(ctx)
 	linker.ComputeMergedSectionSizes(ctx)
+	if ctx.Args.Icf != "" && !ctx.Args.Relocatable {
+		linker.IcfSections(ctx)
+	}
 	linker.CreateSyntheticSections(ctx)
 	linker.BinSections(ctx)
 	ctx.Chunks = append(ctx.Chunks, linker.CollectOutputSections(ctx)...)
-	linker.ScanRelocations(ctx)
+	if ctx.Args.Relocatable {
+		linker.CreateRelocSections(ctx)
+	} else {
+		linker.ScanRelocations(ctx)
+	}
 	linker.ComputeSectionsSize(ctx)
 	linker.SortOutputSections(ctx)
+	linker.AssignSectionIndices(ctx)
 
 	for _, chunk := range ctx.Chunks {
 		chunk.UpdateShdr(ctx)
 	}
 
 	fileSize := linker.SetOutputSectionOffsets(ctx)
-	ctx.Buf = make([]byte, fileSize)
+	if !ctx.Args.Relocatable {
+		if ctx.Target.CreateThunks(ctx) {
+			fileSize = linker.SetOutputSectionOffsets(ctx)
+		}
+		linker.FixSyntheticSymbols(ctx)
+	}
 
-	file, err := os.OpenFile(ctx.Args.Output, os.O_RDWR|os.O_CREATE, 0777)
-	utils.MustNo(err)
+	if ctx.Args.CompressDebugSections != 0 {
+		fileSize = linker.CompressDebugSections(ctx)
+	}
+
+	if ctx.Args.MapFile != "" || ctx.Args.PrintMap {
+		linker.PrintMap(ctx)
+	}
+
+	// Object files are not executable.
+	perm := os.FileMode(0777)
+	if ctx.Args.Relocatable {
+		perm = 0666
+	}
+	file := linker.OpenOutputFile(ctx.Args.Output, fileSize, perm)
+	ctx.Buf = file.Buf
 
 	for _, chunk := range ctx.Chunks {
 		chunk.CopyBuf(ctx)
 	}
 
-	_, err = file.Write(ctx.Buf)
-	utils.MustNo(err)
+	if ctx.BuildId != nil {
+		ctx.BuildId.WriteBuildId(ctx)
+	}
+
+	file.Close()
 
 	// Clean path
 	for i, path := range ctx.Args.LibraryPaths {
@@ -117,48 +159,173 @@ func ParseArgs(ctx *linker.Context) []string {
 		return false
 	}
 
+	// Options that take a joined argument, such as -lfoo, are tried
+	// last, so that -export-dynamic is not taken for -e xport-dynamic.
 	remaining := make([]string, 0)
-	for len(args) > 0 {
-		// --help
-		if readFlag("help") {
-			fmt.Printf("usage: %s [options] file...\n", os.Args[0])
-			os.Exit(0)
-		} else if readFlag("v") || readFlag("version") {
-			fmt.Printf("rvld %s\n", version)
-			os.Exit(0)
-		}
-
-		if readArg("o") || readArg("output") {
-			ctx.Args.Output = arg
-		} else if readArg("m") {
-			if arg == "elf64lriscv" {
-				ctx.Args.Emulation = linker.MachineTypeRISCV64
-			} else {
-				utils.Fatal(fmt.Sprintf("unknown -m argument: %s", arg))
+	readOption := func() bool {
+		if readFlag("gc-sections") {
+			ctx.Args.GcSections = true
+		} else if readFlag("no-gc-sections") {
+			ctx.Args.GcSections = false
+		} else if readFlag("print-gc-sections") {
+			ctx.Args.PrintGcSections = true
+		} else if readFlag("no-print-gc-sections") {
+			ctx.Args.PrintGcSections = false
+		} else if readArg("icf") {
+			switch arg {
+			case "all", "safe":
+				ctx.Args.Icf = arg
+			case "none":
+				ctx.Args.Icf = ""
+			default:
+				utils.Fatal(fmt.Sprintf("unknown --icf argument: %s", arg))
 			}
-		} else if readArg("L") {
-			ctx.Args.LibraryPaths = append(ctx.Args.LibraryPaths, arg)
-		} else if readArg("l") {
-			remaining = append(remaining, "-l"+arg)
+		} else if readFlag("print-icf-sections") {
+			ctx.Args.PrintIcfSections = true
+		} else if readFlag("no-print-icf-sections") {
+			ctx.Args.PrintIcfSections = false
+		} else if readFlag("build-id") {
+			ctx.Args.BuildId = linker.BuildIdSha1
+		} else if readArg("build-id") {
+			linker.ParseBuildId(ctx, arg)
+		} else if readArg("Map") {
+			ctx.Args.MapFile = arg
+		} else if readFlag("M") || readFlag("print-map") {
+			ctx.Args.PrintMap = true
+		} else if readArg("map-format") {
+			if arg != "text" && arg != "json" {
+				utils.Fatal(fmt.Sprintf("unknown --map-format argument: %s", arg))
+			}
+			ctx.Args.MapFormat = arg
+		} else if readFlag("s") || readFlag("strip-all") {
+			ctx.Args.StripAll = true
+			ctx.Args.StripDebug = true
+		} else if readFlag("S") || readFlag("strip-debug") {
+			ctx.Args.StripDebug = true
+		} else if readFlag("x") || readFlag("discard-all") {
+			ctx.Args.DiscardAll = true
+		} else if readFlag("X") || readFlag("discard-locals") {
+			ctx.Args.DiscardLocals = true
+		} else if readArg("retain-symbols-file") {
+			linker.ReadRetainSymbolsFile(ctx, arg)
+		} else if readFlag("eh-frame-hdr") {
+			ctx.Args.EhFrameHdr = true
+		} else if readFlag("no-eh-frame-hdr") {
+			ctx.Args.EhFrameHdr = false
+		} else if readArg("compress-debug-sections") {
+			switch arg {
+			case "none":
+				ctx.Args.CompressDebugSections = 0
+			case "zlib", "zlib-gabi":
+				ctx.Args.CompressDebugSections = elf.COMPRESS_ZLIB
+			default:
+				utils.Fatal(fmt.Sprintf("unsupported --compress-debug-sections argument: %s", arg))
+			}
+		} else if readFlag("no-dynamic-linker") {
+			ctx.Args.NoDynamicLinker = true
+		} else if readFlag("static") {
+			ctx.Args.Static = true
+		} else if readFlag("pie") || readFlag("pic-executable") {
+			ctx.Args.Pie = true
+		} else if readFlag("no-pie") || readFlag("no-pic-executable") {
+			ctx.Args.Pie = false
+		} else if readFlag("r") || readFlag("relocatable") {
+			ctx.Args.Relocatable = true
+		} else if readFlag("static-pie") {
+			ctx.Args.Static = true
+			ctx.Args.Pie = true
+		} else if readFlag("shared") || readFlag("Bshareable") {
+			ctx.Args.Shared = true
+		} else if readFlag("E") || readFlag("export-dynamic") {
+			ctx.Args.ExportDynamic = true
+		} else if readFlag("no-export-dynamic") {
+			ctx.Args.ExportDynamic = false
+		} else if readFlag("as-needed") {
+			remaining = append(remaining, "--as-needed")
+		} else if readFlag("no-as-needed") {
+			remaining = append(remaining, "--no-as-needed")
+		} else if readFlag("push-state") {
+			remaining = append(remaining, "--push-state")
+		} else if readFlag("pop-state") {
+			remaining = append(remaining, "--pop-state")
 		} else if readArg("sysroot") ||
-			readFlag("static") ||
 			readArg("plugin") ||
 			readArg("plugin-opt") ||
-			readFlag("as-needed") ||
 			readFlag("start-group") ||
 			readFlag("end-group") ||
 			readArg("hash-style") ||
-			readArg("build-id") ||
-			readFlag("s") ||
 			readFlag("no-relax") {
 			// Ignored
-		} else {
-			if args[0][0] == '-' {
-				utils.Fatal(fmt.Sprintf("unknown command line option: %s", args[0]))
+		} else if readArg("output") || readArg("o") {
+			ctx.Args.Output = arg
+		} else if readArg("m") {
+			switch arg {
+			case "elf64lriscv":
+				ctx.Args.Emulation = linker.MachineTypeRISCV64
+			case "elf32lriscv":
+				ctx.Args.Emulation = linker.MachineTypeRISCV32
+			case "elf_x86_64":
+				ctx.Args.Emulation = linker.MachineTypeX86_64
+			case "aarch64linux":
+				ctx.Args.Emulation = linker.MachineTypeARM64
+			default:
+				utils.Fatal(fmt.Sprintf("unknown -m argument: %s", arg))
 			}
-			remaining = append(remaining, args[0])
-			args = args[1:]
+		} else if readArg("script") || readArg("T") {
+			ctx.Script = linker.ParseLinkerScript(ctx, arg)
+		} else if readArg("entry") || readArg("e") {
+			ctx.Args.Entry = arg
+		} else if readArg("undefined") || readArg("u") {
+			ctx.Args.Undefined = append(ctx.Args.Undefined, arg)
+		} else if readArg("dynamic-linker") || readArg("I") {
+			ctx.Args.DynamicLinker = arg
+			ctx.Args.NoDynamicLinker = false
+		} else if readArg("soname") || readArg("h") {
+			ctx.Args.Soname = arg
+		} else if readArg("L") {
+			ctx.Args.LibraryPaths = append(ctx.Args.LibraryPaths, arg)
+		} else if readArg("l") {
+			remaining = append(remaining, "-l"+arg)
+		} else if readArg("z") {
+			switch arg {
+			case "now":
+				ctx.Args.ZNow = true
+			case "lazy":
+				ctx.Args.ZNow = false
+			case "execstack":
+				ctx.Args.ZExecStack = true
+			case "noexecstack":
+				ctx.Args.ZExecStack = false
+			case "text", "notext", "relro", "norelro", "separate-code", "noseparate-code":
+				// Ignored
+			default:
+				utils.Warn(fmt.Sprintf("-z %s ignored", arg))
+			}
+		} else {
+			return false
+		}
+		return true
+	}
+
+	for len(args) > 0 {
+		// --help
+		if readFlag("help") {
+			fmt.Printf("usage: %s [options] file...\n", os.Args[0])
+			os.Exit(0)
+		} else if readFlag("v") || readFlag("version") {
+			fmt.Printf("rvld %s\n", version)
+			os.Exit(0)
+		}
+
+		if readOption() {
+			continue
+		}
+
+		if args[0][0] == '-' {
+			utils.Fatal(fmt.Sprintf("unknown command line option: %s", args[0]))
 		}
+		remaining = append(remaining, args[0])
+		args = args[1:]
 	}
 
 	return remaining
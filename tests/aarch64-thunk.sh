@@ -0,0 +1,63 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+AARCH64_CC=${AARCH64_CC:-aarch64-linux-gnu-gcc}
+if ! command -v "$AARCH64_CC" > /dev/null; then
+    echo "skipped: $AARCH64_CC not found"
+    exit 0
+fi
+OBJDUMP=${OBJDUMP:-${AARCH64_CC%gcc}objdump}
+
+mkdir -p "$path_name"
+
+cat <<EOF | $AARCH64_CC -o "$path_name"/a.o -c -xassembler -
+.globl _start
+_start:
+    bl far
+    mov x8, #93
+    svc #0
+EOF
+
+# far is more than 128MiB away, out of the range of bl.
+cat <<EOF | $AARCH64_CC -o "$path_name"/b.o -c -xassembler -
+.text
+.skip 0x8000000
+.globl far
+far:
+    mov x0, #42
+    ret
+EOF
+
+./ld "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+readelf -h "$path_name"/out | grep -q 'Machine: *AArch64'
+
+# The call goes through a thunk, which branches with br.
+start=$(nm "$path_name"/out | awk '$3 == "_start" { print $1 }')
+far=$(nm "$path_name"/out | awk '$3 == "far" { print $1 }')
+$OBJDUMP -d --start-address=0x$start --stop-address=$((0x$start + 4)) "$path_name"/out > "$path_name"/dis
+if grep -q "bl.*<far>" "$path_name"/dis; then
+    exit 1
+fi
+$OBJDUMP -d --start-address=0x$start --stop-address=$((0x$far)) "$path_name"/out | grep -q 'br.*x16'
+
+if command -v qemu-aarch64 > /dev/null; then
+    status=0
+    qemu-aarch64 "$path_name"/out || status=$?
+    [ $status = 42 ]
+fi
+
+# Thunks would move sections that a linker script has placed.
+cat <<EOF > "$path_name"/script
+SECTIONS {
+  . = 0x400000;
+  .text : { *(.text) }
+}
+EOF
+
+if ./ld -T "$path_name"/script "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out2 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'not supported with a SECTIONS command' "$path_name"/log
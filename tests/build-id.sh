@@ -0,0 +1,49 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+int main() {
+    printf("Hello World!\n");
+    return 0;
+}
+EOF
+
+build_id() {
+    readelf -n "$1" | sed -n 's/.*Build ID: //p'
+}
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+[ "$(build_id "$path_name"/out | wc -c)" = 41 ]
+
+# The same inputs give the same ID.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,--build-id=sha1
+[ "$(build_id "$path_name"/out)" = "$(build_id "$path_name"/out2)" ]
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id=md5
+[ "$(build_id "$path_name"/out | wc -c)" = 33 ]
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id=fast
+[ "$(build_id "$path_name"/out | wc -c)" = 17 ]
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id=uuid
+build_id "$path_name"/out | grep -q '^............4...[89ab]...............$'
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id=0xdeadBEEF
+[ "$(build_id "$path_name"/out)" = deadbeef ]
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--build-id=none
+[ -z "$(build_id "$path_name"/out)" ]
+
+if ./ld --build-id=0xzz "$path_name"/a.o -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'invalid --build-id argument' "$path_name"/log
@@ -0,0 +1,38 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+# Enough debug info for compression to pay off.
+{
+    echo '#include <stdio.h>'
+    for i in $(seq 200); do
+        echo "int func$i(int x) { return x + $i; }"
+    done
+    echo 'int main() { printf("Hello World!\n"); return 0; }'
+} | $CC -o "$path_name"/a.o -c -xc -g -
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--compress-debug-sections=zlib
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+# Debug sections are compressed, and readelf can still read them.
+readelf -SW "$path_name"/out | grep -q '\.debug_info .* C '
+readelf -t "$path_name"/out | grep -q ZLIB
+if readelf -SW "$path_name"/out | grep -q '\.text .* C '; then
+    exit 1
+fi
+readelf --debug-dump=info "$path_name"/out | grep -q 'DW_AT_name *:.* main$'
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,--compress-debug-sections=none
+if readelf -SW "$path_name"/out2 | grep -q '\.debug_info .* C '; then
+    exit 1
+fi
+[ "$(stat -c %s "$path_name"/out)" -lt "$(stat -c %s "$path_name"/out2)" ]
+
+if ./ld --compress-debug-sections=lzma "$path_name"/a.o -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'unsupported --compress-debug-sections argument: lzma' "$path_name"/log
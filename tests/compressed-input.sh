@@ -0,0 +1,76 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+AR=${AR:-${CC%gcc}ar}
+OBJCOPY=${OBJCOPY:-${CC%gcc}objcopy}
+
+rm -rf "$path_name"
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -g -gz=zlib -
+#include <stdio.h>
+
+int main() {
+    printf("Hello World!\n");
+    return 0;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -g -gz=zlib -
+int unused(void) {
+    return 42;
+}
+EOF
+
+readelf -SW "$path_name"/a.o | grep -q '\.debug_info .* C '
+
+# Debug info is decompressed and written out as is.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+if readelf -SW "$path_name"/out | grep -q '\.debug_info .* C '; then
+    exit 1
+fi
+readelf --debug-dump=info "$path_name"/out | grep -q 'DW_AT_name *:.* main$'
+
+# Sets the compression type of .debug_info in an object file.
+set_compression_type() {
+    off=$(readelf -SW "$1" | sed -n 's/^ *\[ *[0-9]*\] //p' | awk '$1 == ".debug_info" { print $4 }')
+    printf "\\x$2" | dd of="$1" bs=1 seek=$((0x$off)) conv=notrunc status=none
+}
+
+cp "$path_name"/b.o "$path_name"/fake-zstd.o
+set_compression_type "$path_name"/fake-zstd.o 02
+cp "$path_name"/b.o "$path_name"/bad.o
+set_compression_type "$path_name"/bad.o 7f
+rm -f "$path_name"/libfake.a "$path_name"/libbad.a
+$AR crs "$path_name"/libfake.a "$path_name"/fake-zstd.o
+$AR crs "$path_name"/libbad.a "$path_name"/bad.o
+
+# Archive members that are not loaded are not decompressed.
+$CC -B. -static "$path_name"/a.o "$path_name"/libfake.a "$path_name"/libbad.a \
+    -o "$path_name"/out > "$path_name"/log 2>&1
+if grep -q 'zstd\|compression\|uncompress' "$path_name"/log; then
+    exit 1
+fi
+
+if $CC -B. -static "$path_name"/a.o "$path_name"/libfake.a -Wl,-u,unused \
+    -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'fake-zstd.o): .debug_info: ' "$path_name"/log
+
+if $CC -B. -static "$path_name"/a.o "$path_name"/libbad.a -Wl,-u,unused \
+    -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'bad.o): .debug_info: unsupported compression type: 0x7f' "$path_name"/log
+
+# zstd is decompressed as well, if objcopy can compress with it.
+if $OBJCOPY --compress-debug-sections=zstd "$path_name"/b.o "$path_name"/zstd.o 2> /dev/null; then
+    $CC -B. -static "$path_name"/a.o "$path_name"/zstd.o -o "$path_name"/out
+    qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+    readelf --debug-dump=info "$path_name"/out | grep -q 'DW_AT_name *:.* unused$'
+fi
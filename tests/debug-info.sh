@@ -0,0 +1,37 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -g -
+#include <stdio.h>
+
+void hello() {
+    printf("Hello World!\n");
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -g -
+void hello();
+
+int main() {
+    hello();
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+# DW_AT_low_pc of each function points to the function in the output.
+readelf --debug-dump=info "$path_name"/out > "$path_name"/info
+for func in hello main; do
+    addr=$(nm "$path_name"/out | awk -v f=$func '$3 == f { print $1 }' | sed 's/^0*//')
+    grep -A6 "DW_AT_name *:.* $func\$" "$path_name"/info | grep -q "DW_AT_low_pc *: 0x0*$addr\$"
+done
+
+# Line numbers are resolved through .debug_line and .debug_str.
+readelf --debug-dump=decodedline "$path_name"/out | grep -q '^<stdin> *4 *0x'
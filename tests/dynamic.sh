@@ -0,0 +1,79 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -fno-PIC -
+#include <stdio.h>
+
+extern char **environ;
+
+__attribute__((constructor)) static void init() {
+    printf("init\n");
+}
+
+int main() {
+    printf("Hello %s\n", environ[0] ? "World!" : "");
+    fflush(stdout);
+    return 0;
+}
+EOF
+
+$CC -B. -no-pie "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out > "$path_name"/log
+grep -q '^init$' "$path_name"/log
+grep -q '^Hello World!$' "$path_name"/log
+
+readelf -lW "$path_name"/out | grep -q 'Requesting program interpreter'
+readelf -d "$path_name"/out > "$path_name"/dynamic
+grep -q 'NEEDED.*libc.so.6' "$path_name"/dynamic
+grep -q 'INIT_ARRAY' "$path_name"/dynamic
+
+# A function is called through the PLT, and a variable that the
+# executable refers to directly is copied into it.
+readelf -rW "$path_name"/out > "$path_name"/relocs
+grep -q 'JUMP_SLOT.* printf' "$path_name"/relocs
+grep -q 'COPY.* environ' "$path_name"/relocs
+
+# With --export-dynamic, a plugin can use what the executable defines.
+cat <<EOF | $CC -o "$path_name"/plugin.o -c -xc -fPIC -
+int host_value(void);
+
+int plugin(void) {
+    return host_value() * 2;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -
+#include <dlfcn.h>
+#include <stdio.h>
+
+int host_value(void) {
+    return 21;
+}
+
+int main(int argc, char **argv) {
+    void *handle = dlopen(argv[1], RTLD_NOW);
+    if (!handle) {
+        printf("%s\n", dlerror());
+        return 1;
+    }
+    int (*plugin)(void) = (int (*)(void))dlsym(handle, "plugin");
+    printf("%d\n", plugin());
+    return 0;
+}
+EOF
+
+$CC -B. -shared "$path_name"/plugin.o -o "$path_name"/plugin.so
+$CC -B. "$path_name"/b.o -o "$path_name"/out2 -Wl,--export-dynamic
+readelf --dyn-syms -W "$path_name"/out2 | grep -q ' host_value$'
+qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out2 "$path_name"/plugin.so | grep -q '^42$'
+
+$CC -B. "$path_name"/b.o -o "$path_name"/out3
+if qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out3 "$path_name"/plugin.so > "$path_name"/log3; then
+    exit 1
+fi
+grep -q 'undefined symbol: host_value' "$path_name"/log3
@@ -0,0 +1,37 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.globl _start
+_start:
+    nop
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler - -march=rv64g -mabi=lp64d
+.globl foo
+foo:
+    nop
+EOF
+
+cat <<EOF | $CC -o "$path_name"/c.o -c -xassembler - -march=rv64gc -mabi=lp64
+.globl bar
+bar:
+    nop
+EOF
+
+# RVC is set if any input uses it.
+./ld "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+readelf -h "$path_name"/out | grep -q 'Flags:.*RVC, double-float ABI'
+
+# Different float ABIs cannot be mixed, and no output is left behind.
+rm -f "$path_name"/out2
+if ./ld "$path_name"/a.o "$path_name"/c.o -o "$path_name"/out2 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'different floating-point ABI' "$path_name"/log
+[ ! -e "$path_name"/out2 ]
@@ -0,0 +1,46 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+void foo() {}
+
+int main() {
+    printf("Hello World!\n");
+    return 0;
+}
+EOF
+
+entry() {
+    readelf -h "$1" | awk '/Entry point/ { print $4 }'
+}
+
+addr() {
+    echo 0x$(nm "$1" | awk -v sym="$2" '$3 == sym { print $1 }')
+}
+
+# _start is the default entry point.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+[ $(($(entry "$path_name"/out))) = $(($(addr "$path_name"/out _start))) ]
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+# -e takes its argument as the next word, --entry also after '='.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,-e,foo
+[ $(($(entry "$path_name"/out2))) = $(($(addr "$path_name"/out2 foo))) ]
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out3 -Wl,--entry=foo
+[ $(($(entry "$path_name"/out3))) = $(($(addr "$path_name"/out3 foo))) ]
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out4 -Wl,-efoo
+[ $(($(entry "$path_name"/out4))) = $(($(addr "$path_name"/out4 foo))) ]
+
+# A long option that starts with 'e' is not an entry symbol.
+$CC -B. "$path_name"/a.o -o "$path_name"/out5 -Wl,-export-dynamic
+[ $(($(entry "$path_name"/out5))) = $(($(addr "$path_name"/out5 _start))) ]
+readelf --dyn-syms -W "$path_name"/out5 | grep -q ' foo$'
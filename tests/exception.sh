@@ -0,0 +1,44 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+CXX=${CXX:-${CC%gcc}g++}
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CXX -o "$path_name"/a.o -c -xc++ -
+#include <cstdio>
+#include <stdexcept>
+
+__attribute__((noinline)) static void fail(int n) {
+    if (n > 0)
+        throw std::runtime_error("caught");
+}
+
+int main(int argc, char **argv) {
+    try {
+        fail(argc);
+    } catch (const std::exception &e) {
+        printf("%s\n", e.what());
+        return 0;
+    }
+    return 1;
+}
+EOF
+
+$CXX -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q caught
+readelf -lW "$path_name"/out | grep -q GNU_EH_FRAME
+
+# Notes that are not loaded, such as libgcc's .note.stapsdt, must come
+# after all loaded sections.
+readelf -SW "$path_name"/out | sed -n 's/^ *\[ *[1-9][0-9]*\] //p' |
+    awk '$3 ~ /^0+$/ { nonalloc = 1 } $3 !~ /^0+$/ && nonalloc { exit 1 }'
+
+# crtend's __FRAME_END__ is the zero terminator of .eh_frame.
+frame_end=$(nm "$path_name"/out | awk '$3 == "__FRAME_END__" { print $1 }')
+eh_frame=$(readelf -SW "$path_name"/out | sed -n 's/^ *\[ *[0-9]*\] //p' |
+    awk '$1 == ".eh_frame" { print "0x" $3 " + 0x" $5 }')
+[ $((0x$frame_end)) = $(($eh_frame - 4)) ]
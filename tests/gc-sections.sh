@@ -0,0 +1,107 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -ffunction-sections -fdata-sections -
+#include <stdio.h>
+
+int used_var = 3;
+int unused_var = 4;
+
+int used_fn(void) {
+    return used_var;
+}
+
+int unused_fn(void) {
+    return unused_var;
+}
+
+int undefined_root(void) {
+    return 5;
+}
+
+__attribute__((retain, used)) int retained_fn(void) {
+    return 6;
+}
+
+// Reached only through __start_ and __stop_.
+__attribute__((section("entries"), used)) static int entry_values[] = {1, 2, 3};
+extern int __start_entries[], __stop_entries[];
+
+static int ctor_ran;
+
+__attribute__((constructor)) static void ctor(void) {
+    ctor_ran = 1;
+}
+
+int main() {
+    int sum = 0;
+    for (int *p = __start_entries; p < __stop_entries; p++)
+        sum += *p;
+    printf("%d %d %d\n", used_fn(), sum, ctor_ran);
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--gc-sections \
+    -Wl,--print-gc-sections -Wl,-u,undefined_root 2> "$path_name"/log
+qemu-riscv64 "$path_name"/out | grep -q '^3 6 1$'
+
+grep -q "removing unused section '.text.unused_fn' in file '$path_name/a.o'" "$path_name"/log
+grep -q "removing unused section '.data.unused_var' in file '$path_name/a.o'" "$path_name"/log
+for sec in used_fn used_var undefined_root retained_fn; do
+    if grep -q "'.*\.$sec'" "$path_name"/log; then
+        exit 1
+    fi
+done
+if grep -q "'entries'" "$path_name"/log; then
+    exit 1
+fi
+
+nm "$path_name"/out > "$path_name"/syms
+grep -q ' used_fn$' "$path_name"/syms
+grep -q ' undefined_root$' "$path_name"/syms
+grep -q ' retained_fn$' "$path_name"/syms
+if grep -q ' unused_fn$' "$path_name"/syms; then
+    exit 1
+fi
+
+# Without --gc-sections, everything stays.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,--print-gc-sections 2> "$path_name"/log2
+if [ -s "$path_name"/log2 ]; then
+    exit 1
+fi
+nm "$path_name"/out2 | grep -q ' unused_fn$'
+
+# KEEP in a linker script is a root too.
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler -
+.globl _start
+.section .text._start,"ax"
+_start:
+    nop
+.section .text.kept,"ax"
+kept:
+    nop
+.section .text.dropped,"ax"
+dropped:
+    nop
+EOF
+
+cat <<EOF > "$path_name"/script
+SECTIONS {
+  . = 0x10000;
+  .text : { *(.text._start) KEEP(*(.text.kept)) *(.text.*) }
+}
+EOF
+
+./ld -T "$path_name"/script "$path_name"/b.o -o "$path_name"/out3 --gc-sections \
+    --print-gc-sections 2> "$path_name"/log3
+grep -q "removing unused section '.text.dropped'" "$path_name"/log3
+if grep -q "'.text.kept'" "$path_name"/log3; then
+    exit 1
+fi
+nm "$path_name"/out3 | grep -q ' kept$'
@@ -0,0 +1,73 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"/lib
+
+cat <<EOF | $CC -o "$path_name"/foo.o -c -xc -
+int bar(void);
+
+int foo(void) {
+    return bar() + 1;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/bar.o -c -xc -fPIC -
+int bar(void) {
+    return 41;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/unused.o -c -xc -fPIC -
+int unused(void) {
+    return 0;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/main.o -c -xc -
+#include <stdio.h>
+
+int foo(void);
+
+int main() {
+    printf("%d\n", foo());
+    return 0;
+}
+EOF
+
+rm -f "$path_name"/libfoo.a
+ar rcs "$path_name"/libfoo.a "$path_name"/foo.o
+$CC -B. -shared "$path_name"/bar.o -o "$path_name"/lib/libbar.so -Wl,-soname,libbar.so
+$CC -B. -shared "$path_name"/unused.o -o "$path_name"/lib/libunused.so -Wl,-soname,libunused.so
+
+# Like glibc's libc.so, the script names the files to link in its place.
+# Relative paths are looked up next to it, and -l in SEARCH_DIR.
+cat <<EOF > "$path_name"/libgroup.so
+/* GNU ld script */
+OUTPUT_FORMAT(elf64-littleriscv)
+SEARCH_DIR("$path_name/lib")
+GROUP ( libfoo.a AS_NEEDED ( -lbar -lunused ) )
+EOF
+
+$CC -B. "$path_name"/main.o -o "$path_name"/out -L"$path_name" -lgroup
+readelf -d "$path_name"/out > "$path_name"/dynamic
+grep -q 'NEEDED.*\[libbar.so\]' "$path_name"/dynamic
+# Libraries in AS_NEEDED are only needed if they define a used symbol.
+if grep -q 'NEEDED.*\[libunused.so\]' "$path_name"/dynamic; then
+    exit 1
+fi
+LD_LIBRARY_PATH="$path_name"/lib qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out | grep -q '^42$'
+
+# INPUT is the same as GROUP.
+echo "INPUT($path_name/libfoo.a -lbar)" > "$path_name"/input.ld
+$CC -B. "$path_name"/main.o -o "$path_name"/out2 -L"$path_name"/lib "$path_name"/input.ld
+readelf -d "$path_name"/out2 | grep -q 'NEEDED.*\[libbar.so\]'
+
+# Unknown commands are errors, not silently skipped.
+echo 'GROUP(libfoo.a) FOO(bar)' > "$path_name"/libbad.so
+if $CC -B. "$path_name"/main.o -o "$path_name"/out3 -L"$path_name" -lbad > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'libbad.so:1: unknown directive: FOO' "$path_name"/log
@@ -0,0 +1,89 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -ffunction-sections -fdata-sections -
+#include <stdio.h>
+
+int var1 = 1;
+int var2 = 2;
+
+int same1(int x) {
+    return x * 3 + 1;
+}
+
+int same2(int x) {
+    return x * 3 + 1;
+}
+
+int other(int x) {
+    return x * 5 + 2;
+}
+
+// The same after same1 and same2 are folded.
+int call1(int x) {
+    return same1(x) + 1;
+}
+
+int call2(int x) {
+    return same2(x) + 1;
+}
+
+// The same code, but the relocations refer to different variables.
+int *addr1(void) {
+    return &var1;
+}
+
+int *addr2(void) {
+    return &var2;
+}
+
+int main() {
+    printf("%d %d %d %d %d\n", same1(1), same2(2), other(1), call1(1), call2(2));
+    printf("%d %d\n", *addr1(), *addr2());
+    return 0;
+}
+EOF
+
+addr() {
+    grep " $2\$" "$1" | cut -d' ' -f1
+}
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--icf=all \
+    -Wl,--print-icf-sections 2> "$path_name"/log
+qemu-riscv64 "$path_name"/out > "$path_name"/run
+grep -q '^4 7 7 5 8$' "$path_name"/run
+grep -q '^1 2$' "$path_name"/run
+
+grep -q "selected section '.text.same1' in file '$path_name/a.o'" "$path_name"/log
+grep -q "  removing identical section '.text.same2' in file '$path_name/a.o'" "$path_name"/log
+grep -q "  removing identical section '.text.call2' in file '$path_name/a.o'" "$path_name"/log
+if grep -q "'.text.other'\|'.text.addr2'" "$path_name"/log; then
+    exit 1
+fi
+
+nm "$path_name"/out > "$path_name"/syms
+[ "$(addr "$path_name"/syms same1)" = "$(addr "$path_name"/syms same2)" ]
+[ "$(addr "$path_name"/syms call1)" = "$(addr "$path_name"/syms call2)" ]
+[ "$(addr "$path_name"/syms addr1)" != "$(addr "$path_name"/syms addr2)" ]
+[ "$(addr "$path_name"/syms same1)" != "$(addr "$path_name"/syms other)" ]
+
+# --icf=safe folds nothing without .llvm_addrsig, which GCC does not emit.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,--icf=safe \
+    -Wl,--print-icf-sections > "$path_name"/log2 2>&1
+grep -q -- '--icf=safe: no input file has an address-significance table' "$path_name"/log2
+if grep -q 'removing identical section' "$path_name"/log2; then
+    exit 1
+fi
+nm "$path_name"/out2 > "$path_name"/syms2
+[ "$(addr "$path_name"/syms2 same1)" != "$(addr "$path_name"/syms2 same2)" ]
+qemu-riscv64 "$path_name"/out2 | grep -q '^4 7 7 5 8$'
+
+if $CC -B. -static "$path_name"/a.o -o "$path_name"/out3 -Wl,--icf=some > "$path_name"/log3 2>&1; then
+    exit 1
+fi
+grep -q 'unknown --icf argument: some' "$path_name"/log3
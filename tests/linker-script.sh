@@ -0,0 +1,133 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xassembler -
+.globl _start, var
+.text
+_start:
+    nop
+.data
+var:
+    .quad provided
+EOF
+
+cat <<EOF > "$path_name"/script
+MEMORY {
+  ROM (rx) : ORIGIN = 0x10000, LENGTH = 64K
+  RAM (rw) : ORIGIN = 0x80000, LENGTH = 64K
+}
+
+ENTRY(_start)
+
+SECTIONS {
+  .text : { *(.text) } > ROM
+  .data : {
+    data_start = .;
+    *(.data)
+    data_end = .;
+  } > RAM AT> ROM
+  PROVIDE(provided = 0x1234);
+  PROVIDE(var = 0x5678);
+  PROVIDE(unused = 0x9abc);
+}
+
+ASSERT(data_end - data_start == 8, "unexpected .data size");
+EOF
+
+./ld -T "$path_name"/script "$path_name"/a.o -o "$path_name"/out
+nm "$path_name"/out > "$path_name"/syms
+grep -q '^0*10000 T _start$' "$path_name"/syms
+grep -q '^0*80000 . data_start$' "$path_name"/syms
+grep -q '^0*80008 . data_end$' "$path_name"/syms
+grep -q '^0*1234 A provided$' "$path_name"/syms
+# PROVIDE only defines symbols that are referenced and not defined.
+grep -q '^0*80000 D var$' "$path_name"/syms
+if grep -q ' unused$' "$path_name"/syms; then
+    exit 1
+fi
+readelf -h "$path_name"/out | grep -q 'Entry point address: *0x10000$'
+
+# AT> loads .data into ROM, right after .text.
+readelf -lW "$path_name"/out | grep -q 'LOAD .* 0x0*80000 0x0*1000[0-9a-f] '
+
+# A failed ASSERT stops the link with its message.
+sed 's/== 8/== 16/' "$path_name"/script > "$path_name"/script2
+if ./ld -T "$path_name"/script2 "$path_name"/a.o -o "$path_name"/out2 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'unexpected .data size' "$path_name"/log
+
+# Without SECTIONS, the default layout is used.
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -
+#include <stdio.h>
+
+extern char magic[];
+
+int main() {
+    printf("%lx\n", (unsigned long)magic);
+    return 0;
+}
+EOF
+
+echo 'PROVIDE(magic = 0xabcd);' > "$path_name"/magic.ld
+$CC -B. -static "$path_name"/b.o -Wl,-T,"$path_name"/magic.ld -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q '^abcd$'
+
+# A program laid out by SECTIONS runs. .rodata starts on the last page
+# of .text, which the two must share as one segment.
+cat <<EOF | $CC -o "$path_name"/c.o -c -xc -ffunction-sections -fdata-sections -
+#include <stdio.h>
+
+const char message[] = "Hello from SECTIONS";
+int counter = 3;
+int zeroed;
+int unused_var = 4;
+__attribute__((section(".keep_me"))) int kept = 5;
+__attribute__((section(".discard_me"))) int dropped = 6;
+
+int main() {
+    printf("%s %d %d\n", message, counter, zeroed);
+    return 0;
+}
+EOF
+
+cat <<EOF > "$path_name"/layout.ld
+SECTIONS {
+  .text 0x400000 + SIZEOF_HEADERS : { *(.text .text.*) }
+  .rodata : ALIGN(16) { *(.rodata .rodata.*) }
+  . = ALIGN(0x1000);
+  .data : { *(.data .data.*) KEEP(*(.keep_me)) }
+  .bss : ALIGN(64) { *(.bss .bss.* COMMON) }
+  /DISCARD/ : { *(.discard_me) }
+}
+EOF
+
+$CC -B. -static "$path_name"/c.o -Wl,-T,"$path_name"/layout.ld -Wl,--gc-sections \
+    -o "$path_name"/out3
+qemu-riscv64 "$path_name"/out3 | grep -q '^Hello from SECTIONS 3 0$'
+
+# No two segments share a page.
+last=0
+readelf -lW "$path_name"/out3 | grep ' LOAD ' | while read -r _ _ vaddr _ _ memsz _; do
+    [ $((vaddr / 4096)) -gt $last ]
+    last=$(((vaddr + memsz - 1) / 4096))
+done
+
+readelf -SW "$path_name"/out3 > "$path_name"/sections3
+grep -q ' \.data *PROGBITS *0*[0-9a-f]*000 ' "$path_name"/sections3
+grep -q ' \.bss *NOBITS *0*[0-9a-f]*[048c]0 ' "$path_name"/sections3
+if grep -q 'discard_me' "$path_name"/sections3; then
+    exit 1
+fi
+
+# KEEP keeps .keep_me from --gc-sections, which removes unused_var.
+nm "$path_name"/out3 > "$path_name"/syms3
+grep -q ' D kept$' "$path_name"/syms3
+if grep -q ' unused_var$\| dropped$' "$path_name"/syms3; then
+    exit 1
+fi
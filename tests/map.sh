@@ -0,0 +1,71 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+int counter = 3;
+
+int main() {
+    printf("Hello %d\n", counter);
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,-Map="$path_name"/map
+qemu-riscv64 "$path_name"/out | grep -q 'Hello 3'
+
+# As in GNU ld's map, input sections are listed under their output
+# sections, with the symbols they define at their final addresses.
+addr=$(nm "$path_name"/out | awk '$3 == "main" { print $1 }')
+grep -q '^Linker script and memory map$' "$path_name"/map
+grep -q "^LOAD $path_name/a.o\$" "$path_name"/map
+grep -q '^\.text  *0x[0-9a-f]\{16\}  *0x[0-9a-f]*$' "$path_name"/map
+grep -q "^ \.text  *0x[0-9a-f]\{16\}  *0x[0-9a-f]* $path_name/a.o\$" "$path_name"/map
+grep -q "^ *0x$addr  *main\$" "$path_name"/map
+grep -q ' counter$' "$path_name"/map
+grep -q 'libc\.a(.*\.o)$' "$path_name"/map
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out2 -Wl,--print-map,--map-format=json > "$path_name"/json
+grep -q '"name": "main"' "$path_name"/json
+grep -q '"chunks"' "$path_name"/json
+
+# Sections loaded apart from their addresses show both, and so do the
+# symbols that a script assigns.
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler -
+.globl _start
+.text
+_start:
+    nop
+.data
+    .quad 1
+EOF
+
+cat <<EOF > "$path_name"/script
+MEMORY {
+  ROM (rx) : ORIGIN = 0x10000, LENGTH = 64K
+  RAM (rw) : ORIGIN = 0x80000, LENGTH = 64K
+}
+
+SECTIONS {
+  .text : { *(.text) } > ROM
+  .data : { *(.data) } > RAM AT> ROM
+  _sidata = LOADADDR(.data);
+}
+EOF
+
+./ld -T "$path_name"/script "$path_name"/b.o -o "$path_name"/out3 -Map "$path_name"/map3
+grep -q '^ROM  *0x0*10000 0x0*10000 rx$' "$path_name"/map3
+lma=$(readelf -lW "$path_name"/out3 | awk '$3 == "0x0000000000080000" { print $4 }')
+grep -q "^\.data  *0x0*80000  *0x8 load address $lma\$" "$path_name"/map3
+grep -q "^ *$lma  *_sidata\$" "$path_name"/map3
+
+if ./ld --map-format=xml "$path_name"/a.o -o "$path_name"/out2 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'unknown --map-format argument' "$path_name"/log
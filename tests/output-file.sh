@@ -0,0 +1,44 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+rm -rf "$path_name"
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+int main() {
+    printf("Hello World!\n");
+    return 0;
+}
+EOF
+
+umask 022
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+[ "$(stat -c %a "$path_name"/out)" = 755 ]
+
+./ld -r "$path_name"/a.o -o "$path_name"/c.o
+[ "$(stat -c %a "$path_name"/c.o)" = 644 ]
+
+# The output is replaced, not rewritten, so a hard link to the old
+# output is left alone.
+ln "$path_name"/out "$path_name"/link
+$CC -B. -static "$path_name"/c.o -o "$path_name"/out
+[ "$(stat -c %i "$path_name"/out)" != "$(stat -c %i "$path_name"/link)" ]
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+# A failed link leaves the old output and no temporary file behind.
+cp "$path_name"/out "$path_name"/saved
+if $CC -B. -static "$path_name"/a.o -lno-such-library -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+cmp "$path_name"/out "$path_name"/saved
+[ -z "$(ls -A "$path_name" | grep '\.tmp')" ]
+
+# Special files are written in place.
+$CC -B. -static "$path_name"/a.o -o /dev/null
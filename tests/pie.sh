@@ -0,0 +1,45 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -fPIE -
+#include <stdio.h>
+
+int x = 5;
+int *p = &x;
+
+int main() {
+    printf("Hello %d\n", *p);
+    return 0;
+}
+EOF
+
+$CC -B. -pie "$path_name"/a.o -o "$path_name"/out -Wl,-z,now,-z,relro,-z,noexecstack
+qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out | grep -q '^Hello 5$'
+readelf -h "$path_name"/out | grep -q 'Type: *DYN'
+readelf -d "$path_name"/out > "$path_name"/dynamic
+grep -q 'FLAGS_1.*NOW PIE' "$path_name"/dynamic
+grep -q 'FLAGS.*BIND_NOW' "$path_name"/dynamic
+readelf -lW "$path_name"/out | grep -q 'GNU_STACK .* RW  '
+
+# A static PIE relocates itself and has no program interpreter.
+$CC -B. -static-pie "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q '^Hello 5$'
+readelf -h "$path_name"/out | grep -q 'Type: *DYN'
+readelf -lW "$path_name"/out > "$path_name"/phdrs
+grep -q DYNAMIC "$path_name"/phdrs
+if grep -q INTERP "$path_name"/phdrs; then
+    exit 1
+fi
+
+$CC -B. -no-pie "$path_name"/a.o -o "$path_name"/out -Wl,-z,execstack,-z,separate-code
+readelf -h "$path_name"/out | grep -q 'Type: *EXEC'
+readelf -lW "$path_name"/out | grep -q 'GNU_STACK .* RWE '
+
+# Unknown -z keywords are ignored with a warning.
+$CC -B. "$path_name"/a.o -o "$path_name"/out -Wl,-z,no-such-keyword > "$path_name"/log 2>&1
+grep -q -- '-z no-such-keyword ignored' "$path_name"/log
@@ -0,0 +1,74 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.section .text._start,"ax",@progbits
+.globl _start
+_start:
+    call same1
+    call same2
+    call same3
+    nop
+
+.section .llvm_addrsig,"e",@0x6fff4c03
+EOF
+
+# The table refers to same2 by its index in this file, which is only
+# known once the file is assembled.
+make_b() {
+    cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.section .text.same1,"ax",@progbits
+.globl same1
+same1:
+    addi a0, a0, 1
+    ret
+
+.section .text.same2,"ax",@progbits
+.globl same2
+same2:
+    addi a0, a0, 1
+    ret
+
+.section .text.same3,"ax",@progbits
+.globl same3
+same3:
+    addi a0, a0, 1
+    ret
+
+.section .llvm_addrsig,"e",@0x6fff4c03
+.uleb128 $1
+EOF
+}
+
+make_b 0
+idx=$(readelf -sW "$path_name"/b.o | awk '$8 == "same2" { sub(":", "", $1); print $1 }')
+make_b "$idx"
+
+# The table is rewritten against the symbol table of the output, so
+# that --icf=safe keeps same2 but folds same3 into same1.
+./ld -r "$path_name"/a.o "$path_name"/b.o -o "$path_name"/c.o
+readelf -SW "$path_name"/c.o | grep -q '\.llvm_addrsig'
+
+./ld "$path_name"/c.o -o "$path_name"/out --icf=safe --print-icf-sections \
+    > "$path_name"/log 2>&1
+grep -q "removing identical section '.text.same3'" "$path_name"/log
+if grep -q "'.text.same2'" "$path_name"/log; then
+    exit 1
+fi
+
+# Without a table for every input, none is written.
+cat <<EOF | $CC -o "$path_name"/d.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.globl foo
+foo:
+    nop
+EOF
+
+./ld -r "$path_name"/a.o "$path_name"/b.o "$path_name"/d.o -o "$path_name"/e.o
+if readelf -SW "$path_name"/e.o | grep -q '\.llvm_addrsig'; then
+    exit 1
+fi
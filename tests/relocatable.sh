@@ -0,0 +1,62 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+static int count = 1;
+
+void hello(const char *name) {
+    printf("Hello %s %d\n", name, count++);
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -O2 -
+void hello(const char *name);
+
+int main() {
+    hello("World");
+    hello("again");
+    return 0;
+}
+EOF
+
+./ld -r "$path_name"/a.o "$path_name"/b.o -o "$path_name"/c.o
+
+# The output is an object file that keeps its relocations.
+readelf -h "$path_name"/c.o | grep -q 'Type: *REL'
+readelf -SW "$path_name"/c.o | grep -q '\.rela\.text'
+readelf -lW "$path_name"/c.o | grep -q 'There are no program headers'
+nm "$path_name"/c.o > "$path_name"/syms
+grep -q ' T hello$' "$path_name"/syms
+grep -q ' T main$' "$path_name"/syms
+grep -q ' U printf$' "$path_name"/syms
+grep -q ' d count$' "$path_name"/syms
+
+# Strings stay mergeable for the final link.
+readelf -SW "$path_name"/c.o > "$path_name"/sections
+grep -q '\.rodata\.str1\.1 *PROGBITS *[0-9a-f]* [0-9a-f]* [0-9a-f]* 01 *AMS ' "$path_name"/sections
+grep -q '\.comment *PROGBITS *[0-9a-f]* [0-9a-f]* [0-9a-f]* 01 *MS ' "$path_name"/sections
+
+# It can be linked again, also with -r.
+$CC -B. -static "$path_name"/c.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out > "$path_name"/log
+grep -q '^Hello World 1$' "$path_name"/log
+grep -q '^Hello again 2$' "$path_name"/log
+
+./ld -r "$path_name"/c.o -o "$path_name"/d.o
+$CC -B. -static "$path_name"/d.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q '^Hello again 2$'
+
+# ... where they are merged with those of other files.
+cat <<EOF | $CC -o "$path_name"/e.o -c -xc -O2 -
+const char *greeting(void) { return "again"; }
+EOF
+
+$CC -B. -static "$path_name"/c.o "$path_name"/e.o -o "$path_name"/out
+[ "$(strings "$path_name"/out | grep -c '^again$')" = 1 ]
@@ -0,0 +1,66 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.attribute arch, "rv64i2p0_m2p0_a2p0_c2p0"
+.attribute stack_align, 16
+.globl _start
+_start:
+    nop
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler - -march=rv64gc -mabi=lp64d
+.attribute arch, "rv64i2p0_f2p0_d2p0"
+.attribute stack_align, 16
+.globl foo
+foo:
+    nop
+EOF
+
+# Extensions are merged, and the section gets its own segment.
+./ld "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+readelf -A "$path_name"/out | grep -q 'Tag_RISCV_arch: "rv64i2p0_m2p0_a2p0_f2p0_d2p0_c2p0"'
+readelf -lW "$path_name"/out | grep -q RISCV_ATTRIBUT
+
+# Written by hand, as older assemblers did: versions are missing.
+cat <<EOF | $CC -o "$path_name"/c.o -c -xassembler - -march=rv64gc -mabi=lp64d -Wa,-mno-arch-attr
+.section .riscv.attributes, "", @0x70000003
+.byte 'A'
+.4byte 25
+.asciz "riscv"
+.byte 1
+.4byte 15
+.byte 5
+.asciz "rv64imac"
+EOF
+
+# Missing versions take their defaults instead of 0p0.
+./ld "$path_name"/a.o "$path_name"/c.o -o "$path_name"/out
+readelf -A "$path_name"/out | grep -q 'Tag_RISCV_arch: "rv64i2p1_m2p0_a2p1_c2p0"'
+
+# A length past the end of the section is an error, not a crash.
+cat <<EOF | $CC -o "$path_name"/d.o -c -xassembler - -march=rv64gc -mabi=lp64d -Wa,-mno-arch-attr
+.section .riscv.attributes, "", @0x70000003
+.byte 'A'
+.4byte 100
+.asciz "riscv"
+.byte 1
+EOF
+
+if ./ld "$path_name"/a.o "$path_name"/d.o -o "$path_name"/out > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'd.o: corrupted .riscv.attributes section' "$path_name"/log
+if grep -q '^panic:' "$path_name"/log; then
+    exit 1
+fi
+
+# Only the files that are linked are checked, not all archive members.
+rm -f "$path_name"/libd.a
+ar rcs "$path_name"/libd.a "$path_name"/d.o
+./ld "$path_name"/a.o "$path_name"/libd.a -o "$path_name"/out
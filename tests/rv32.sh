@@ -0,0 +1,54 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xassembler - -march=rv32imac -mabi=ilp32
+.globl _start
+_start:
+    call get_status
+    li a7, 93
+    ecall
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler - -march=rv32imac -mabi=ilp32
+.globl get_status
+get_status:
+    lui a0, %hi(status)
+    lw a0, %lo(status)(a0)
+    ret
+
+.data
+status:
+    .word 42
+EOF
+
+./ld "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+
+readelf -h "$path_name"/out > "$path_name"/header
+grep -q 'Class: *ELF32' "$path_name"/header
+grep -q 'Machine: *RISC-V' "$path_name"/header
+grep -q 'Flags:.*RVC, soft-float ABI' "$path_name"/header
+readelf -lW "$path_name"/out | grep -q LOAD
+nm "$path_name"/out | grep -q '^[0-9a-f]\{8\} T get_status$'
+
+# 32-bit and 64-bit objects cannot be mixed.
+cat <<EOF | $CC -o "$path_name"/c.o -c -xassembler - -march=rv64imac -mabi=lp64
+.globl foo
+foo:
+    ret
+EOF
+
+if ./ld "$path_name"/a.o "$path_name"/c.o -o "$path_name"/out2 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q 'incompatible file type' "$path_name"/log
+
+if command -v qemu-riscv32 > /dev/null; then
+    status=0
+    qemu-riscv32 "$path_name"/out || status=$?
+    [ $status = 42 ]
+fi
@@ -0,0 +1,70 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -fPIC -
+#include <stdio.h>
+
+int counter = 5;
+static __thread int calls;
+
+__attribute__((visibility("hidden"))) int hidden_add(int x) {
+    return x + counter;
+}
+
+int add(int x) {
+    calls++;
+    return hidden_add(x);
+}
+
+int get_calls(void) {
+    return calls;
+}
+
+void hello(void) {
+    printf("Hello from the library\n");
+}
+
+void (*get_hello(void))(void) {
+    return hello;
+}
+EOF
+
+cat <<EOF | $CC -o "$path_name"/b.o -c -xc -fPIC -
+#include <stdio.h>
+
+int add(int x);
+int get_calls(void);
+void hello(void);
+void (*get_hello(void))(void);
+extern int counter;
+
+int main() {
+    counter = 10;
+    int sum = add(1);
+    printf("%d %d %d\n", sum, get_calls(), get_hello() == hello);
+    hello();
+    return 0;
+}
+EOF
+
+$CC -B. -shared "$path_name"/a.o -o "$path_name"/libfoo.so -Wl,-soname,libfoo.so
+readelf -h "$path_name"/libfoo.so | grep -q 'Type: *DYN'
+readelf -d "$path_name"/libfoo.so | grep -q 'SONAME.*\[libfoo.so\]'
+
+# Hidden symbols are not exported.
+readelf --dyn-syms -W "$path_name"/libfoo.so > "$path_name"/dynsym
+grep -q ' add$' "$path_name"/dynsym
+if grep -q ' hidden_add$' "$path_name"/dynsym; then
+    exit 1
+fi
+
+$CC -B. "$path_name"/b.o -o "$path_name"/out "$path_name"/libfoo.so
+readelf -d "$path_name"/out | grep -q 'NEEDED.*\[libfoo.so\]'
+LD_LIBRARY_PATH="$path_name" qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out > "$path_name"/log
+grep -q '^11 1 1$' "$path_name"/log
+grep -q '^Hello from the library$' "$path_name"/log
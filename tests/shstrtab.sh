@@ -0,0 +1,29 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+int main() {
+    printf("Hello World!\n");
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+# e_shstrndx points to .shstrtab, and every section has a name.
+shstrndx=$(readelf -h "$path_name"/out | awk '/string table index/ { print $NF }')
+readelf -SW "$path_name"/out | grep -q "\[ *$shstrndx\] \.shstrtab "
+readelf -SW "$path_name"/out | grep -q ' \.text '
+readelf -SW "$path_name"/out | grep -q ' \.data '
+
+# Symbols refer to their sections by index.
+text=$(readelf -SW "$path_name"/out | sed -n 's/.*\[ *\([0-9]*\)\] \.text .*/\1/p')
+readelf -sW "$path_name"/out | awk '$8 == "main" { print $7 }' | grep -qx "$text"
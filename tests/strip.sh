@@ -0,0 +1,55 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -g -Wa,-L -
+#include <stdio.h>
+
+static void hello() {
+    printf("Hello %s\n", "World!");
+}
+
+int main() {
+    hello();
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+readelf -SW "$path_name"/out | grep -q '\.debug_info'
+nm "$path_name"/out | grep -q ' t hello$'
+nm "$path_name"/out | grep -q ' \.L'
+
+# -s drops the symbol table and debug info.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,-s
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+if readelf -SW "$path_name"/out | grep -q '\.symtab\|\.strtab\|\.debug_'; then
+    exit 1
+fi
+
+# -S only drops debug info.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--strip-debug
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+nm "$path_name"/out | grep -q ' T main$'
+if readelf -SW "$path_name"/out | grep -q '\.debug_'; then
+    exit 1
+fi
+
+# -X drops only temporary local symbols.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,-X
+nm "$path_name"/out | grep -q ' t hello$'
+if nm "$path_name"/out | grep -q ' \.L'; then
+    exit 1
+fi
+
+# -x drops all local symbols.
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out -Wl,--discard-all
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+nm "$path_name"/out | grep -q ' T main$'
+if nm "$path_name"/out | grep -q ' t hello$'; then
+    exit 1
+fi
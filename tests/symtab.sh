@@ -0,0 +1,34 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+int counter = 3;
+
+static void hello(void) {
+    printf("Hello World!\n");
+}
+
+int main() {
+    hello();
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q 'Hello World!'
+
+readelf -SW "$path_name"/out | grep -q ' \.symtab '
+readelf -SW "$path_name"/out | grep -q ' \.strtab '
+
+# Globals and locals of the input end up in the symbol table.
+nm "$path_name"/out | grep -q ' T main$'
+nm "$path_name"/out | grep -q ' D counter$'
+nm "$path_name"/out | grep -q ' t hello$'
+nm "$path_name"/out | grep -Eq ' [TW] puts$'
@@ -0,0 +1,73 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+mkdir -p "$path_name"
+
+cat <<EOF | $CC -o "$path_name"/a.o -c -xc -
+#include <stdio.h>
+
+extern char _etext[], _edata[], __bss_start[], _end[];
+extern void (*__init_array_start[])(void);
+extern void (*__init_array_end[])(void);
+
+int data = 1;
+int bss[1000];
+int ctor_ran;
+
+__attribute__((constructor)) static void ctor(void) {
+    ctor_ran = 1;
+}
+
+int main() {
+    if ((char *)main >= _etext)
+        return 1;
+    if ((char *)&data >= _edata || _edata > __bss_start)
+        return 2;
+    if ((char *)&bss[999] >= _end)
+        return 3;
+    if (__init_array_end - __init_array_start < 1 || !ctor_ran)
+        return 4;
+    printf("OK\n");
+    return 0;
+}
+EOF
+
+$CC -B. -static "$path_name"/a.o -o "$path_name"/out
+qemu-riscv64 "$path_name"/out | grep -q '^OK$'
+
+# They are defined by the linker, so nothing else needs to.
+nm "$path_name"/out | grep -q ' _end$'
+nm "$path_name"/out | grep -q ' __bss_start$'
+
+# They are only defined if something refers to them, and hidden ones are
+# local to the output.
+$CC -B. "$path_name"/a.o -o "$path_name"/out2
+nm "$path_name"/out2 > "$path_name"/syms2
+grep -q '^[0-9a-f]* [a-z] _end$' "$path_name"/syms2
+grep -q '^[0-9a-f]* [a-z] __init_array_start$' "$path_name"/syms2
+for sym in __preinit_array_start __fini_array_start __rela_iplt_start __ehdr_start; do
+    if grep -q " $sym\$" "$path_name"/syms2; then
+        exit 1
+    fi
+done
+qemu-riscv64 -L /usr/riscv64-linux-gnu "$path_name"/out2 | grep -q '^OK$'
+
+# __ehdr_start needs the headers to be loaded.
+cat <<EOF | $CC -o "$path_name"/b.o -c -xassembler -
+.globl _start
+_start:
+    .quad __ehdr_start
+EOF
+
+cat <<EOF > "$path_name"/script
+MEMORY { ROM (rx) : ORIGIN = 0x10000, LENGTH = 64K }
+SECTIONS { .text : { *(.text) } > ROM }
+EOF
+
+if ./ld -T "$path_name"/script "$path_name"/b.o -o "$path_name"/out3 > "$path_name"/log 2>&1; then
+    exit 1
+fi
+grep -q '__ehdr_start is referenced, but the headers are not loaded' "$path_name"/log
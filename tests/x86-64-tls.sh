@@ -0,0 +1,59 @@
+#!/bin/bash
+set -e
+
+test_name=$(basename "$0" .sh)
+path_name=out/test/$test_name
+
+X86_CC=${X86_CC:-x86_64-linux-gnu-gcc}
+if ! command -v "$X86_CC" > /dev/null; then
+    echo "skipped: $X86_CC not found"
+    exit 0
+fi
+
+run=qemu-x86_64
+if [ "$(uname -m)" = x86_64 ]; then
+    run=
+fi
+
+mkdir -p "$path_name"
+
+# Compiled as PIC, x uses the general-dynamic model and y the
+# local-dynamic one.
+cat <<EOF | $X86_CC -o "$path_name"/a.o -c -xc -fPIC -O2 -
+__thread int x = 1;
+static __thread int y = 2;
+
+int *get_x(void) { return &x; }
+int *get_y(void) { return &y; }
+EOF
+
+cat <<EOF | $X86_CC -o "$path_name"/b.o -c -xc -O2 -
+#include <stdio.h>
+
+int *get_x(void);
+int *get_y(void);
+__thread int z = 3;
+
+int main() {
+    *get_x() += 10;
+    *get_y() += 20;
+    printf("%d %d %d\n", *get_x(), *get_y(), z);
+    return 0;
+}
+EOF
+
+# Static executables have no __tls_get_addr, so the calls to it must be
+# rewritten.
+$X86_CC -B. -static "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+$run "$path_name"/out | grep -q '^11 22 3$'
+if nm "$path_name"/out | grep -q __tls_get_addr; then
+    exit 1
+fi
+
+$X86_CC -B. "$path_name"/a.o "$path_name"/b.o -o "$path_name"/out
+$run "$path_name"/out | grep -q '^11 22 3$'
+
+# A shared library keeps calling __tls_get_addr.
+$X86_CC -B. -shared "$path_name"/a.o -o "$path_name"/liba.so
+$X86_CC -B. "$path_name"/b.o -o "$path_name"/out "$path_name"/liba.so
+LD_LIBRARY_PATH="$path_name" $run "$path_name"/out | grep -q '^11 22 3$'